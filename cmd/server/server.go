@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"gin-demo/pkg/controller"
+	"gin-demo/pkg/discovery"
+	"gin-demo/pkg/gateway"
 	"gin-demo/pkg/util/ginprom"
 	"gin-demo/pkg/util/logger"
+	"gin-demo/pkg/util/springcloud"
 	v1 "gin-demo/web/api/v1"
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
@@ -12,19 +17,63 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// repeatedFlag collects the values of a flag given several times
+type repeatedFlag []string
+
+func (f *repeatedFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *repeatedFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func main() {
+	// should cover the registry fetch interval of the peers, so that they stop routing to us
+	drainPeriod := flag.Duration("eureka-drain-period", 30*time.Second, "time to wait between marking the instance OUT_OF_SERVICE and deregistering it")
+	eurekaUrl := flag.String("eureka-url", "http://localhost:1111/eureka/", "comma separated eureka server urls, ignored when -eureka-dns-domain or -eureka-zone-urls is set")
+	eurekaDnsDomain := flag.String("eureka-dns-domain", "", "domain to resolve the eureka servers from, with txt.<region>.<domain> TXT records")
+	eurekaDnsSrv := flag.Bool("eureka-dns-srv", false, "resolve the eureka servers from the _eureka._tcp.<domain> SRV records instead")
+	eurekaDnsScheme := flag.String("eureka-dns-scheme", "", "scheme of the eureka servers found in dns, http or https, empty for https on port 443 and http otherwise")
+	eurekaRegion := flag.String("eureka-region", "default", "region of the eureka servers")
+	eurekaZone := flag.String("eureka-zone", "", "availability zone of this instance, its eureka servers are preferred with -eureka-dns-domain or -eureka-zone-urls")
+	eurekaZoneUrls := flag.String("eureka-zone-urls", "", "eureka server urls per availability zone, in failover order, e.g. zone1=http://a/eureka/,http://b/eureka/;zone2=http://c/eureka/. Replaces -eureka-url")
+	eurekaSnapshotFile := flag.String("eureka-snapshot-file", "eureka-registry.json", "registry snapshot used when eureka is down at startup, empty to disable")
+	eurekaSnapshotMaxAge := flag.Duration("eureka-snapshot-max-age", 24*time.Hour, "oldest -eureka-snapshot-file used at startup, 0 for any age")
+	eurekaToken := flag.String("eureka-token", "", "bearer token for the eureka servers, basic auth credentials go in -eureka-url")
+	eurekaCAFile := flag.String("eureka-ca-file", "", "PEM bundle of the CAs trusted for the eureka servers, on top of the system ones")
+	eurekaCertFile := flag.String("eureka-cert-file", "", "PEM client certificate for the eureka servers")
+	eurekaKeyFile := flag.String("eureka-key-file", "", "PEM key of -eureka-cert-file")
+	gatewayRules := flag.String("gateway-rules", "", "load balancing rule per application, e.g. demo-v1=RandomRule,demo-v2=LeastActiveRule")
+	gatewayHashKey := flag.String("gateway-hash-key", "", "key of the ConsistentHashRule, header:<name>, cookie:<name> or query:<name>")
+	gatewayPing := flag.String("gateway-ping", "", "probe the upstream instances, url for their health check url or tcp for their port, empty to trust eureka")
+	gatewayPingInterval := flag.Duration("gateway-ping-interval", 10*time.Second, "time between two probes of -gateway-ping")
+	gatewayOutlierDetection := flag.Bool("gateway-outlier-detection", false, "eject the upstream instances failing too many requests for a while")
+	gatewayMetadataFilter := flag.String("gateway-metadata-filter", "", "only route to the instances with this metadata, e.g. version=2,canary=false")
+	gatewayZoneAffinity := flag.Bool("gateway-zone-affinity", false, "prefer the upstream instances in -eureka-zone, other zones only when it has none")
+	gatewayRetry := flag.Bool("gateway-retry", false, "retry the idempotent requests failing with a connection error or a 502/503/504 on another instance")
+	gatewayRetryNextServer := flag.Int("gateway-retry-next-server", 1, "number of other instances tried by -gateway-retry")
+	gatewayCircuitBreaker := flag.String("gateway-circuit-breaker", "", "open a circuit on the upstreams failing or too slow, per application or per instance, empty to disable")
+	var gatewayPathRewrites repeatedFlag
+	flag.Var(&gatewayPathRewrites, "gateway-path-rewrite", "rewrite the path forwarded by /gateway/<app>, with <app>:StripPrefix=<segments>, <app>:RewritePath=<regexp>,<replacement> or <app>:PrefixPath=<path>. Repeat it for several filters, applied in order")
+	gatewayRoutes := flag.String("gateway-routes", "", "YAML or JSON file of the routes, like the ones of spring cloud gateway. Its retry, circuitBreaker and pathRewrites sections replace the -gateway flags of the same settings")
+	gatewayRoutesReloadInterval := flag.Duration("gateway-routes-reload-interval", 10*time.Second, "how often -gateway-routes is checked for changes, 0 to only reload it with POST /admin/gateway/reload. The -gateway flags need a restart")
+	flag.Parse()
 
-	newLogger, err := logger.NewLogger(&logger.LogConfig{
+	logConfig := &logger.LogConfig{
 		Level:      "Debug",
 		Filename:   "server.log",
 		MaxSize:    10,
 		MaxAge:     3,
 		MaxBackups: 3,
-	})
+	}
+	newLogger, err := logger.NewLogger(logConfig)
 	if err != nil {
 		fmt.Println("failed to new logger, ", err)
 		os.Exit(-1)
@@ -43,7 +92,105 @@ func main() {
 
 	ginprom.Register(r, "/metrics")
 
-	api := &v1.Api{}
+	api := &v1.Api{
+		LogFilename: logConfig.Filename,
+		Discovery: discovery.Config{
+			ApplicationName: "gin-demo",
+			ServiceUrl:      *eurekaUrl,
+			Zone:            *eurekaZone,
+			SnapshotFile:    *eurekaSnapshotFile,
+			SnapshotMaxAge:  *eurekaSnapshotMaxAge,
+			Security: springcloud.SecurityConfig{
+				BearerToken: *eurekaToken,
+				CAFile:      *eurekaCAFile,
+				CertFile:    *eurekaCertFile,
+				KeyFile:     *eurekaKeyFile,
+			},
+		},
+	}
+	api.GatewayHashKey = *gatewayHashKey
+	api.GatewayPing = *gatewayPing
+	api.GatewayPingInterval = *gatewayPingInterval
+	if *gatewayOutlierDetection {
+		config := springcloud.DefaultOutlierConfig()
+		api.GatewayOutlierDetection = &config
+	}
+	if *gatewayRetry {
+		config := controller.DefaultRetryConfig()
+		config.MaxAutoRetriesNextServer = *gatewayRetryNextServer
+		api.GatewayRetry = &config
+	}
+	switch *gatewayCircuitBreaker {
+	case "":
+	case "application", "instance":
+		config := springcloud.DefaultCircuitBreakerConfig()
+		api.GatewayCircuitBreaker = &config
+		api.GatewayCircuitBreakerPerInstance = *gatewayCircuitBreaker == "instance"
+	default:
+		fmt.Println("invalid -gateway-circuit-breaker:", *gatewayCircuitBreaker)
+		os.Exit(-1)
+	}
+	api.GatewayZoneAffinity = *gatewayZoneAffinity
+	api.GatewayRoutesFile = *gatewayRoutes
+	api.GatewayRoutesReloadInterval = *gatewayRoutesReloadInterval
+	if *gatewayMetadataFilter != "" {
+		api.GatewayMetadataFilters = strings.Split(*gatewayMetadataFilter, ",")
+	}
+	if *gatewayRules != "" {
+		api.GatewayRules = map[string]string{}
+		for _, appRule := range strings.Split(*gatewayRules, ",") {
+			parts := strings.SplitN(strings.TrimSpace(appRule), "=", 2)
+			if len(parts) != 2 {
+				fmt.Println("invalid -gateway-rules entry:", appRule)
+				os.Exit(-1)
+			}
+			api.GatewayRules[parts[0]] = parts[1]
+		}
+	}
+	for _, appFilter := range gatewayPathRewrites {
+		parts := strings.SplitN(appFilter, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			fmt.Println("invalid -gateway-path-rewrite:", appFilter)
+			os.Exit(-1)
+		}
+		if _, err := gateway.ParsePathRewrite(parts[1:]); err != nil {
+			fmt.Println("invalid -gateway-path-rewrite:", err)
+			os.Exit(-1)
+		}
+		if api.GatewayPathRewrites == nil {
+			api.GatewayPathRewrites = map[string][]string{}
+		}
+		api.GatewayPathRewrites[parts[0]] = append(api.GatewayPathRewrites[parts[0]], parts[1])
+	}
+	if *eurekaZoneUrls != "" {
+		zones := &springcloud.ZoneConfig{
+			Region:      *eurekaRegion,
+			Zone:        *eurekaZone,
+			ServiceUrls: map[string]string{},
+		}
+		for _, zoneUrls := range strings.Split(*eurekaZoneUrls, ";") {
+			parts := strings.SplitN(strings.TrimSpace(zoneUrls), "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				fmt.Println("invalid -eureka-zone-urls entry:", zoneUrls)
+				os.Exit(-1)
+			}
+			zones.AvailabilityZones = append(zones.AvailabilityZones, parts[0])
+			zones.ServiceUrls[parts[0]] = parts[1]
+		}
+		if zones.Zone == "" {
+			zones.Zone = zones.AvailabilityZones[0]
+		}
+		api.Discovery.Zones = zones
+	}
+	if *eurekaDnsDomain != "" {
+		api.Discovery.Dns = &springcloud.DnsConfig{
+			Domain: *eurekaDnsDomain,
+			Region: *eurekaRegion,
+			Zone:   *eurekaZone,
+			Scheme: *eurekaDnsScheme,
+			UseSrv: *eurekaDnsSrv,
+		}
+	}
 	api.Register(r)
 
 	listenAddress := ":8080"
@@ -74,6 +221,9 @@ func main() {
 	<-quit
 	log.Println("Shutting down server...")
 
+	log.Println("Deregistering from eureka, draining for", *drainPeriod)
+	api.Shutdown(*drainPeriod)
+
 	// The context is used to inform the server it has 5 seconds to finish
 	// the request it is currently handling
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"gin-demo/pkg/gateway"
+	"gin-demo/pkg/util/springcloud"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// errCircuitOpen tells that the circuit of the instance kept the request from being sent
+	errCircuitOpen = errors.New("circuit open")
+	// errApplicationCircuitOpen tells the same of the circuit of the whole application
+	errApplicationCircuitOpen = errors.New("application circuit open")
+)
+
+// circuitBreakers hands out the circuit breakers of the applications, or of their instances,
+// creating them on first use. Only the requests sent to an instance count, a request failing
+// before, e.g. for an unknown application, neither takes a permit nor counts as a failure
+type circuitBreakers struct {
+	lock        *sync.Mutex
+	config      *springcloud.CircuitBreakerConfig // nil without circuit breakers
+	perInstance bool
+	breakers    map[string]*springcloud.CircuitBreaker // by breakerName
+}
+
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{
+		lock:     new(sync.Mutex),
+		breakers: map[string]*springcloud.CircuitBreaker{},
+	}
+}
+
+// configure replaces the config, nil disables the circuit breakers. The breakers of the previous
+// config are dropped, unless it is the same: a reload of the routes file keeps the open circuits
+func (b *circuitBreakers) configure(config *springcloud.CircuitBreakerConfig, perInstance bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	same := b.config == config || (b.config != nil && config != nil && *b.config == *config)
+	if same && b.perInstance == perInstance {
+		return
+	}
+	b.config = config
+	b.perInstance = perInstance
+	for name, breaker := range b.breakers {
+		breaker.Remove()
+		delete(b.breakers, name)
+	}
+}
+
+// of returns the breaker of the instance, or of its application unless the circuits are per instance,
+// perInstance tells which. The breaker is nil without circuit breakers
+func (b *circuitBreakers) of(instance *springcloud.ApplicationInstance) (breaker *springcloud.CircuitBreaker, perInstance bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.config == nil {
+		return nil, false
+	}
+	name := breakerName(instance.App, "")
+	if b.perInstance {
+		name = breakerName(instance.App, instance.InstanceId)
+	}
+	breaker, exist := b.breakers[name]
+	if !exist {
+		breaker = springcloud.NewCircuitBreaker(name, *b.config)
+		b.breakers[name] = breaker
+	}
+	return breaker, b.perInstance
+}
+
+// remove drops the breaker of an application or instance which left the registry, with its gauge
+func (b *circuitBreakers) remove(name string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if breaker, exist := b.breakers[name]; exist {
+		breaker.Remove()
+		delete(b.breakers, name)
+	}
+}
+
+// circuitBreakerConfigOf checks the circuitBreaker section of a routes file, the fields left out keep
+// their default but the rates, which are 0
+func circuitBreakerConfigOf(definition *gateway.CircuitBreakerDefinition) (springcloud.CircuitBreakerConfig, error) {
+	if definition.FailureRate < 0 || definition.FailureRate > 1 || definition.SlowCallRate < 0 || definition.SlowCallRate > 1 {
+		return springcloud.CircuitBreakerConfig{}, fmt.Errorf("invalid circuit breaker, the rates are between 0 and 1")
+	}
+	if definition.FailureRate == 0 && definition.SlowCallRate == 0 {
+		return springcloud.CircuitBreakerConfig{}, fmt.Errorf("invalid circuit breaker, it needs a failureRate or a slowCallRate")
+	}
+	if definition.MinRequests < 0 || definition.HalfOpenRequests < 0 {
+		return springcloud.CircuitBreakerConfig{}, fmt.Errorf("invalid circuit breaker, the requests cannot be negative")
+	}
+	config := springcloud.DefaultCircuitBreakerConfig()
+	config.FailureRate = definition.FailureRate
+	config.SlowCallRate = definition.SlowCallRate
+	if definition.Window > 0 {
+		config.Window = time.Duration(definition.Window)
+	}
+	if definition.MinRequests > 0 {
+		config.MinRequests = definition.MinRequests
+	}
+	if definition.SlowCallDuration > 0 {
+		config.SlowCallDuration = time.Duration(definition.SlowCallDuration)
+	}
+	if definition.OpenDuration > 0 {
+		config.OpenDuration = time.Duration(definition.OpenDuration)
+	}
+	if definition.HalfOpenRequests > 0 {
+		config.HalfOpenRequests = definition.HalfOpenRequests
+	}
+	return config, nil
+}
+
+// breakerName is the upper case application, followed by the instance for the breakers per instance
+func breakerName(appName, instanceId string) string {
+	if instanceId == "" {
+		return strings.ToUpper(appName)
+	}
+	return strings.ToUpper(appName) + "/" + instanceId
+}
+
+// onRegistryEvent forgets the circuit breakers of the applications and instances leaving the registry,
+// so that the churn of the instances does not pile up breakers and gauges
+func (controller *GatewayController) onRegistryEvent(event springcloud.RegistryEvent) {
+	switch {
+	case event.Type == springcloud.ApplicationRemoved:
+		controller.breakers.remove(breakerName(event.AppName, ""))
+	case event.Instance == nil && event.Previous != nil:
+		controller.breakers.remove(breakerName(event.Previous.App, event.Previous.InstanceId))
+	}
+}
+
+func circuitOpenResponse(name string) *gatewayResponse {
+	return &gatewayResponse{
+		Code: -1,
+		Msg:  "service unavailable, circuit open:" + name,
+	}
+}
@@ -7,24 +7,34 @@ import (
 )
 
 type EurekaController struct {
+	eureka *springcloud.Eureka
+}
+
+// NewEurekaController serves the registry of eureka, which is shared and started by the caller
+func NewEurekaController(eureka *springcloud.Eureka) *EurekaController {
+	return &EurekaController{eureka: eureka}
 }
 
 func (controller *EurekaController) Handle(r *gin.Engine) {
-	eureka := springcloud.NewEureka("http://localhost:1111/eureka/", "gin-demo", 30, true, true)
-	err := eureka.Start()
-	if err != nil {
-		panic("eureka start failed: " + err.Error())
-	}
+	eureka := controller.eureka
 	eurekaGroup := r.Group("eureka")
 	{
 		eurekaGroup.GET("/apps", func(context *gin.Context) {
 			responseJson(context, func() (data interface{}, err error) {
-				return eureka.GetApplications()
+				applications, err := eureka.GetApplications()
+				if err != nil && eureka.Stale() {
+					markStale(context)
+					return eureka.CachedApplications(), nil
+				}
+				return applications, err
 			})
 		})
 		eurekaGroup.GET("/apps/:appId", func(context *gin.Context) {
 			responseJson(context, func() (data interface{}, err error) {
 				appId := context.Param("appId")
+				if eureka.Stale() {
+					markStale(context)
+				}
 				application, exist := eureka.GetApplication(appId)
 				if exist {
 					return application, nil
@@ -34,4 +44,44 @@ func (controller *EurekaController) Handle(r *gin.Engine) {
 			})
 		})
 	}
+
+	// take the instance in and out of rotation without restarting it, e.g. for blue/green drains
+	adminGroup := r.Group("admin/eureka")
+	{
+		adminGroup.GET("/status", func(context *gin.Context) {
+			responseJson(context, func() (data interface{}, err error) {
+				// eureka reports the override, if any, instead of the status of the instance
+				status, overriddenStatus := eureka.Status(), eureka.StatusOverride()
+				if overriddenStatus != "" {
+					status = overriddenStatus
+				} else {
+					overriddenStatus = springcloud.StatusUnknown
+				}
+				return gin.H{"instanceId": eureka.InstanceId(), "status": status, "overriddenStatus": overriddenStatus}, nil
+			})
+		})
+		adminGroup.PUT("/status", func(context *gin.Context) {
+			responseJson(context, func() (data interface{}, err error) {
+				type StatusOverride struct {
+					Value string `form:"value" binding:"required,oneof=UP OUT_OF_SERVICE DOWN"`
+				}
+				var statusOverride StatusOverride
+				if err := context.ShouldBind(&statusOverride); err != nil {
+					return parameterValidationError(err)
+				}
+
+				return nil, eureka.SetStatusOverride(statusOverride.Value)
+			})
+		})
+		adminGroup.DELETE("/status", func(context *gin.Context) {
+			responseJson(context, func() (data interface{}, err error) {
+				return nil, eureka.ClearStatusOverride()
+			})
+		})
+	}
+}
+
+// markStale flags a response built from the registry snapshot, eureka has been unreachable since the start
+func markStale(context *gin.Context) {
+	context.Header("X-Registry-Stale", "true")
 }
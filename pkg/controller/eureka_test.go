@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"gin-demo/pkg/util/jsonlib"
+	"gin-demo/pkg/util/springcloud"
+	"gin-demo/pkg/util/springcloud/eurekatest"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// serve runs one request through the engine and decodes the api response
+func serve(t *testing.T, r *gin.Engine, method, target string) apiResponse {
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+	var response apiResponse
+	if err := jsonlib.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s %s: invalid response %s: %s", method, target, recorder.Body.String(), err)
+	}
+	return response
+}
+
+func TestEurekaController_Status(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := eurekatest.NewServer()
+	defer server.Close()
+
+	eureka := springcloud.NewEureka(server.ServiceUrl(), "gin-demo", 30, true, true)
+	eureka.HostName = "demo-host"
+	if err := eureka.Start(); err != nil {
+		t.Fatal("eureka start failed: ", err)
+	}
+	defer eureka.Stop()
+
+	r := gin.New()
+	NewEurekaController(eureka).Handle(r)
+
+	expectStatus := func(status, overriddenStatus string) {
+		t.Helper()
+		response := serve(t, r, http.MethodGet, "/admin/eureka/status")
+		data, _ := response.Data.(map[string]interface{})
+		if response.Code != 0 || data["status"] != status || data["overriddenStatus"] != overriddenStatus {
+			t.Fatalf("wrong status, expected:%s/%s, actual:%+v", status, overriddenStatus, response)
+		}
+	}
+
+	expectStatus(springcloud.StatusUp, springcloud.StatusUnknown)
+
+	if response := serve(t, r, http.MethodPut, "/admin/eureka/status?value=SLEEPING"); response.Code == 0 {
+		t.Fatal("an unknown status is not a valid override")
+	}
+	if response := serve(t, r, http.MethodPut, "/admin/eureka/status?value=OUT_OF_SERVICE"); response.Code != 0 {
+		t.Fatal("failed to override status: ", response.Msg)
+	}
+	expectStatus(springcloud.StatusOutOfService, springcloud.StatusOutOfService)
+	if instance, _ := server.Instance("gin-demo", eureka.InstanceId()); instance.Status != springcloud.StatusOutOfService {
+		t.Fatalf("status not overridden in eureka, actual:%s", instance.Status)
+	}
+
+	if response := serve(t, r, http.MethodDelete, "/admin/eureka/status"); response.Code != 0 {
+		t.Fatal("failed to clear status override: ", response.Msg)
+	}
+	expectStatus(springcloud.StatusUp, springcloud.StatusUnknown)
+	if instance, _ := server.Instance("gin-demo", eureka.InstanceId()); instance.Status != springcloud.StatusUp {
+		t.Fatalf("status override not cleared in eureka, actual:%s", instance.Status)
+	}
+}
@@ -1,8 +1,12 @@
 package controller
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
+	"gin-demo/pkg/gateway"
 	"gin-demo/pkg/util/jsonlib"
 	"gin-demo/pkg/util/springcloud"
 	"github.com/gin-gonic/gin"
@@ -14,6 +18,8 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -42,6 +48,17 @@ var (
 type GatewayController struct {
 	ribbon     *springcloud.Ribbon
 	httpClient *http.Client
+	// where the key of the sticky rules comes from, see SetHashKey
+	hashKeySource string
+	hashKeyName   string
+	denyList      *springcloud.DenyList
+	// startup are the policies given by the Set methods, policies the ones in use, see ApplyConfig
+	startup     policies
+	policies    atomic.Value // *policies
+	breakers    *circuitBreakers
+	routes      atomic.Value // *gateway.RouteTable, see SetRoutes
+	reloader    *gateway.Reloader
+	unsubscribe func() // stops following the registry, see onRegistryEvent
 }
 
 type gatewayResponse struct {
@@ -58,11 +75,9 @@ type upstreamServiceResponse struct {
 	Data interface{} `json:"data"`
 }
 
-func NewGatewayController(serverUrl string, applicationName string) (*GatewayController, error) {
-	ribbon := springcloud.NewRibbon(serverUrl, applicationName, 30, true, true)
-	if err := ribbon.Start(); err != nil {
-		return nil, err
-	}
+// NewGatewayController routes to the instances in the registry of eureka, which is shared and started by the caller
+func NewGatewayController(eureka *springcloud.Eureka) *GatewayController {
+	ribbon := springcloud.NewRibbonWithEureka(eureka)
 
 	httpClient := &http.Client{
 		Transport: &http.Transport{
@@ -89,82 +104,527 @@ func NewGatewayController(serverUrl string, applicationName string) (*GatewayCon
 		// Timeout: 10 * time.Second,
 	}
 
-	return &GatewayController{
+	controller := &GatewayController{
 		ribbon:     ribbon,
 		httpClient: httpClient,
-	}, nil
+		denyList:   springcloud.NewDenyList(),
+		startup: policies{
+			// no retry, see SetRetry
+			retry:     RetryConfig{Timeout: 10 * time.Second},
+			rewriters: map[string]gateway.PathRewrite{},
+		},
+		// no circuit breakers, see SetCircuitBreaker
+		breakers: newCircuitBreakers(),
+	}
+	controller.useStartupPolicies()
+	controller.unsubscribe = eureka.Subscribe(controller.onRegistryEvent)
+	return controller
 }
 
 func (controller *GatewayController) Handle(r *gin.Engine) {
 	gatewayGroup := r.Group("gateway")
 	{
-		gatewayGroup.Any("/:appId/:uri", func(c *gin.Context) {
-			defer func() {
-				if err := recover(); err != nil {
-					httpRequestPanic.Inc()
+		// the application alone goes to the root of its instances
+		gatewayGroup.Any("/:appId", controller.forwardRequest)
+		gatewayGroup.Any("/:appId/*path", controller.forwardRequest)
+	}
+	// the declared routes get what is left, see SetRoutes
+	r.NoRoute(controller.routeRequest)
+
+	// keep instances out of the gateway by hand, e.g. a misbehaving one still UP in eureka.
+	// The deny list only applies when it is part of the instance filter, see DenyList
+	adminGroup := r.Group("admin/gateway")
+	{
+		adminGroup.GET("/deny", func(context *gin.Context) {
+			responseJson(context, func() (data interface{}, err error) {
+				return gin.H{"instanceIds": controller.denyList.InstanceIds()}, nil
+			})
+		})
+		adminGroup.PUT("/deny/:instanceId", func(context *gin.Context) {
+			responseJson(context, func() (data interface{}, err error) {
+				controller.denyList.Add(context.Param("instanceId"))
+				controller.ribbon.RefreshFilters()
+				return nil, nil
+			})
+		})
+		adminGroup.DELETE("/deny/:instanceId", func(context *gin.Context) {
+			responseJson(context, func() (data interface{}, err error) {
+				controller.denyList.Remove(context.Param("instanceId"))
+				controller.ribbon.RefreshFilters()
+				return nil, nil
+			})
+		})
+		// the config in use stays when the file is invalid, the error tells why
+		adminGroup.POST("/reload", func(context *gin.Context) {
+			responseJson(context, func() (data interface{}, err error) {
+				if controller.reloader == nil {
+					return nil, errors.New("no routes file to reload")
 				}
-			}()
-
-			httpRequestTotal.Inc()
-			appId := c.Param("appId")
-			uri := c.Param("uri")
-			instance, exist := controller.ribbon.GetApplicationInstance(appId)
-			if !exist {
-				c.JSON(200, &gatewayResponse{
-					Code: -1,
-					Msg:  "service not found",
-				})
-				httpRequestForwardFail.Inc()
-				return
-			}
+				table, err := controller.reloader.Reload("admin request")
+				if err != nil {
+					return nil, err
+				}
+				routeIds := make([]string, 0, len(table.Routes()))
+				for _, route := range table.Routes() {
+					routeIds = append(routeIds, route.Id)
+				}
+				return gin.H{
+					"routes": routeIds,
+				}, nil
+			})
+		})
+	}
+}
+
+// forwardRequest sends /gateway/<appId>/<path> to <path> on an instance of appId
+func (controller *GatewayController) forwardRequest(c *gin.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			httpRequestPanic.Inc()
+		}
+	}()
 
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
+	httpRequestTotal.Inc()
+	appId := c.Param("appId")
+	// the escaped path keeps the encoded characters, the gateway and application segments are left out
+	path := gateway.StripSegments(c.Request.URL.EscapedPath(), 2)
+	policies := controller.currentPolicies()
+	if rewrite, exist := policies.rewriters[strings.ToUpper(appId)]; exist {
+		path = rewrite.Rewrite(path)
+	}
+	controller.proxy(c, policies.retry, appId, path)
+}
 
-			u := &url.URL{
-				Scheme:   "http",
-				Host:     instance.IpAddr + ":" + strconv.Itoa(instance.Port),
-				Path:     "/" + uri,
-				RawQuery: c.Request.URL.RawQuery,
+// routeRequest sends the requests no other handler took to the first matching route, if any.
+// The lb:// routes are proxied like /gateway/<appId>/<path>, with the retry and the circuit breakers.
+// A static url gets each request once within the retry timeout, the retry and the circuit breakers
+// being about the instances of the applications in eureka
+func (controller *GatewayController) routeRequest(c *gin.Context) {
+	table, _ := controller.routes.Load().(*gateway.RouteTable)
+	if table == nil {
+		return
+	}
+	route, exchange, exist := table.Match(c.Request)
+	if !exist {
+		// gin answers its default 404
+		return
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			httpRequestPanic.Inc()
+		}
+	}()
+
+	httpRequestTotal.Inc()
+	c.Request.Header = exchange.Header
+	retry := controller.currentPolicies().retry
+	if route.LoadBalanced() {
+		controller.proxy(c, retry, route.ServiceId(), exchange.Path)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), retry.Timeout)
+	defer cancel()
+	request, err := newRequest(ctx, c, route.Uri.Scheme, route.Uri.Host, exchange.Path, nil, false)
+	if err != nil {
+		c.JSON(200, &gatewayResponse{
+			Code: -1,
+			Msg:  "failed to create request:" + err.Error(),
+		})
+		httpRequestForwardFail.Inc()
+		return
+	}
+	response, err := controller.httpClient.Do(request)
+	if err != nil {
+		c.JSON(200, &gatewayResponse{
+			Code: -1,
+			Msg:  "failed to access service:" + err.Error(),
+		})
+		httpRequestForwardFail.Inc()
+		return
+	}
+	httpRequestForwardSuccess.Inc()
+	controller.writeResponse(c, response)
+}
+
+// proxy sends the request to path on an instance of appId, path being escaped
+func (controller *GatewayController) proxy(c *gin.Context, retry RetryConfig, appId, path string) {
+	var body []byte
+	replayable := false
+	if retry.enabled() {
+		var err error
+		if body, replayable, err = bufferBody(c.Request, retry.MaxBodySize); err != nil {
+			c.JSON(200, &gatewayResponse{
+				Code: -1,
+				Msg:  "failed to read request:" + err.Error(),
+			})
+			httpRequestForwardFail.Inc()
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), retry.Timeout)
+	defer cancel()
+
+	instance, response, failure := controller.forward(ctx, c, retry, appId, path, body, replayable)
+	if instance != nil {
+		defer controller.ribbon.ServerStats(instance).DecrementActiveRequests()
+	}
+	if failure != nil {
+		c.JSON(200, failure)
+		httpRequestForwardFail.Inc()
+		return
+	}
+
+	httpRequestForwardSuccess.Inc()
+	controller.writeResponse(c, response)
+}
+
+// writeResponse copies the response as is with the x-preserve-body header, otherwise wraps it in a gatewayResponse
+func (controller *GatewayController) writeResponse(c *gin.Context, response *http.Response) {
+	if preserveBody := response.Header.Get("x-preserve-body"); preserveBody != "" {
+		extraHeader := make(map[string]string)
+		for headerName, headerValues := range response.Header {
+			if len(headerValues) > 0 {
+				extraHeader[headerName] = headerValues[0]
 			}
-			request, err := http.NewRequestWithContext(ctx, c.Request.Method, u.String(), c.Request.Body)
-			if err != nil {
-				c.JSON(200, &gatewayResponse{
-					Code: -1,
-					Msg:  "failed to create request:" + err.Error(),
-				})
-				httpRequestForwardFail.Inc()
-				return
+		}
+		c.DataFromReader(response.StatusCode, response.ContentLength, response.Header.Get("content-length"), response.Body, extraHeader)
+		return
+	}
+
+	c.JSON(200, controller.parseUpstreamResponse(response))
+}
+
+// forward sends the request to an instance of appId, then again to the same or other instances
+// as the retry config allows. The caller decrements the active requests of the returned instance
+func (controller *GatewayController) forward(ctx context.Context, c *gin.Context, retry RetryConfig, appId, path string, body []byte, replayable bool) (*springcloud.ApplicationInstance, *http.Response, *gatewayResponse) {
+	instance, exist := controller.ribbon.GetApplicationInstance(appId, controller.hashKey(c))
+	if !exist {
+		return nil, nil, &gatewayResponse{
+			Code: -1,
+			Msg:  "service not found",
+		}
+	}
+
+	tried := map[string]bool{instance.InstanceId: true}
+	sameRetries, nextRetries := 0, 0
+	for {
+		request, err := controller.newUpstreamRequest(ctx, c, instance, path, body, replayable)
+		if err != nil {
+			return nil, nil, &gatewayResponse{
+				Code: -1,
+				Msg:  "failed to create request:" + err.Error(),
 			}
+		}
 
-			request.Header = c.Request.Header
+		controller.ribbon.ServerStats(instance).IncrementActiveRequests()
+		response, err := controller.send(instance, request)
+		if err == errCircuitOpen || err == errApplicationCircuitOpen {
+			// nothing was sent, another instance takes the request without spending a retry.
+			// The circuit of the application fails it fast, it is the same for every instance
+			controller.ribbon.ServerStats(instance).DecrementActiveRequests()
+			if err == errApplicationCircuitOpen {
+				return nil, nil, circuitOpenResponse(appId)
+			}
+			if instance = controller.chooseOther(appId, tried); instance == nil {
+				return nil, nil, circuitOpenResponse(appId)
+			}
+			continue
+		}
 
-			response, err := controller.httpClient.Do(request)
+		var next *springcloud.ApplicationInstance
+		var target string
+		if replayable && retry.retryable(ctx, c.Request, response, err) {
+			if sameRetries < retry.MaxAutoRetries {
+				next, target = instance, "same"
+				sameRetries++
+			} else if nextRetries < retry.MaxAutoRetriesNextServer {
+				if next, target = controller.chooseOther(appId, tried), "next"; next != nil {
+					nextRetries++
+					sameRetries = 0
+				}
+			}
+		}
+		if next == nil {
 			if err != nil {
-				c.JSON(200, &gatewayResponse{
+				return instance, nil, &gatewayResponse{
 					Code: -1,
 					Msg:  "failed to access service:" + err.Error(),
-				})
-				httpRequestForwardFail.Inc()
-				return
+				}
 			}
+			return instance, response, nil
+		}
 
-			httpRequestForwardSuccess.Inc()
+		if response != nil {
+			response.Body.Close()
+		}
+		controller.ribbon.ServerStats(instance).DecrementActiveRequests()
+		httpRequestRetry.WithLabelValues(target).Inc()
+		instance = next
+	}
+}
 
-			if preserveBody := response.Header.Get("x-preserve-body"); preserveBody != "" {
-				extraHeader := make(map[string]string)
-				for headerName, headerValues := range response.Header {
-					if len(headerValues) > 0 {
-						extraHeader[headerName] = headerValues[0]
-					}
-				}
-				c.DataFromReader(response.StatusCode, response.ContentLength, response.Header.Get("content-length"), response.Body, extraHeader)
-				return
+// chooseOther asks the ribbon for an instance not tried yet, without the hash key,
+// which would give the same instance again
+func (controller *GatewayController) chooseOther(appId string, tried map[string]bool) *springcloud.ApplicationInstance {
+	// the rules spread the choices, a few attempts are enough to skip the tried instances
+	for i := 0; i < 3; i++ {
+		instance, exist := controller.ribbon.GetApplicationInstance(appId, "")
+		if !exist {
+			return nil
+		}
+		if !tried[instance.InstanceId] {
+			tried[instance.InstanceId] = true
+			return instance
+		}
+	}
+	return nil
+}
+
+// newUpstreamRequest sends the request to path on instance, path being escaped
+func (controller *GatewayController) newUpstreamRequest(ctx context.Context, c *gin.Context, instance *springcloud.ApplicationInstance, path string, body []byte, replayable bool) (*http.Request, error) {
+	scheme, port := "http", instance.Port
+	if instance.Secure() {
+		scheme, port = "https", instance.SecurePort
+	}
+	return newRequest(ctx, c, scheme, instance.IpAddr+":"+strconv.Itoa(port), path, body, replayable)
+}
+
+// newRequest copies the request of c to path on host, with body if replayable and the original body otherwise
+func newRequest(ctx context.Context, c *gin.Context, scheme, host, path string, body []byte, replayable bool) (*http.Request, error) {
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return nil, err
+	}
+	u := &url.URL{
+		Scheme:   scheme,
+		Host:     host,
+		Path:     unescaped,
+		RawPath:  path,
+		RawQuery: c.Request.URL.RawQuery,
+	}
+
+	var bodyReader io.Reader
+	switch {
+	case !replayable:
+		bodyReader = c.Request.Body
+	case body != nil:
+		bodyReader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, c.Request.Method, u.String(), bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	request.Header = c.Request.Header
+	return request, nil
+}
+
+// send reports the outcome of the request to the stats, the outlier detection and the circuit breaker.
+// The request is only sent if the circuit of the instance or of its application lets it through,
+// errCircuitOpen or errApplicationCircuitOpen tell it was not. Each attempt counts on its own, with its own duration
+func (controller *GatewayController) send(instance *springcloud.ApplicationInstance, request *http.Request) (*http.Response, error) {
+	breaker, perInstance := controller.breakers.of(instance)
+	if breaker != nil && !breaker.Allow() {
+		if perInstance {
+			return nil, errCircuitOpen
+		}
+		return nil, errApplicationCircuitOpen
+	}
+
+	stats := controller.ribbon.ServerStats(instance)
+	start := time.Now()
+	response, err := controller.httpClient.Do(request)
+	if breaker != nil {
+		breaker.Record(time.Since(start), err != nil || response.StatusCode >= http.StatusInternalServerError)
+	}
+	if err != nil {
+		if isConnectionFailure(err) {
+			stats.NoteConnectionFailure()
+		}
+		// connection errors and timeouts alike
+		controller.ribbon.ReportFailure(instance)
+		return nil, err
+	}
+
+	stats.NoteSuccess()
+	if response.StatusCode >= http.StatusInternalServerError {
+		controller.ribbon.ReportFailure(instance)
+	} else {
+		controller.ribbon.ReportSuccess(instance)
+	}
+	return response, nil
+}
+
+// SetRetry sends the failed requests again as config allows, call it before Handle.
+// A zero Timeout keeps the default of 10 seconds
+func (controller *GatewayController) SetRetry(config RetryConfig) {
+	if config.Timeout <= 0 {
+		config.Timeout = controller.startup.retry.Timeout
+	}
+	controller.startup.retry = config
+	controller.useStartupPolicies()
+}
+
+// SetCircuitBreaker rejects the requests to the applications failing or too slow for a while,
+// or to their instances when perInstance is set. Call it before Handle
+func (controller *GatewayController) SetCircuitBreaker(config springcloud.CircuitBreakerConfig, perInstance bool) {
+	controller.startup.breaker = &config
+	controller.startup.perInstance = perInstance
+	controller.useStartupPolicies()
+}
+
+// SetPathRewrite changes the path of the requests forwarded to appId with StripPrefix, PrefixPath
+// and RewritePath filters, see gateway.ParsePathRewrite. Call it before Handle
+func (controller *GatewayController) SetPathRewrite(appId string, filters []string) error {
+	rewrite, err := gateway.ParsePathRewrite(filters)
+	if err != nil {
+		return err
+	}
+	controller.startup.rewriters[strings.ToUpper(appId)] = rewrite
+	controller.useStartupPolicies()
+	return nil
+}
+
+// SetRoutes serves the requests matching no other handler with table, on top of /gateway/<appId>/<path>
+func (controller *GatewayController) SetRoutes(table *gateway.RouteTable) {
+	controller.routes.Store(table)
+}
+
+// ApplyConfig serves the routes of a routes file, see SetRoutes, with its retry, circuit breaker and path
+// rewrites in place of the ones set at startup. An invalid section is an error and nothing changes,
+// e.g. for gateway.NewReloader
+func (controller *GatewayController) ApplyConfig(config *gateway.Config, table *gateway.RouteTable) error {
+	next := controller.startup
+	if config.Retry != nil {
+		retry, err := retryConfigOf(config.Retry)
+		if err != nil {
+			return err
+		}
+		next.retry = retry
+	}
+	if config.CircuitBreaker != nil {
+		breaker, err := circuitBreakerConfigOf(config.CircuitBreaker)
+		if err != nil {
+			return err
+		}
+		next.breaker, next.perInstance = &breaker, config.CircuitBreaker.PerInstance
+	}
+	if len(config.PathRewrites) > 0 {
+		next.rewriters = make(map[string]gateway.PathRewrite, len(controller.startup.rewriters)+len(config.PathRewrites))
+		for appId, rewrite := range controller.startup.rewriters {
+			next.rewriters[appId] = rewrite
+		}
+		for appId, filters := range config.PathRewrites {
+			rewrite, err := gateway.ParsePathRewrite(filters)
+			if err != nil {
+				return fmt.Errorf("invalid path rewrite of %s:%s", appId, err)
 			}
+			next.rewriters[strings.ToUpper(appId)] = rewrite
+		}
+	}
 
-			c.JSON(200, controller.parseUpstreamResponse(response))
-		})
+	controller.breakers.configure(next.breaker, next.perInstance)
+	controller.policies.Store(&next)
+	controller.routes.Store(table)
+	return nil
+}
+
+// policies are the settings of the requests to the applications which a routes file may replace
+type policies struct {
+	retry       RetryConfig
+	breaker     *springcloud.CircuitBreakerConfig // nil without circuit breakers
+	perInstance bool
+	rewriters   map[string]gateway.PathRewrite // by upper case application name
+}
+
+func (controller *GatewayController) useStartupPolicies() {
+	startup := controller.startup
+	controller.breakers.configure(startup.breaker, startup.perInstance)
+	controller.policies.Store(&startup)
+}
+
+func (controller *GatewayController) currentPolicies() *policies {
+	return controller.policies.Load().(*policies)
+}
+
+// SetReloader lets admin/gateway/reload load the routes file again, see ApplyConfig
+func (controller *GatewayController) SetReloader(reloader *gateway.Reloader) {
+	controller.reloader = reloader
+}
+
+// SetRule makes the requests to appId balanced by rule, round robin is the default
+func (controller *GatewayController) SetRule(appId string, rule springcloud.IRule) {
+	controller.ribbon.SetRule(appId, rule)
+}
+
+// SetHashKey tells where to find the key given to the sticky rules like springcloud.ConsistentHashRule,
+// spec is one of "header:<name>", "cookie:<name>" or "query:<name>". Call it before Handle
+func (controller *GatewayController) SetHashKey(spec string) error {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return fmt.Errorf("invalid hash key:%s", spec)
 	}
+	switch parts[0] {
+	case "header", "cookie", "query":
+		controller.hashKeySource, controller.hashKeyName = parts[0], parts[1]
+		return nil
+	default:
+		return fmt.Errorf("invalid hash key source:%s", parts[0])
+	}
+}
+
+func (controller *GatewayController) hashKey(c *gin.Context) string {
+	switch controller.hashKeySource {
+	case "header":
+		return c.GetHeader(controller.hashKeyName)
+	case "cookie":
+		value, _ := c.Cookie(controller.hashKeyName)
+		return value
+	case "query":
+		return c.Query(controller.hashKeyName)
+	default:
+		return ""
+	}
+}
+
+// SetPing probes the instances each interval, those failing the probe get no traffic until they recover
+func (controller *GatewayController) SetPing(ping springcloud.IPing, interval time.Duration) {
+	controller.ribbon.SetPing(ping, interval)
+}
+
+// SetOutlierDetection ejects the instances failing too many requests for a while
+func (controller *GatewayController) SetOutlierDetection(config springcloud.OutlierConfig) {
+	controller.ribbon.SetOutlierDetection(config)
+}
+
+// DenyList is the list of the instances taken out by hand through admin/gateway/deny,
+// to be made part of the instance filter of eureka or of SetInstanceFilter
+func (controller *GatewayController) DenyList() *springcloud.DenyList {
+	return controller.denyList
+}
+
+// SetInstanceFilter decides which instances take traffic, the filter of eureka by default
+func (controller *GatewayController) SetInstanceFilter(filter springcloud.InstanceFilter) {
+	controller.ribbon.SetInstanceFilter(filter)
+}
+
+// RefreshFilters applies the instance filter again, after a change of the filter of eureka
+func (controller *GatewayController) RefreshFilters() {
+	controller.ribbon.RefreshFilters()
+}
+
+// Stop stops following the registry
+func (controller *GatewayController) Stop() {
+	controller.unsubscribe()
+	controller.ribbon.Stop()
+}
+
+// isConnectionFailure tells whether the instance could not be reached at all
+func isConnectionFailure(err error) bool {
+	var opError *net.OpError
+	return errors.As(err, &opError) && opError.Op == "dial"
 }
 
 func (controller *GatewayController) parseUpstreamResponse(response *http.Response) *gatewayResponse {
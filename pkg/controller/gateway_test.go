@@ -0,0 +1,746 @@
+package controller
+
+import (
+	"fmt"
+	"gin-demo/pkg/gateway"
+	"gin-demo/pkg/util/jsonlib"
+	"gin-demo/pkg/util/springcloud"
+	"gin-demo/pkg/util/springcloud/eurekatest"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// upstream answers every request with its status code and its name, and remembers the urls it got
+type upstream struct {
+	*httptest.Server
+	hits       int32
+	statusCode int32
+	lock       *sync.Mutex
+	urls       []string
+}
+
+func newUpstream(name string, statusCode int) *upstream {
+	u := &upstream{statusCode: int32(statusCode), lock: new(sync.Mutex)}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&u.hits, 1)
+		u.lock.Lock()
+		u.urls = append(u.urls, r.URL.RequestURI())
+		u.lock.Unlock()
+		statusCode := int(atomic.LoadInt32(&u.statusCode))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		fmt.Fprintf(w, `{"code":%d,"msg":"%s","data":"%s"}`, statusCode, http.StatusText(statusCode), name)
+	}))
+	return u
+}
+
+func (u *upstream) Hits() int {
+	return int(atomic.LoadInt32(&u.hits))
+}
+
+func (u *upstream) setStatusCode(statusCode int) {
+	atomic.StoreInt32(&u.statusCode, int32(statusCode))
+}
+
+// lastUrl is the escaped path and query of the last request
+func (u *upstream) lastUrl() string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if len(u.urls) == 0 {
+		return ""
+	}
+	return u.urls[len(u.urls)-1]
+}
+
+func (u *upstream) port() int {
+	return u.Listener.Addr().(*net.TCPAddr).Port
+}
+
+// newTestGateway serves the upstreams as the instances of demo-v1, set up lets the test configure
+// the gateway before Handle
+func newTestGateway(t *testing.T, setUp func(controller *GatewayController), upstreams ...*upstream) (*gin.Engine, func()) {
+	gin.SetMode(gin.TestMode)
+	server := eurekatest.NewServer()
+	for i, u := range upstreams {
+		server.Register(eurekatest.NewInstance("demo-v1", fmt.Sprintf("demo-v1-%d", i), "127.0.0.1", u.port()))
+	}
+
+	eureka := springcloud.NewEureka(server.ServiceUrl(), "gin-demo", 30, false, true)
+	if err := eureka.Start(); err != nil {
+		server.Close()
+		t.Fatal("eureka start failed: ", err)
+	}
+	controller := NewGatewayController(eureka)
+	if setUp != nil {
+		setUp(controller)
+	}
+	r := gin.New()
+	controller.Handle(r)
+
+	return r, func() {
+		controller.Stop()
+		eureka.Stop()
+		server.Close()
+	}
+}
+
+// forward sends a request through the gateway and decodes its response
+func forward(t *testing.T, r *gin.Engine, method, target string, header http.Header) gatewayResponse {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, target, strings.NewReader(`{"id":42}`))
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	r.ServeHTTP(recorder, request)
+	var response gatewayResponse
+	if err := jsonlib.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s %s: invalid response %s: %s", method, target, recorder.Body.String(), err)
+	}
+	return response
+}
+
+func retryWith(same, next int) func(controller *GatewayController) {
+	return func(controller *GatewayController) {
+		config := DefaultRetryConfig()
+		config.MaxAutoRetries = same
+		config.MaxAutoRetriesNextServer = next
+		controller.SetRetry(config)
+	}
+}
+
+func TestGatewayController_HashKey(t *testing.T) {
+	var upstreams []*upstream
+	for i := 0; i < 3; i++ {
+		u := newUpstream(fmt.Sprintf("demo-v1-%d", i), http.StatusOK)
+		defer u.Close()
+		upstreams = append(upstreams, u)
+	}
+
+	tests := []struct {
+		spec string
+		// request carries the key of a user
+		request func(user string) (target string, header http.Header)
+	}{
+		{"header:X-User-Id", func(user string) (string, http.Header) {
+			return "/gateway/demo-v1/orders", http.Header{"X-User-Id": {user}}
+		}},
+		{"cookie:user", func(user string) (string, http.Header) {
+			return "/gateway/demo-v1/orders", http.Header{"Cookie": {"theme=dark; user=" + user}}
+		}},
+		{"query:user", func(user string) (string, http.Header) {
+			return "/gateway/demo-v1/orders?page=2&user=" + user, nil
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			r, stop := newTestGateway(t, func(controller *GatewayController) {
+				controller.SetRule("demo-v1", springcloud.NewConsistentHashRule(0))
+				if err := controller.SetHashKey(test.spec); err != nil {
+					t.Fatal(err)
+				}
+			}, upstreams...)
+			defer stop()
+
+			// each user sticks to one instance, the users are spread over all of them
+			reached := map[interface{}]bool{}
+			for i := 0; i < 20; i++ {
+				target, header := test.request(fmt.Sprintf("user-%d", i))
+				first := forward(t, r, http.MethodGet, target, header)
+				for j := 0; j < 3; j++ {
+					if response := forward(t, r, http.MethodGet, target, header); response.Data != first.Data {
+						t.Fatalf("user-%d: expect the same instance, got %v then %v", i, first.Data, response.Data)
+					}
+				}
+				reached[first.Data] = true
+			}
+			if len(reached) != len(upstreams) {
+				t.Fatalf("expect the users on every instance, got %v", reached)
+			}
+
+			// without the key the requests are balanced round robin
+			reached = map[interface{}]bool{}
+			for i := 0; i < len(upstreams); i++ {
+				reached[forward(t, r, http.MethodGet, "/gateway/demo-v1/orders", nil).Data] = true
+			}
+			if len(reached) != len(upstreams) {
+				t.Fatalf("expect the requests without key on every instance, got %v", reached)
+			}
+		})
+	}
+}
+
+func TestGatewayController_SetHashKey_Invalid(t *testing.T) {
+	controller := &GatewayController{}
+	for _, spec := range []string{"", "header", "header:", "body:user"} {
+		if err := controller.SetHashKey(spec); err == nil {
+			t.Errorf("%s: expect an error", spec)
+		}
+	}
+}
+
+func TestGatewayController_DenyList(t *testing.T) {
+	var upstreams []*upstream
+	for i := 0; i < 2; i++ {
+		u := newUpstream(fmt.Sprintf("demo-v1-%d", i), http.StatusOK)
+		defer u.Close()
+		upstreams = append(upstreams, u)
+	}
+	r, stop := newTestGateway(t, func(controller *GatewayController) {
+		controller.SetInstanceFilter(springcloud.FilterChain{springcloud.DefaultInstanceFilter(), controller.DenyList()})
+	}, upstreams...)
+	defer stop()
+
+	expectDenied := func(instanceIds ...string) {
+		t.Helper()
+		response := serve(t, r, http.MethodGet, "/admin/gateway/deny")
+		data, _ := response.Data.(map[string]interface{})
+		if response.Code != 0 || fmt.Sprint(data["instanceIds"]) != fmt.Sprint(instanceIds) {
+			t.Fatalf("wrong deny list, expected:%v, actual:%+v", instanceIds, response)
+		}
+	}
+	// reached tells which upstreams answered a few requests
+	reached := func() map[interface{}]bool {
+		reached := map[interface{}]bool{}
+		for i := 0; i < 4; i++ {
+			reached[forward(t, r, http.MethodGet, "/gateway/demo-v1/orders", nil).Data] = true
+		}
+		return reached
+	}
+
+	expectDenied()
+	if response := serve(t, r, http.MethodPut, "/admin/gateway/deny/demo-v1-0"); response.Code != 0 {
+		t.Fatal("failed to deny the instance: ", response.Msg)
+	}
+	expectDenied("demo-v1-0")
+	if reached := reached(); len(reached) != 1 || !reached["demo-v1-1"] {
+		t.Fatalf("expect the denied instance to get nothing, got %v", reached)
+	}
+
+	if response := serve(t, r, http.MethodDelete, "/admin/gateway/deny/demo-v1-0"); response.Code != 0 {
+		t.Fatal("failed to remove the instance from the deny list: ", response.Msg)
+	}
+	expectDenied()
+	if reached := reached(); len(reached) != 2 {
+		t.Fatalf("expect the instance back once removed from the deny list, got %v", reached)
+	}
+}
+
+func TestGatewayController_Retry(t *testing.T) {
+	tests := []struct {
+		name   string
+		setUp  func(controller *GatewayController)
+		method string
+		header http.Header
+		// the status of each upstream, and how many requests each one expects
+		statusCodes []int
+		hits        []int
+	}{
+		{"no retry", nil, http.MethodGet, nil, []int{503}, []int{1}},
+		{"same instance", retryWith(2, 0), http.MethodGet, nil, []int{503}, []int{3}},
+		{"next instance", retryWith(0, 1), http.MethodGet, nil, []int{503, 503}, []int{1, 1}},
+		{"same then next instance", retryWith(1, 1), http.MethodGet, nil, []int{503, 503}, []int{2, 2}},
+		{"next instances exhausted", retryWith(0, 5), http.MethodGet, nil, []int{503, 503}, []int{1, 1}},
+		{"not idempotent", retryWith(1, 1), http.MethodPost, nil, []int{503, 503}, []int{1, 0}},
+		{"idempotency key", retryWith(0, 1), http.MethodPost, http.Header{"Idempotency-Key": {"order-42"}}, []int{503, 503}, []int{1, 1}},
+		{"not retryable status", retryWith(1, 1), http.MethodGet, nil, []int{500, 500}, []int{1, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var upstreams []*upstream
+			for i, statusCode := range test.statusCodes {
+				u := newUpstream(fmt.Sprintf("demo-v1-%d", i), statusCode)
+				defer u.Close()
+				upstreams = append(upstreams, u)
+			}
+			r, stop := newTestGateway(t, test.setUp, upstreams...)
+			defer stop()
+
+			response := forward(t, r, test.method, "/gateway/demo-v1/orders", test.header)
+			if response.SubCode != int64(test.statusCodes[0]) {
+				t.Fatalf("expect the upstream answer, got %+v", response)
+			}
+			// the first instance is not known in advance, the hits of both are compared in order
+			hits := make([]int, 0, len(upstreams))
+			for _, u := range upstreams {
+				hits = append(hits, u.Hits())
+			}
+			if len(hits) == 2 && hits[0] < hits[1] {
+				hits[0], hits[1] = hits[1], hits[0]
+			}
+			if fmt.Sprint(hits) != fmt.Sprint(test.hits) {
+				t.Fatalf("wrong requests per instance, expected:%v, actual:%v", test.hits, hits)
+			}
+		})
+	}
+}
+
+func TestGatewayController_RetryNextServer(t *testing.T) {
+	failing := newUpstream("failing", http.StatusServiceUnavailable)
+	defer failing.Close()
+	healthy := newUpstream("healthy", http.StatusOK)
+	defer healthy.Close()
+	// nothing listens on the port of a closed server
+	down := newUpstream("down", http.StatusOK)
+	down.Close()
+
+	r, stop := newTestGateway(t, retryWith(0, 2), failing, healthy, down)
+	defer stop()
+
+	// the round robin starts each request on another instance, all of them end on the healthy one
+	for i := 0; i < 3; i++ {
+		response := forward(t, r, http.MethodGet, "/gateway/demo-v1/orders", nil)
+		if response.Code != 0 || response.Data != "healthy" {
+			t.Fatalf("request %d: expect the healthy instance to answer, got %+v", i, response)
+		}
+	}
+	if healthy.Hits() != 3 {
+		t.Fatalf("wrong requests to the healthy instance, expected:%d, actual:%d", 3, healthy.Hits())
+	}
+}
+
+func TestGatewayController_RetryConnectionFailure(t *testing.T) {
+	healthy := newUpstream("healthy", http.StatusOK)
+	defer healthy.Close()
+	down := newUpstream("down", http.StatusOK)
+	down.Close()
+
+	r, stop := newTestGateway(t, retryWith(0, 1), down, healthy)
+	defer stop()
+
+	// a request which could not be sent is retried whatever its method
+	for i := 0; i < 2; i++ {
+		response := forward(t, r, http.MethodPost, "/gateway/demo-v1/orders", nil)
+		if response.Code != 0 || response.Data != "healthy" {
+			t.Fatalf("request %d: expect the healthy instance to answer, got %+v", i, response)
+		}
+	}
+}
+
+func TestGatewayController_ApplicationCircuitBreaker(t *testing.T) {
+	u := newUpstream("demo-v1", http.StatusServiceUnavailable)
+	defer u.Close()
+
+	var controller *GatewayController
+	r, stop := newTestGateway(t, func(c *GatewayController) {
+		controller = c
+		c.SetCircuitBreaker(springcloud.CircuitBreakerConfig{
+			MinRequests:      2,
+			FailureRate:      0.5,
+			OpenDuration:     100 * time.Millisecond,
+			HalfOpenRequests: 1,
+		}, false)
+	}, u)
+	defer stop()
+
+	// the requests which reach no instance do not count
+	for i := 0; i < 3; i++ {
+		if response := forward(t, r, http.MethodGet, "/gateway/unknown-v1/orders", nil); response.Msg != "service not found" {
+			t.Fatalf("request %d: expect the application not to be found, got %+v", i, response)
+		}
+	}
+	if _, exist := controller.breakers.breakers["UNKNOWN-V1"]; exist {
+		t.Fatal("an unknown application should get no circuit breaker")
+	}
+
+	// the failures open the circuit, then the requests fail fast
+	for i := 0; i < 2; i++ {
+		if response := forward(t, r, http.MethodGet, "/gateway/demo-v1/orders", nil); response.SubCode != http.StatusServiceUnavailable {
+			t.Fatalf("request %d: expect the upstream answer, got %+v", i, response)
+		}
+	}
+	breaker, _ := controller.breakers.of(&springcloud.ApplicationInstance{App: "DEMO-V1"})
+	if response := forward(t, r, http.MethodGet, "/gateway/demo-v1/orders", nil); !strings.Contains(response.Msg, "circuit open") {
+		t.Fatalf("expect the request to fail fast, got %+v", response)
+	}
+	if u.Hits() != 2 || breaker.State() != springcloud.CircuitOpen {
+		t.Fatalf("expect the circuit open after 2 requests, got %d requests and %s", u.Hits(), breaker.State())
+	}
+
+	// the trial request finds the upstream back and closes the circuit
+	u.setStatusCode(http.StatusOK)
+	time.Sleep(150 * time.Millisecond)
+	if breaker.State() != springcloud.CircuitHalfOpen {
+		t.Fatalf("expect the circuit half open, got %s", breaker.State())
+	}
+	for i := 0; i < 3; i++ {
+		if response := forward(t, r, http.MethodGet, "/gateway/demo-v1/orders", nil); response.Code != 0 || response.SubCode != http.StatusOK {
+			t.Fatalf("request %d: expect the upstream to answer, got %+v", i, response)
+		}
+	}
+	if u.Hits() != 5 || breaker.State() != springcloud.CircuitClosed {
+		t.Fatalf("expect the circuit closed, got %d requests and %s", u.Hits(), breaker.State())
+	}
+}
+
+func TestGatewayController_InstanceCircuitBreaker(t *testing.T) {
+	failing := newUpstream("failing", http.StatusServiceUnavailable)
+	defer failing.Close()
+	healthy := newUpstream("healthy", http.StatusOK)
+	defer healthy.Close()
+
+	var controller *GatewayController
+	r, stop := newTestGateway(t, func(c *GatewayController) {
+		controller = c
+		retryWith(0, 1)(c)
+		c.SetCircuitBreaker(springcloud.CircuitBreakerConfig{
+			MinRequests:      1,
+			FailureRate:      0.5,
+			OpenDuration:     100 * time.Millisecond,
+			HalfOpenRequests: 1,
+		}, true)
+	}, failing, healthy)
+	defer stop()
+	breaker, _ := controller.breakers.of(&springcloud.ApplicationInstance{App: "DEMO-V1", InstanceId: "demo-v1-0"})
+
+	expectHealthy := func() {
+		t.Helper()
+		for i := 0; i < 4; i++ {
+			if response := forward(t, r, http.MethodGet, "/gateway/demo-v1/orders", nil); response.Data != "healthy" {
+				t.Fatalf("request %d: expect the healthy instance to answer, got %+v", i, response)
+			}
+		}
+	}
+
+	// the first failure opens the circuit, then the failing instance gets nothing
+	expectHealthy()
+	if failing.Hits() != 1 || breaker.State() != springcloud.CircuitOpen {
+		t.Fatalf("expect one request before the circuit opens, got %d and %s", failing.Hits(), breaker.State())
+	}
+
+	// the single trial request is the one actually sent, it fails and opens the circuit again
+	time.Sleep(150 * time.Millisecond)
+	expectHealthy()
+	if failing.Hits() != 2 || breaker.State() != springcloud.CircuitOpen {
+		t.Fatalf("expect one trial request, got %d requests and %s", failing.Hits(), breaker.State())
+	}
+}
+
+func TestGatewayController_CircuitBreakerRemoved(t *testing.T) {
+	u := newUpstream("demo-v1", http.StatusServiceUnavailable)
+	defer u.Close()
+
+	var controller *GatewayController
+	r, stop := newTestGateway(t, func(c *GatewayController) {
+		controller = c
+		c.SetCircuitBreaker(springcloud.CircuitBreakerConfig{MinRequests: 1, FailureRate: 0.5, OpenDuration: time.Minute}, true)
+	}, u)
+	defer stop()
+
+	forward(t, r, http.MethodGet, "/gateway/demo-v1/orders", nil)
+	name := breakerName("demo-v1", "demo-v1-0")
+	if count := circuitGauges(t, name); count != 3 {
+		t.Fatalf("wrong gauges of %s, expected:%d, actual:%d", name, 3, count)
+	}
+
+	// the instance leaves the registry, its breaker and its gauges go with it
+	previous := &springcloud.ApplicationInstanceDto{App: "DEMO-V1", InstanceId: "demo-v1-0"}
+	controller.onRegistryEvent(springcloud.RegistryEvent{Type: springcloud.InstanceDown, AppName: "DEMO-V1", Previous: previous})
+	if _, exist := controller.breakers.breakers[name]; exist {
+		t.Fatalf("expect the breaker of %s removed", name)
+	}
+	if count := circuitGauges(t, name); count != 0 {
+		t.Fatalf("wrong gauges of %s, expected:%d, actual:%d", name, 0, count)
+	}
+}
+
+// circuitGauges counts the circuit_breaker_state series of a breaker
+func circuitGauges(t *testing.T, name string) int {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal("gather failed: ", err)
+	}
+	count := 0
+	for _, family := range families {
+		if family.GetName() != "circuit_breaker_state" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "name" && label.GetValue() == name {
+					count++
+				}
+			}
+		}
+	}
+	return count
+}
+
+func TestGatewayController_ForwardPath(t *testing.T) {
+	u := newUpstream("demo-v1", http.StatusOK)
+	defer u.Close()
+
+	r, stop := newTestGateway(t, nil, u)
+	defer stop()
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/gateway/demo-v1", "/"},
+		{"/gateway/demo-v1/", "/"},
+		{"/gateway/demo-v1/orders", "/orders"},
+		{"/gateway/demo-v1/v1/orders/42/items", "/v1/orders/42/items"},
+		{"/gateway/demo-v1/orders/", "/orders/"},
+		{"/gateway/demo-v1/orders?page=2&size=10", "/orders?page=2&size=10"},
+		// the encoded characters reach the upstream as they came
+		{"/gateway/demo-v1/files/a%2Fb%20c", "/files/a%2Fb%20c"},
+		{"/gateway/demo-v1/search/caf%C3%A9", "/search/caf%C3%A9"},
+	}
+	for _, test := range tests {
+		if response := forward(t, r, http.MethodGet, test.target, nil); response.Code != 0 {
+			t.Fatalf("%s: forward failed: %+v", test.target, response)
+		}
+		if url := u.lastUrl(); url != test.want {
+			t.Errorf("%s: expect %s upstream, got %s", test.target, test.want, url)
+		}
+	}
+}
+
+func TestGatewayController_PathRewrite(t *testing.T) {
+	u := newUpstream("demo-v1", http.StatusOK)
+	defer u.Close()
+
+	tests := []struct {
+		name    string
+		filters []string
+		target  string
+		want    string
+	}{
+		{"strip prefix", []string{"StripPrefix=1"}, "/gateway/demo-v1/v1/orders/42", "/orders/42"},
+		{"regexp", []string{`RewritePath=^/v1/(?P<rest>.*)$, /api/$\{rest}`}, "/gateway/demo-v1/v1/orders/42", "/api/orders/42"},
+		{"prefix", []string{"PrefixPath=/api"}, "/gateway/demo-v1/orders/42?expand=items", "/api/orders/42?expand=items"},
+		{"encoded characters", []string{"StripPrefix=1", "PrefixPath=/api"}, "/gateway/demo-v1/v1/files/a%2Fb", "/api/files/a%2Fb"},
+		{"trailing slash", []string{"StripPrefix=1", "PrefixPath=/api"}, "/gateway/demo-v1/v1/orders/", "/api/orders/"},
+		// the application name matches whatever its case
+		{"application case", []string{"StripPrefix=1"}, "/gateway/DEMO-V1/v1/orders", "/orders"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, stop := newTestGateway(t, func(controller *GatewayController) {
+				if err := controller.SetPathRewrite("demo-v1", test.filters); err != nil {
+					t.Fatal(err)
+				}
+			}, u)
+			defer stop()
+
+			if response := forward(t, r, http.MethodGet, test.target, nil); response.Code != 0 {
+				t.Fatalf("forward failed: %+v", response)
+			}
+			if url := u.lastUrl(); url != test.want {
+				t.Fatalf("expect %s upstream, got %s", test.want, url)
+			}
+		})
+	}
+}
+
+func TestGatewayController_Routes(t *testing.T) {
+	u := newUpstream("demo-v1", http.StatusOK)
+	defer u.Close()
+	static := newUpstream("static", http.StatusOK)
+	defer static.Close()
+
+	table, err := gateway.NewRouteTable(&gateway.Config{Routes: []gateway.RouteDefinition{
+		{Id: "orders", Uri: "lb://demo-v1", Predicates: []string{"Path=/orders/**"}, Filters: []string{"StripPrefix=1"}},
+		{Id: "items", Uri: static.URL, Predicates: []string{"Path=/items/{id}"}, Filters: []string{"SetPath=/api/items/{id}"}},
+	}})
+	if err != nil {
+		t.Fatal("invalid routes: ", err)
+	}
+	r, stop := newTestGateway(t, func(controller *GatewayController) {
+		controller.SetRoutes(table)
+	}, u)
+	defer stop()
+
+	tests := []struct {
+		target   string
+		upstream *upstream
+		want     string
+	}{
+		{"/orders/v1/42?expand=items", u, "/v1/42?expand=items"},
+		{"/orders/files/a%2Fb/", u, "/files/a%2Fb/"},
+		{"/items/42?expand=orders", static, "/api/items/42?expand=orders"},
+	}
+	for _, test := range tests {
+		response := forward(t, r, http.MethodGet, test.target, nil)
+		if response.Code != 0 || response.SubCode != http.StatusOK {
+			t.Fatalf("%s: forward failed: %+v", test.target, response)
+		}
+		if url := test.upstream.lastUrl(); url != test.want {
+			t.Fatalf("%s: expect %s upstream, got %s", test.target, test.want, url)
+		}
+	}
+
+	// the requests no route matches get the 404 of gin
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/unknown/42", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("wrong status of an unmatched path, expected:%d, actual:%d", http.StatusNotFound, recorder.Code)
+	}
+	if u.Hits()+static.Hits() != len(tests) {
+		t.Fatalf("an unmatched path reached an upstream")
+	}
+}
+
+func TestGatewayController_StaticRouteNoRetry(t *testing.T) {
+	static := newUpstream("static", http.StatusServiceUnavailable)
+	defer static.Close()
+
+	table, err := gateway.NewRouteTable(&gateway.Config{Routes: []gateway.RouteDefinition{
+		{Id: "items", Uri: static.URL, Predicates: []string{"Path=/items/**"}},
+	}})
+	if err != nil {
+		t.Fatal("invalid routes: ", err)
+	}
+	r, stop := newTestGateway(t, func(controller *GatewayController) {
+		retryWith(2, 0)(controller)
+		controller.SetCircuitBreaker(springcloud.CircuitBreakerConfig{MinRequests: 1, FailureRate: 0.5, OpenDuration: time.Minute}, false)
+		controller.SetRoutes(table)
+	})
+	defer stop()
+
+	// the retry and the circuit breaker are for the applications in eureka, a static url gets each request once
+	for i := 0; i < 3; i++ {
+		if response := forward(t, r, http.MethodGet, "/items/42", nil); response.SubCode != http.StatusServiceUnavailable {
+			t.Fatalf("request %d: expect the upstream answer, got %+v", i, response)
+		}
+	}
+	if static.Hits() != 3 {
+		t.Fatalf("wrong requests to the static url, expected:%d, actual:%d", 3, static.Hits())
+	}
+}
+
+func TestGatewayController_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "routes.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failing := newUpstream("failing", http.StatusServiceUnavailable)
+	defer failing.Close()
+	healthy := newUpstream("healthy", http.StatusOK)
+	defer healthy.Close()
+	var controller *GatewayController
+	r, stop := newTestGateway(t, func(c *GatewayController) {
+		controller = c
+		c.SetReloader(gateway.NewReloader(filename, c.ApplyConfig))
+	}, failing, healthy)
+	defer stop()
+	reload := func() apiResponse {
+		t.Helper()
+		return serve(t, r, http.MethodPost, "/admin/gateway/reload")
+	}
+
+	write("routes:\n  - id: orders\n    uri: lb://demo-v1\n    predicates:\n      - Path=/orders/**\n")
+	response := reload()
+	data, _ := response.Data.(map[string]interface{})
+	if response.Code != 0 || fmt.Sprint(data["routes"]) != "[orders]" {
+		t.Fatalf("wrong reload response: %+v", response)
+	}
+	if response := forward(t, r, http.MethodGet, "/orders/42", nil); response.SubCode == 0 {
+		t.Fatalf("expect the reloaded route to reach an instance, got %+v", response)
+	}
+
+	// the policies come with the routes
+	write(`
+routes:
+  - id: items
+    uri: lb://demo-v1
+    predicates:
+      - Path=/items/**
+retry:
+  maxAutoRetriesNextServer: 1
+  retryableStatusCodes: [503]
+  retryableMethods: [GET]
+  timeout: 5s
+circuitBreaker:
+  perInstance: true
+  minRequests: 100
+  failureRate: 0.5
+  openDuration: 30s
+  halfOpenRequests: 5
+pathRewrites:
+  demo-v1:
+    - PrefixPath=/api
+`)
+	if response := reload(); response.Code != 0 {
+		t.Fatalf("valid config rejected: %+v", response)
+	}
+	for i := 0; i < 4; i++ {
+		if response := forward(t, r, http.MethodGet, "/gateway/demo-v1/orders", nil); response.Data != "healthy" {
+			t.Fatalf("request %d: expect the retry to reach the healthy instance, got %+v", i, response)
+		}
+	}
+	if url := healthy.lastUrl(); url != "/api/orders" {
+		t.Fatalf("expect /api/orders upstream, got %s", url)
+	}
+	if breaker, perInstance := controller.breakers.of(&springcloud.ApplicationInstance{App: "DEMO-V1", InstanceId: "demo-v1-0"}); breaker == nil || !perInstance {
+		t.Fatal("expect the circuit breakers per instance")
+	}
+	if response := forward(t, r, http.MethodGet, "/items/42", nil); response.Data != "healthy" {
+		t.Fatalf("expect the new route to be served, got %+v", response)
+	}
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/orders/42", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expect the removed route to be gone, got %d", recorder.Code)
+	}
+
+	// an invalid file changes nothing, the error tells why
+	for _, content := range []string{
+		"routes:\n  - id: users\n    uri: ftp://users\n",
+		"routes:\n  - id: users\n    uri: lb://demo-v1\nretry:\n  maxAutoRetries: -1\n",
+		"routes:\n  - id: users\n    uri: lb://demo-v1\nretry:\n  timeout: soon\n",
+		"routes:\n  - id: users\n    uri: lb://demo-v1\npathRewrites:\n  demo-v1:\n    - SetPath=/api\n",
+	} {
+		write(content)
+		if response := reload(); response.Code == 0 || !strings.Contains(response.Msg, "invalid") {
+			t.Fatalf("%s: expect the config to be rejected, got %+v", content, response)
+		}
+	}
+	if response := forward(t, r, http.MethodGet, "/items/42", nil); response.Data != "healthy" {
+		t.Fatalf("expect the previous routes to stay, got %+v", response)
+	}
+	for i := 0; i < 2; i++ {
+		if response := forward(t, r, http.MethodGet, "/gateway/demo-v1/orders", nil); response.Data != "healthy" || healthy.lastUrl() != "/api/orders" {
+			t.Fatalf("request %d: expect the previous policies to stay, got %+v to %s", i, response, healthy.lastUrl())
+		}
+	}
+
+	// without the sections, the settings of the startup are back
+	write("routes:\n  - id: items\n    uri: lb://demo-v1\n    predicates:\n      - Path=/items/**\n")
+	if response := reload(); response.Code != 0 {
+		t.Fatalf("valid config rejected: %+v", response)
+	}
+	hits := failing.Hits()
+	for i := 0; i < 2; i++ {
+		forward(t, r, http.MethodGet, "/gateway/demo-v1/orders", nil)
+	}
+	if failing.Hits() != hits+1 || healthy.lastUrl() != "/orders" {
+		t.Fatalf("expect no retry nor path rewrite, got %d requests to the failing instance and %s", failing.Hits()-hits, healthy.lastUrl())
+	}
+	if breaker, _ := controller.breakers.of(&springcloud.ApplicationInstance{App: "DEMO-V1", InstanceId: "demo-v1-0"}); breaker != nil {
+		t.Fatal("expect no circuit breaker")
+	}
+}
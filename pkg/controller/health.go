@@ -0,0 +1,23 @@
+package controller
+
+import (
+	"gin-demo/pkg/util/health"
+	"github.com/gin-gonic/gin"
+)
+
+// HealthController serves the aggregated health in the spring boot actuator format,
+// so that the eureka health check url and the load balancers can use it
+type HealthController struct {
+	indicator health.HealthIndicator
+}
+
+func NewHealthController(indicator health.HealthIndicator) *HealthController {
+	return &HealthController{indicator: indicator}
+}
+
+func (controller *HealthController) Handle(r *gin.Engine) {
+	r.GET("/health", func(context *gin.Context) {
+		result := controller.indicator.Health()
+		context.JSON(health.HttpStatus(result.Status), result)
+	})
+}
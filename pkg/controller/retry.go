@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"gin-demo/pkg/gateway"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+var httpRequestRetry = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_request_retry_total",
+	Help: "The total number of forwarded requests sent again, to the same instance or to the next one",
+}, []string{"target"})
+
+// RetryConfig tells when the gateway sends a request again, like the retry settings of ribbon
+type RetryConfig struct {
+	// MaxAutoRetries is the number of retries on the same instance
+	MaxAutoRetries int
+	// MaxAutoRetriesNextServer is the number of other instances tried after the first one
+	MaxAutoRetriesNextServer int
+	// RetryableStatusCodes are the upstream responses worth another attempt
+	RetryableStatusCodes []int
+	// RetryableMethods are the idempotent methods, the other requests are only retried when they
+	// could not be sent at all, or carry an Idempotency-Key header
+	RetryableMethods []string
+	// RetryOnAllOperations retries any method, for upstreams known to be idempotent
+	RetryOnAllOperations bool
+	// Timeout is the time all the attempts of a request have together, the retries do not
+	// get one of their own
+	Timeout time.Duration
+	// MaxBodySize is the size of the request bodies buffered to be replayed,
+	// bigger bodies are streamed to a single attempt
+	MaxBodySize int64
+}
+
+// DefaultRetryConfig tries one more instance on connection failures and gateway errors
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAutoRetries:           0,
+		MaxAutoRetriesNextServer: 1,
+		RetryableStatusCodes:     []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		RetryableMethods:         []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete},
+		Timeout:                  10 * time.Second,
+		MaxBodySize:              1024 * 1024,
+	}
+}
+
+// retryConfigOf checks the retry section of a routes file, the fields left out keep their default
+// but the retries, which are 0
+func retryConfigOf(definition *gateway.RetryDefinition) (RetryConfig, error) {
+	if definition.MaxAutoRetries < 0 || definition.MaxAutoRetriesNextServer < 0 || definition.MaxBodySize < 0 {
+		return RetryConfig{}, fmt.Errorf("invalid retry, the retries and maxBodySize cannot be negative")
+	}
+	config := DefaultRetryConfig()
+	config.MaxAutoRetries = definition.MaxAutoRetries
+	config.MaxAutoRetriesNextServer = definition.MaxAutoRetriesNextServer
+	config.RetryOnAllOperations = definition.RetryOnAllOperations
+	if definition.RetryableStatusCodes != nil {
+		config.RetryableStatusCodes = definition.RetryableStatusCodes
+	}
+	if definition.RetryableMethods != nil {
+		config.RetryableMethods = definition.RetryableMethods
+	}
+	if definition.Timeout > 0 {
+		config.Timeout = time.Duration(definition.Timeout)
+	}
+	if definition.MaxBodySize > 0 {
+		config.MaxBodySize = definition.MaxBodySize
+	}
+	return config, nil
+}
+
+func (config RetryConfig) enabled() bool {
+	return config.MaxAutoRetries > 0 || config.MaxAutoRetriesNextServer > 0
+}
+
+// idempotent tells whether the request may reach the upstream more than once
+func (config RetryConfig) idempotent(request *http.Request) bool {
+	if config.RetryOnAllOperations || request.Header.Get("Idempotency-Key") != "" {
+		return true
+	}
+	for _, method := range config.RetryableMethods {
+		if request.Method == method {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable tells whether an attempt ending with response or err is worth another one
+func (config RetryConfig) retryable(ctx context.Context, request *http.Request, response *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		// the timeout is reached
+		return false
+	}
+	if err != nil {
+		// a request which could not be sent can go anywhere else
+		return isConnectionFailure(err) || config.idempotent(request)
+	}
+	for _, statusCode := range config.RetryableStatusCodes {
+		if response.StatusCode == statusCode {
+			return config.idempotent(request)
+		}
+	}
+	return false
+}
+
+// bufferBody reads the body of request so that it can be sent again, unless it is bigger than limit:
+// the body is then left to be streamed once and replayable is false
+func bufferBody(request *http.Request, limit int64) (body []byte, replayable bool, err error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, true, nil
+	}
+	body, err = ioutil.ReadAll(io.LimitReader(request.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > limit {
+		request.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), request.Body))
+		return nil, false, nil
+	}
+	return body, true, nil
+}
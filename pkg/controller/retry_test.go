@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBufferBody(t *testing.T) {
+	tests := []struct {
+		body       string
+		limit      int64
+		buffered   bool
+		replayable bool
+	}{
+		{"", 4, false, true},
+		{"abc", 4, true, true},
+		{"abcd", 4, true, true},
+		// one byte over the limit is streamed
+		{"abcde", 4, false, false},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+		if test.body == "" {
+			request.Body = http.NoBody
+		}
+		body, replayable, err := bufferBody(request, test.limit)
+		if err != nil {
+			t.Fatalf("%q: failed to buffer: %s", test.body, err)
+		}
+		if replayable != test.replayable || (body != nil) != test.buffered {
+			t.Errorf("%q: expect buffered %t and replayable %t, got %q and %t", test.body, test.buffered, test.replayable, body, replayable)
+		}
+		if test.buffered && string(body) != test.body {
+			t.Errorf("%q: wrong buffered body %q", test.body, body)
+		}
+		// a body too big is still forwarded whole, once
+		if !test.replayable {
+			forwarded, _ := ioutil.ReadAll(request.Body)
+			if string(forwarded) != test.body {
+				t.Errorf("%q: wrong streamed body %q", test.body, forwarded)
+			}
+		}
+	}
+}
+
+func TestRetryConfig_Idempotent(t *testing.T) {
+	config := DefaultRetryConfig()
+	tests := []struct {
+		method         string
+		idempotencyKey string
+		allOperations  bool
+		want           bool
+	}{
+		{http.MethodGet, "", false, true},
+		{http.MethodDelete, "", false, true},
+		{http.MethodPost, "", false, false},
+		{http.MethodPatch, "", false, false},
+		{http.MethodPost, "order-42", false, true},
+		{http.MethodPatch, "", true, true},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, "/", nil)
+		if test.idempotencyKey != "" {
+			request.Header.Set("Idempotency-Key", test.idempotencyKey)
+		}
+		config.RetryOnAllOperations = test.allOperations
+		if idempotent := config.idempotent(request); idempotent != test.want {
+			t.Errorf("%s, key %q, all operations %t: expect %t, got %t", test.method, test.idempotencyKey, test.allOperations, test.want, idempotent)
+		}
+	}
+}
+
+func TestRetryConfig_Retryable(t *testing.T) {
+	config := DefaultRetryConfig()
+	connectionFailure := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	readFailure := &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		method     string
+		statusCode int
+		err        error
+		want       bool
+	}{
+		{"get 503", context.Background(), http.MethodGet, http.StatusServiceUnavailable, nil, true},
+		{"get 500", context.Background(), http.MethodGet, http.StatusInternalServerError, nil, false},
+		{"get 200", context.Background(), http.MethodGet, http.StatusOK, nil, false},
+		{"post 503", context.Background(), http.MethodPost, http.StatusServiceUnavailable, nil, false},
+		// the request never left, any method may go elsewhere
+		{"post not connected", context.Background(), http.MethodPost, 0, connectionFailure, true},
+		{"post reset", context.Background(), http.MethodPost, 0, readFailure, false},
+		{"get reset", context.Background(), http.MethodGet, 0, readFailure, true},
+		{"timeout reached", cancelled, http.MethodGet, http.StatusServiceUnavailable, nil, false},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, "/", nil)
+		var response *http.Response
+		if test.err == nil {
+			response = &http.Response{StatusCode: test.statusCode}
+		}
+		if retryable := config.retryable(test.ctx, request, response, test.err); retryable != test.want {
+			t.Errorf("%s: expect %t, got %t", test.name, test.want, retryable)
+		}
+	}
+}
@@ -1,16 +1,17 @@
 package controller
 
 import (
-	"gin-demo/pkg/database"
 	"gin-demo/pkg/service"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 type UserController struct {
+	Database *gorm.DB
 }
 
 func (controller *UserController) Handle(r *gin.Engine) {
-	userService := &service.UserService{Database: database.Database}
+	userService := &service.UserService{Database: controller.Database}
 	user := r.Group("/user")
 	{
 		user.GET("/list", func(context *gin.Context) {
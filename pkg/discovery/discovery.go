@@ -0,0 +1,82 @@
+// Package discovery owns the eureka client of the process, the controllers share it so that
+// the registry is fetched once and the instance registered once
+package discovery
+
+import (
+	"gin-demo/pkg/util/springcloud"
+	"log"
+	"time"
+)
+
+type Config struct {
+	ApplicationName string
+	// ServiceUrl lists the eureka servers, comma separated, unless Dns or Zones is set
+	ServiceUrl string
+	Dns        *springcloud.DnsConfig
+	// Zones lists the eureka servers per availability zone, those of Zones.Zone are preferred.
+	// Ignored when Dns is set
+	Zones *springcloud.ZoneConfig
+	// Zone is the availability zone of the instance, registered in its metadata. Dns.Zone when empty
+	Zone string
+	// SnapshotFile keeps the registry for the next start, in case eureka is down by then
+	SnapshotFile string
+	// SnapshotMaxAge rejects an older snapshot, 0 accepts any age
+	SnapshotMaxAge               time.Duration
+	Security                     springcloud.SecurityConfig
+	RegistryFetchIntervalSeconds int
+}
+
+type Registry struct {
+	eureka *springcloud.Eureka
+}
+
+// NewRegistry creates the eureka client, it registers the instance on Start
+func NewRegistry(config Config) (*Registry, error) {
+	if config.RegistryFetchIntervalSeconds == 0 {
+		config.RegistryFetchIntervalSeconds = 30
+	}
+
+	var eureka *springcloud.Eureka
+	if config.Dns != nil {
+		var err error
+		eureka, err = springcloud.NewEurekaWithDns(*config.Dns, config.ApplicationName, config.RegistryFetchIntervalSeconds, true, true)
+		if err != nil {
+			return nil, err
+		}
+	} else if config.Zones != nil {
+		eureka = springcloud.NewEurekaWithZones(*config.Zones, config.ApplicationName, config.RegistryFetchIntervalSeconds, true, true)
+	} else {
+		eureka = springcloud.NewEureka(config.ServiceUrl, config.ApplicationName, config.RegistryFetchIntervalSeconds, true, true)
+	}
+
+	if config.Zone != "" {
+		eureka.Zone = config.Zone
+	}
+	eureka.SnapshotFile = config.SnapshotFile
+	eureka.SnapshotMaxAge = config.SnapshotMaxAge
+	if err := eureka.SetSecurity(config.Security); err != nil {
+		return nil, err
+	}
+	return &Registry{eureka: eureka}, nil
+}
+
+func (r *Registry) Start() error {
+	return r.eureka.Start()
+}
+
+// Eureka is the shared client, its lifecycle belongs to the registry
+func (r *Registry) Eureka() *springcloud.Eureka {
+	return r.eureka
+}
+
+// Shutdown takes the instance out of service, gives the peers drainPeriod to refresh
+// their registry caches, then deregisters from eureka
+func (r *Registry) Shutdown(drainPeriod time.Duration) {
+	if err := r.eureka.SetStatus(springcloud.StatusOutOfService); err != nil {
+		log.Println("failed to mark instance out of service:", err)
+	}
+
+	time.Sleep(drainPeriod)
+
+	r.eureka.Stop()
+}
@@ -0,0 +1,57 @@
+package discovery
+
+import (
+	"fmt"
+	"gin-demo/pkg/util/springcloud"
+	"gin-demo/pkg/util/springcloud/eurekatest"
+	"testing"
+	"time"
+)
+
+func TestRegistry_Shutdown(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+
+	registry, err := NewRegistry(Config{ApplicationName: "gin-demo", ServiceUrl: server.ServiceUrl()})
+	if err != nil {
+		t.Fatal("invalid config: ", err)
+	}
+	if err := registry.Start(); err != nil {
+		t.Fatal("registry start failed: ", err)
+	}
+	instanceId := registry.Eureka().InstanceId()
+	started := len(server.Requests())
+
+	drainPeriod := 200 * time.Millisecond
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		registry.Shutdown(drainPeriod)
+		close(done)
+	}()
+
+	// the peers still find the instance while it drains, out of service
+	time.Sleep(drainPeriod / 2)
+	instance, exist := server.Instance("gin-demo", instanceId)
+	if !exist || instance.Status != springcloud.StatusOutOfService {
+		t.Fatalf("expect the instance out of service while draining, got %+v", instance)
+	}
+
+	<-done
+	if elapsed := time.Since(start); elapsed < drainPeriod {
+		t.Fatalf("deregistered before the end of the drain period, after %s", elapsed)
+	}
+	// the status first, the cancel once drained, and nothing after
+	expected := []string{"POST /eureka/apps/GIN-DEMO", "DELETE /eureka/apps/GIN-DEMO/" + instanceId}
+	if requests := server.Requests()[started:]; fmt.Sprint(requests) != fmt.Sprint(expected) {
+		t.Fatalf("wrong shutdown requests, expected:%v, actual:%v", expected, requests)
+	}
+	if _, exist := server.Instance("gin-demo", instanceId); exist {
+		t.Fatal("instance not deregistered")
+	}
+	select {
+	case <-registry.Eureka().Done():
+	default:
+		t.Fatal("eureka not stopped")
+	}
+}
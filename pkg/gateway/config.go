@@ -0,0 +1,148 @@
+// Package gateway holds the route table of the gateway, declared like the routes of spring cloud gateway:
+// each route has predicates selecting the requests, filters changing them and the uri they go to
+package gateway
+
+import (
+	"bytes"
+	"gin-demo/pkg/util/jsonlib"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config is the content of the routes file, in YAML or JSON:
+//
+//	routes:
+//	  - id: orders
+//	    uri: lb://orders
+//	    predicates:
+//	      - Path=/orders/**
+//	      - Method=GET,POST
+//	    filters:
+//	      - StripPrefix=1
+//	retry:
+//	  maxAutoRetriesNextServer: 1
+//	  retryableMethods: [GET, HEAD]
+//	  timeout: 5s
+//	circuitBreaker:
+//	  perInstance: true
+//	  failureRate: 0.5
+//	  openDuration: 10s
+//	pathRewrites:
+//	  orders:
+//	    - StripPrefix=1
+//
+// The retry, circuitBreaker and pathRewrites sections replace the settings of the gateway given
+// at startup, which are back once the section is removed
+type Config struct {
+	Routes []RouteDefinition `json:"routes" yaml:"routes"`
+	// Retry replaces the retry of the requests to the applications. The fields left out keep the
+	// default of controller.DefaultRetryConfig, but the retries which are 0
+	Retry *RetryDefinition `json:"retry" yaml:"retry"`
+	// CircuitBreaker replaces the circuit breakers. The fields left out keep the default of
+	// springcloud.DefaultCircuitBreakerConfig, but the rates which are 0 and ignored
+	CircuitBreaker *CircuitBreakerDefinition `json:"circuitBreaker" yaml:"circuitBreaker"`
+	// PathRewrites are the filters of the requests to /gateway/<appId>/<path> by application, see ParsePathRewrite.
+	// The applications left out keep their path rewrite of the startup
+	PathRewrites map[string][]string `json:"pathRewrites" yaml:"pathRewrites"`
+}
+
+// RouteDefinition declares a route, the predicates and filters in the Name=arg1, arg2 shortcut notation
+type RouteDefinition struct {
+	Id string `json:"id" yaml:"id"`
+	// Uri is lb://<application> to balance over the instances in eureka, or a static http(s) url
+	// sent each request once, without retry nor circuit breaker
+	Uri        string   `json:"uri" yaml:"uri"`
+	Predicates []string `json:"predicates" yaml:"predicates"`
+	Filters    []string `json:"filters" yaml:"filters"`
+}
+
+// RetryDefinition declares the fields of controller.RetryConfig
+type RetryDefinition struct {
+	MaxAutoRetries           int      `json:"maxAutoRetries" yaml:"maxAutoRetries"`
+	MaxAutoRetriesNextServer int      `json:"maxAutoRetriesNextServer" yaml:"maxAutoRetriesNextServer"`
+	RetryableStatusCodes     []int    `json:"retryableStatusCodes" yaml:"retryableStatusCodes"`
+	RetryableMethods         []string `json:"retryableMethods" yaml:"retryableMethods"`
+	RetryOnAllOperations     bool     `json:"retryOnAllOperations" yaml:"retryOnAllOperations"`
+	Timeout                  Duration `json:"timeout" yaml:"timeout"`
+	MaxBodySize              int64    `json:"maxBodySize" yaml:"maxBodySize"`
+}
+
+// CircuitBreakerDefinition declares the fields of springcloud.CircuitBreakerConfig, and whether
+// the circuits are per instance rather than per application
+type CircuitBreakerDefinition struct {
+	PerInstance      bool     `json:"perInstance" yaml:"perInstance"`
+	Window           Duration `json:"window" yaml:"window"`
+	MinRequests      int      `json:"minRequests" yaml:"minRequests"`
+	FailureRate      float64  `json:"failureRate" yaml:"failureRate"`
+	SlowCallRate     float64  `json:"slowCallRate" yaml:"slowCallRate"`
+	SlowCallDuration Duration `json:"slowCallDuration" yaml:"slowCallDuration"`
+	OpenDuration     Duration `json:"openDuration" yaml:"openDuration"`
+	HalfOpenRequests int      `json:"halfOpenRequests" yaml:"halfOpenRequests"`
+}
+
+// Duration is a time.Duration written like 1.5s or 300ms
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := jsonlib.Unmarshal(data, &value); err != nil {
+		return errors.Errorf("invalid duration %s, expect a string like 10s", data)
+	}
+	return d.parse(value)
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	return d.parse(value)
+}
+
+func (d *Duration) parse(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return errors.Errorf("invalid duration:%s", value)
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// LoadConfig reads the routes file, JSON when its extension is .json and YAML otherwise
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// both formats reject the unknown fields, a misspelled key would otherwise be ignored silently
+	var config Config
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		decoder := jsonlib.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&config)
+	} else {
+		err = yaml.UnmarshalStrict(data, &config)
+	}
+	if err != nil {
+		return nil, errors.Errorf("invalid routes file %s:%s", filename, err)
+	}
+	return &config, nil
+}
+
+// shortcut splits Name=arg1, arg2 into its name and trimmed arguments
+func shortcut(definition string) (name string, args []string) {
+	parts := strings.SplitN(definition, "=", 2)
+	name = strings.TrimSpace(parts[0])
+	if len(parts) == 1 || strings.TrimSpace(parts[1]) == "" {
+		return name, nil
+	}
+	for _, arg := range strings.Split(parts[1], ",") {
+		args = append(args, strings.TrimSpace(arg))
+	}
+	return name, args
+}
@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig_UnknownFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"routes.json", `{"routes": [{"id": "orders", "uri": "lb://orders", "predicates": ["Path=/orders/**"]}]}`, true},
+		{"routes.json", `{"routes": [{"id": "orders", "uri": "lb://orders", "predicate": ["Path=/orders/**"]}]}`, false},
+		{"routes.json", `{"route": []}`, false},
+		{"routes.yaml", "routes:\n  - id: orders\n    uri: lb://orders\n    predicates:\n      - Path=/orders/**\n", true},
+		{"routes.yaml", "routes:\n  - id: orders\n    uri: lb://orders\n    predicate:\n      - Path=/orders/**\n", false},
+	}
+
+	for _, test := range tests {
+		filename := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(filename, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := LoadConfig(filename)
+		if !test.valid {
+			if err == nil || !strings.Contains(err.Error(), "invalid routes file") {
+				t.Errorf("%s: expect an unknown field to be rejected, got %v", test.content, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: load failed: %s", test.content, err)
+		} else if len(config.Routes) != 1 || config.Routes[0].Predicates[0] != "Path=/orders/**" {
+			t.Errorf("%s: wrong config %+v", test.content, config)
+		}
+	}
+}
+
+func TestLoadConfig_Policies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"routes.json", `{"retry": {"maxAutoRetriesNextServer": 1, "timeout": "1.5s"}, "circuitBreaker": {"openDuration": "1.5s"}, "pathRewrites": {"orders": ["StripPrefix=1"]}}`, true},
+		{"routes.yaml", "retry:\n  maxAutoRetriesNextServer: 1\n  timeout: 1.5s\ncircuitBreaker:\n  openDuration: 1.5s\npathRewrites:\n  orders:\n    - StripPrefix=1\n", true},
+		{"routes.json", `{"retry": {"timeout": 1500}}`, false},
+		{"routes.json", `{"retry": {"timeout": "-1s"}}`, false},
+		{"routes.yaml", "retry:\n  timeout: soon\n", false},
+		{"routes.yaml", "retry:\n  retries: 1\n", false},
+	}
+
+	for _, test := range tests {
+		filename := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(filename, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := LoadConfig(filename)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expect an error", test.content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: load failed: %s", test.content, err)
+			continue
+		}
+		if config.Retry.MaxAutoRetriesNextServer != 1 || time.Duration(config.Retry.Timeout) != 1500*time.Millisecond ||
+			time.Duration(config.CircuitBreaker.OpenDuration) != 1500*time.Millisecond || config.PathRewrites["orders"][0] != "StripPrefix=1" {
+			t.Errorf("%s: wrong config %+v %+v %+v", test.content, config.Retry, config.CircuitBreaker, config.PathRewrites)
+		}
+	}
+}
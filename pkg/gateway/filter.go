@@ -0,0 +1,151 @@
+package gateway
+
+import (
+	"github.com/pkg/errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Exchange is a request matched by a route, the filters change it before it is forwarded
+type Exchange struct {
+	// Path is the escaped path sent to the target
+	Path   string
+	Header http.Header
+	// Vars are the template variables captured by the Path and Host predicates
+	Vars map[string]string
+}
+
+type filter interface {
+	apply(exchange *Exchange)
+}
+
+type filterFunc func(exchange *Exchange)
+
+func (f filterFunc) apply(exchange *Exchange) {
+	f(exchange)
+}
+
+// newFilter parses one of StripPrefix, PrefixPath, RewritePath, SetPath,
+// AddRequestHeader, SetRequestHeader or RemoveRequestHeader
+func newFilter(definition string) (filter, error) {
+	name, args := shortcut(definition)
+	switch name {
+	case "StripPrefix":
+		if len(args) != 1 {
+			return nil, errors.Errorf("StripPrefix needs a number of segments")
+		}
+		count, err := strconv.Atoi(args[0])
+		if err != nil || count < 0 {
+			return nil, errors.Errorf("invalid StripPrefix:%s", args[0])
+		}
+		return filterFunc(func(exchange *Exchange) {
+			exchange.Path = StripSegments(exchange.Path, count)
+		}), nil
+	case "PrefixPath":
+		if len(args) != 1 || !strings.HasPrefix(args[0], "/") {
+			return nil, errors.Errorf("PrefixPath needs a path starting with /")
+		}
+		prefix := strings.TrimSuffix(args[0], "/")
+		return filterFunc(func(exchange *Exchange) {
+			exchange.Path = prefix + exchange.Path
+		}), nil
+	case "RewritePath":
+		if len(args) != 2 {
+			return nil, errors.Errorf("RewritePath needs a regexp and a replacement")
+		}
+		compiled, err := regexp.Compile(args[0])
+		if err != nil {
+			return nil, errors.Errorf("invalid RewritePath regexp %s:%s", args[0], err)
+		}
+		// $\{name} is how the spring cloud gateway files escape ${name}
+		replacement := strings.ReplaceAll(args[1], `$\{`, "${")
+		return filterFunc(func(exchange *Exchange) {
+			exchange.Path = compiled.ReplaceAllString(exchange.Path, replacement)
+			if !strings.HasPrefix(exchange.Path, "/") {
+				exchange.Path = "/" + exchange.Path
+			}
+		}), nil
+	case "SetPath":
+		if len(args) != 1 || !strings.HasPrefix(args[0], "/") {
+			return nil, errors.Errorf("SetPath needs a template starting with /")
+		}
+		template := args[0]
+		return filterFunc(func(exchange *Exchange) {
+			path := template
+			for name, value := range exchange.Vars {
+				path = strings.ReplaceAll(path, "{"+name+"}", value)
+			}
+			exchange.Path = path
+		}), nil
+	case "AddRequestHeader", "SetRequestHeader":
+		if len(args) != 2 {
+			return nil, errors.Errorf("%s needs a name and a value", name)
+		}
+		headerName, value := args[0], args[1]
+		if name == "AddRequestHeader" {
+			return filterFunc(func(exchange *Exchange) {
+				exchange.Header.Add(headerName, value)
+			}), nil
+		}
+		return filterFunc(func(exchange *Exchange) {
+			exchange.Header.Set(headerName, value)
+		}), nil
+	case "RemoveRequestHeader":
+		if len(args) != 1 {
+			return nil, errors.Errorf("RemoveRequestHeader needs a name")
+		}
+		headerName := args[0]
+		return filterFunc(func(exchange *Exchange) {
+			exchange.Header.Del(headerName)
+		}), nil
+	default:
+		return nil, errors.Errorf("unknown filter:%s", name)
+	}
+}
+
+// StripSegments removes the first count segments of an escaped path, keeping what follows as is,
+// trailing slash included. Nothing left gives /
+func StripSegments(path string, count int) string {
+	for i := 0; i < count; i++ {
+		next := strings.IndexByte(strings.TrimPrefix(path, "/"), '/')
+		if next < 0 {
+			return "/"
+		}
+		path = strings.TrimPrefix(path, "/")[next:]
+	}
+	return path
+}
+
+// PathRewrite changes an escaped path with StripPrefix, PrefixPath and RewritePath filters applied in order,
+// e.g. for the requests forwarded to /gateway/<appId>/<path> out of the route table
+type PathRewrite []filter
+
+// ParsePathRewrite parses the filters of a PathRewrite. The other filters are rejected, they need
+// the headers or the template variables of a route
+func ParsePathRewrite(definitions []string) (PathRewrite, error) {
+	rewrite := make(PathRewrite, 0, len(definitions))
+	for _, definition := range definitions {
+		switch name, _ := shortcut(definition); name {
+		case "StripPrefix", "PrefixPath", "RewritePath":
+		default:
+			return nil, errors.Errorf("filter %s: not a path rewrite", definition)
+		}
+		filter, err := newFilter(definition)
+		if err != nil {
+			return nil, errors.Errorf("filter %s: %s", definition, err)
+		}
+		rewrite = append(rewrite, filter)
+	}
+	return rewrite, nil
+}
+
+// Rewrite returns the path changed by the filters
+func (rewrite PathRewrite) Rewrite(path string) string {
+	exchange := &Exchange{Path: path}
+	for _, filter := range rewrite {
+		filter.apply(exchange)
+	}
+	return exchange.Path
+}
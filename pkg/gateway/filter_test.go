@@ -0,0 +1,83 @@
+package gateway
+
+import "testing"
+
+func TestStripSegments(t *testing.T) {
+	tests := []struct {
+		path  string
+		count int
+		want  string
+	}{
+		{"/gateway/orders/v1/items/42", 2, "/v1/items/42"},
+		{"/gateway/orders/v1/items/42", 0, "/gateway/orders/v1/items/42"},
+		{"/gateway/orders", 2, "/"},
+		{"/gateway/orders/", 2, "/"},
+		{"/gateway", 2, "/"},
+		{"/", 1, "/"},
+		// the trailing slash is kept
+		{"/gateway/orders/items/", 2, "/items/"},
+		// the encoded characters stay encoded, an encoded slash is not a separator
+		{"/gateway/orders/files/a%2Fb%20c", 2, "/files/a%2Fb%20c"},
+		{"/gateway/a%2Fb/items", 2, "/items"},
+		// empty segments count like the others
+		{"/gateway/orders//items", 2, "//items"},
+		{"/gateway/orders//items", 3, "/items"},
+	}
+
+	for _, test := range tests {
+		if path := StripSegments(test.path, test.count); path != test.want {
+			t.Errorf("%s minus %d segments: expect %s, got %s", test.path, test.count, test.want, path)
+		}
+	}
+}
+
+func TestPathRewrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []string
+		path    string
+		want    string
+	}{
+		{"none", nil, "/v1/items/42", "/v1/items/42"},
+		{"strip prefix", []string{"StripPrefix=1"}, "/v1/items/42", "/items/42"},
+		{"strip everything", []string{"StripPrefix=3"}, "/v1/items/42", "/"},
+		{"regexp", []string{`RewritePath=^/v1/(?P<rest>.*)$, /api/$\{rest}`}, "/v1/items/42", "/api/items/42"},
+		{"regexp numbered group", []string{"RewritePath=^/v(\\d+)/, /version-$1/"}, "/v1/items", "/version-1/items"},
+		{"regexp without leading slash", []string{"RewritePath=^/v1/, "}, "/v1/items", "/items"},
+		{"prefix", []string{"PrefixPath=/api/"}, "/items/42", "/api/items/42"},
+		{"strip then prefix", []string{"StripPrefix=1", "PrefixPath=/api"}, "/v1/items/42", "/api/items/42"},
+		// the filters apply in the order given
+		{"prefix then strip", []string{"PrefixPath=/api", "StripPrefix=1"}, "/v1/items/42", "/v1/items/42"},
+		{"all", []string{"StripPrefix=1", "RewritePath=^/items, /orders", "PrefixPath=/api"}, "/v1/items/42", "/api/orders/42"},
+		// the path stays escaped, and keeps its trailing slash
+		{"encoded characters", []string{"StripPrefix=1", "PrefixPath=/api"}, "/v1/files/a%2Fb%20c", "/api/files/a%2Fb%20c"},
+		{"trailing slash", []string{"StripPrefix=1", "PrefixPath=/api"}, "/v1/items/", "/api/items/"},
+	}
+
+	for _, test := range tests {
+		rewrite, err := ParsePathRewrite(test.filters)
+		if err != nil {
+			t.Fatalf("%s: invalid rewrite: %s", test.name, err)
+		}
+		if path := rewrite.Rewrite(test.path); path != test.want {
+			t.Errorf("%s: expect %s, got %s", test.name, test.want, path)
+		}
+	}
+}
+
+func TestParsePathRewrite_Invalid(t *testing.T) {
+	for _, definition := range []string{
+		"StripPrefix",
+		"StripPrefix=-1",
+		"PrefixPath=api",
+		"RewritePath=^/v1",
+		"RewritePath=(unclosed, /",
+		// a valid filter, but not of the path alone
+		"SetPath=/api",
+		"AddRequestHeader=X-Demo, 1",
+	} {
+		if _, err := ParsePathRewrite([]string{definition}); err == nil {
+			t.Errorf("%s: expect an error", definition)
+		}
+	}
+}
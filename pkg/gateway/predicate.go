@@ -0,0 +1,217 @@
+package gateway
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// matchContext is the request being matched, the predicates add the template variables they capture
+type matchContext struct {
+	request *http.Request
+	vars    map[string]string
+	// draw is the random value of a weight group for this request, the same for all its routes
+	draw func(group string) int
+}
+
+type predicate interface {
+	test(ctx *matchContext) bool
+}
+
+// newPredicate parses one of Path, Host, Method, Header, Query or Weight
+func newPredicate(definition string) (predicate, error) {
+	name, args := shortcut(definition)
+	switch name {
+	case "Path":
+		return newPatternPredicate(args, '/', func(request *http.Request) string {
+			return request.URL.EscapedPath()
+		})
+	case "Host":
+		return newPatternPredicate(args, '.', func(request *http.Request) string {
+			host := request.Host
+			if hostName, _, err := net.SplitHostPort(host); err == nil {
+				host = hostName
+			}
+			return strings.ToLower(host)
+		})
+	case "Method":
+		if len(args) == 0 {
+			return nil, errors.Errorf("Method needs at least one method")
+		}
+		methods := make(methodPredicate, 0, len(args))
+		for _, method := range args {
+			methods = append(methods, strings.ToUpper(method))
+		}
+		return methods, nil
+	case "Header", "Query":
+		if len(args) != 1 && len(args) != 2 {
+			return nil, errors.Errorf("%s needs a name and an optional regexp", name)
+		}
+		valuePredicate := &valuePredicate{name: args[0], query: name == "Query"}
+		if len(args) == 2 {
+			var err error
+			if valuePredicate.regexp, err = regexp.Compile("^(?:" + args[1] + ")$"); err != nil {
+				return nil, errors.Errorf("invalid %s regexp %s:%s", name, args[1], err)
+			}
+		}
+		return valuePredicate, nil
+	case "Weight":
+		if len(args) != 2 {
+			return nil, errors.Errorf("Weight needs a group and a weight")
+		}
+		weight, err := strconv.Atoi(args[1])
+		if err != nil || weight < 0 {
+			return nil, errors.Errorf("invalid weight:%s", args[1])
+		}
+		return &weightPredicate{group: args[0], weight: weight}, nil
+	default:
+		return nil, errors.Errorf("unknown predicate:%s", name)
+	}
+}
+
+// patternPredicate matches one of its spring style patterns, see compilePattern
+type patternPredicate struct {
+	patterns []*regexp.Regexp
+	value    func(request *http.Request) string
+}
+
+func newPatternPredicate(patterns []string, separator byte, value func(request *http.Request) string) (predicate, error) {
+	if len(patterns) == 0 {
+		return nil, errors.Errorf("at least one pattern is needed")
+	}
+	predicate := &patternPredicate{value: value}
+	for _, pattern := range patterns {
+		compiled, err := compilePattern(pattern, separator)
+		if err != nil {
+			return nil, err
+		}
+		predicate.patterns = append(predicate.patterns, compiled)
+	}
+	return predicate, nil
+}
+
+func (predicate *patternPredicate) test(ctx *matchContext) bool {
+	value := predicate.value(ctx.request)
+	for _, pattern := range predicate.patterns {
+		match := pattern.FindStringSubmatch(value)
+		if match == nil {
+			continue
+		}
+		for i, name := range pattern.SubexpNames() {
+			if name != "" {
+				ctx.vars[name] = match[i]
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compilePattern turns a spring path pattern into a regexp: ** matches any number of segments,
+// * any part of one and {name} a whole one, captured as a variable. The segments are separated
+// by / in paths and by . in hosts, a path may end with an extra /
+func compilePattern(pattern string, separator byte) (*regexp.Regexp, error) {
+	sep := string(separator)
+	var builder strings.Builder
+	builder.WriteString("^")
+	rest := pattern
+	if strings.HasPrefix(rest, "**"+sep) {
+		// **.example.com also matches example.com
+		builder.WriteString("(?:.*" + regexp.QuoteMeta(sep) + ")?")
+		rest = rest[3:]
+	}
+	suffix := ""
+	if strings.HasSuffix(rest, sep+"**") {
+		// /orders/** also matches /orders
+		suffix = "(?:" + regexp.QuoteMeta(sep) + ".*)?"
+		rest = rest[:len(rest)-3]
+	} else if separator == '/' && !strings.HasSuffix(rest, "/") {
+		suffix = "/?"
+	}
+
+	segment := "[^" + regexp.QuoteMeta(sep) + "]"
+	for len(rest) > 0 {
+		switch {
+		case strings.HasPrefix(rest, "**"):
+			builder.WriteString(".*")
+			rest = rest[2:]
+		case rest[0] == '*':
+			builder.WriteString(segment + "*")
+			rest = rest[1:]
+		case rest[0] == '{':
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return nil, errors.Errorf("unclosed variable in pattern:%s", pattern)
+			}
+			builder.WriteString("(?P<" + rest[1:end] + ">" + segment + "+)")
+			rest = rest[end+1:]
+		default:
+			next := strings.IndexAny(rest, "*{")
+			if next < 0 {
+				next = len(rest)
+			}
+			builder.WriteString(regexp.QuoteMeta(rest[:next]))
+			rest = rest[next:]
+		}
+	}
+	builder.WriteString(suffix + "$")
+
+	compiled, err := regexp.Compile(builder.String())
+	if err != nil {
+		return nil, errors.Errorf("invalid pattern %s:%s", pattern, err)
+	}
+	return compiled, nil
+}
+
+type methodPredicate []string
+
+func (predicate methodPredicate) test(ctx *matchContext) bool {
+	for _, method := range predicate {
+		if ctx.request.Method == method {
+			return true
+		}
+	}
+	return false
+}
+
+// valuePredicate requires a header or a query parameter, with one of its values matching regexp if set
+type valuePredicate struct {
+	name   string
+	query  bool
+	regexp *regexp.Regexp
+}
+
+func (predicate *valuePredicate) test(ctx *matchContext) bool {
+	var values []string
+	if predicate.query {
+		values = ctx.request.URL.Query()[predicate.name]
+	} else {
+		values = ctx.request.Header.Values(predicate.name)
+	}
+	if predicate.regexp == nil {
+		return len(values) > 0
+	}
+	for _, value := range values {
+		if predicate.regexp.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// weightPredicate splits the requests among the routes of a group, in proportion to their weights.
+// The route table sets the range of the route in the group, from start included to end excluded
+type weightPredicate struct {
+	group  string
+	weight int
+	start  int
+	end    int
+}
+
+func (predicate *weightPredicate) test(ctx *matchContext) bool {
+	draw := ctx.draw(predicate.group)
+	return draw >= predicate.start && draw < predicate.end
+}
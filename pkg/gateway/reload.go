@@ -0,0 +1,144 @@
+package gateway
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var routesReload = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gateway_routes_reload_total",
+	Help: "The number of times the routes file was loaded, by result",
+}, []string{"result"})
+
+// Reloader loads the routes file again on demand or when it changes. A file which cannot be read,
+// declares invalid routes or is refused by apply is rejected, the config in use stays until a valid one comes
+type Reloader struct {
+	filename string
+	apply    func(config *Config, table *RouteTable) error
+	lock     *sync.Mutex // one load at a time, so that an older file never wins over a newer one
+	// version is the state of the file when last loaded, valid or not
+	version fileVersion
+	cancel  context.CancelFunc
+}
+
+// fileVersion tells the file changed without reading it
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader gives the configs loaded from filename and their route tables to apply, e.g. GatewayController.ApplyConfig,
+// which checks the rest of the config and applies all of it or nothing
+func NewReloader(filename string, apply func(config *Config, table *RouteTable) error) *Reloader {
+	return &Reloader{
+		filename: filename,
+		apply:    apply,
+		lock:     new(sync.Mutex),
+	}
+}
+
+func (r *Reloader) Filename() string {
+	return r.filename
+}
+
+// Reload loads and applies the routes file, reason is logged with the outcome
+func (r *Reloader) Reload(reason string) (*RouteTable, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// remembered even when invalid, the watch waits for the next change instead of retrying it
+	if version, err := statFile(r.filename); err == nil {
+		r.version = version
+	}
+
+	table, err := r.load()
+	if err != nil {
+		routesReload.WithLabelValues("failure").Inc()
+		log.Printf("gateway config not reloaded from %s (%s), the previous one stays: %s", r.filename, reason, err)
+		return nil, err
+	}
+	routesReload.WithLabelValues("success").Inc()
+	log.Printf("gateway config reloaded from %s (%s): %d routes", r.filename, reason, len(table.Routes()))
+	return table, nil
+}
+
+func (r *Reloader) load() (*RouteTable, error) {
+	config, err := LoadConfig(r.filename)
+	if err != nil {
+		return nil, err
+	}
+	table, err := NewRouteTable(config)
+	if err != nil {
+		return nil, errors.Errorf("invalid routes in %s:%s", r.filename, err)
+	}
+	if err := r.apply(config, table); err != nil {
+		return nil, errors.Errorf("invalid config in %s:%s", r.filename, err)
+	}
+	return table, nil
+}
+
+// Watch checks the routes file every interval and reloads it once its modification time or size
+// changed, until Stop. Polling works on every file system, mounted config maps included
+func (r *Reloader) Watch(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.lock.Lock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.cancel = cancel
+	r.lock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if r.changed() {
+				_, _ = r.Reload("file changed")
+			}
+		}
+	}()
+}
+
+// changed tells whether the file differs from the last one loaded, a missing file is not a change
+func (r *Reloader) changed() bool {
+	version, err := statFile(r.filename)
+	if err != nil {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return !version.same(r.version)
+}
+
+// Stop stops watching the file
+func (r *Reloader) Stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+}
+
+func (version fileVersion) same(other fileVersion) bool {
+	return version.size == other.size && version.modTime.Equal(other.modTime)
+}
+
+func statFile(filename string) (fileVersion, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}, nil
+}
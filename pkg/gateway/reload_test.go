@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "routes.yml")
+	modTime := time.Now().Add(-time.Hour)
+	write := func(content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// a distinct modification time whatever the resolution of the file system
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var current atomic.Value
+	routeIds := func() string {
+		table, _ := current.Load().(*RouteTable)
+		if table == nil {
+			return ""
+		}
+		var ids []string
+		for _, route := range table.Routes() {
+			ids = append(ids, route.Id)
+		}
+		return strings.Join(ids, ",")
+	}
+	reloader := NewReloader(filename, func(config *Config, table *RouteTable) error {
+		if config.Retry != nil && config.Retry.Timeout == 0 {
+			return errors.Errorf("retry needs a timeout")
+		}
+		current.Store(table)
+		return nil
+	})
+
+	write("routes:\n  - id: orders\n    uri: lb://orders\n")
+	if _, err := reloader.Reload("test"); err != nil || routeIds() != "orders" {
+		t.Fatal("valid routes not applied: ", err)
+	}
+
+	failures := testutil.ToFloat64(routesReload.WithLabelValues("failure"))
+	write("routes:\n  - id: orders\n    uri: ftp://orders\n")
+	if _, err := reloader.Reload("test"); err == nil || !strings.Contains(err.Error(), "uri must be") {
+		t.Fatal("invalid routes accepted: ", err)
+	}
+	write("routes:\n  - id: [orders\n")
+	if _, err := reloader.Reload("test"); err == nil || !strings.Contains(err.Error(), "invalid routes file") {
+		t.Fatal("unreadable routes accepted: ", err)
+	}
+	// valid routes come with the rest of the config, which apply refuses
+	write("routes:\n  - id: users\n    uri: lb://users\nretry:\n  maxAutoRetries: 1\n")
+	if _, err := reloader.Reload("test"); err == nil || !strings.Contains(err.Error(), "retry needs a timeout") {
+		t.Fatal("refused config accepted: ", err)
+	}
+	if routeIds() != "orders" {
+		t.Fatal("the previous routes should stay, actual: ", routeIds())
+	}
+	if testutil.ToFloat64(routesReload.WithLabelValues("failure")) != failures+3 {
+		t.Fatal("failures not counted")
+	}
+
+	reloader.Watch(10 * time.Millisecond)
+	defer reloader.Stop()
+	write("routes:\n  - id: orders\n    uri: lb://orders\n  - id: users\n    uri: lb://users\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for routeIds() != "orders,users" {
+		if time.Now().After(deadline) {
+			t.Fatal("the change of the file was not picked up, routes: ", routeIds())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,158 @@
+package gateway
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Route sends the requests matching all its predicates to Uri, through its filters
+type Route struct {
+	Id string
+	// Uri is lb://<application> or a static url, its path is ignored like in spring cloud gateway,
+	// use PrefixPath to add one
+	Uri        *url.URL
+	predicates []predicate
+	filters    []filter
+}
+
+// LoadBalanced tells whether the route goes to the instances of an application in eureka
+func (route *Route) LoadBalanced() bool {
+	return route.Uri.Scheme == "lb"
+}
+
+// ServiceId is the application of a load balanced route
+func (route *Route) ServiceId() string {
+	return route.Uri.Host
+}
+
+// RouteTable matches the requests against its routes, in order. It is immutable, a change
+// of the routes builds a new table
+type RouteTable struct {
+	routes []*Route
+	// weights are the total weight of each Weight group
+	weights map[string]int
+	random  func(n int) int
+}
+
+// NewRouteTable checks and compiles the route definitions, the error lists every invalid one
+func NewRouteTable(config *Config) (*RouteTable, error) {
+	table := &RouteTable{weights: map[string]int{}, random: rand.Intn}
+	var problems []string
+	ids := map[string]bool{}
+	for i, definition := range config.Routes {
+		route, err := newRoute(definition)
+		if err == nil && ids[definition.Id] {
+			err = errors.Errorf("duplicate id")
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("route %d (%s): %s", i, definition.Id, err))
+			continue
+		}
+		ids[route.Id] = true
+		for _, predicate := range route.predicates {
+			if weight, ok := predicate.(*weightPredicate); ok {
+				weight.start = table.weights[weight.group]
+				weight.end = weight.start + weight.weight
+				table.weights[weight.group] = weight.end
+			}
+		}
+		table.routes = append(table.routes, route)
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+	return table, nil
+}
+
+func newRoute(definition RouteDefinition) (*Route, error) {
+	if definition.Id == "" {
+		return nil, errors.New("missing id")
+	}
+	uri, err := url.Parse(definition.Uri)
+	if err != nil {
+		return nil, errors.Errorf("invalid uri %s:%s", definition.Uri, err)
+	}
+	switch uri.Scheme {
+	case "lb", "http", "https":
+		if uri.Host == "" {
+			return nil, errors.Errorf("missing host in uri:%s", definition.Uri)
+		}
+	default:
+		return nil, errors.Errorf("uri must be lb://, http:// or https://, not:%s", definition.Uri)
+	}
+
+	route := &Route{Id: definition.Id, Uri: uri}
+	for _, predicateDefinition := range definition.Predicates {
+		predicate, err := newPredicate(predicateDefinition)
+		if err != nil {
+			return nil, errors.Errorf("predicate %s: %s", predicateDefinition, err)
+		}
+		route.predicates = append(route.predicates, predicate)
+	}
+	for _, filterDefinition := range definition.Filters {
+		filter, err := newFilter(filterDefinition)
+		if err != nil {
+			return nil, errors.Errorf("filter %s: %s", filterDefinition, err)
+		}
+		route.filters = append(route.filters, filter)
+	}
+	return route, nil
+}
+
+// Routes lists the routes in the order they are matched
+func (table *RouteTable) Routes() []*Route {
+	return table.routes
+}
+
+// Match finds the first route whose predicates all accept the request,
+// and runs its filters on the exchange forwarded to the route
+func (table *RouteTable) Match(request *http.Request) (*Route, *Exchange, bool) {
+	draws := map[string]int{}
+	ctx := &matchContext{
+		request: request,
+		draw: func(group string) int {
+			draw, exist := draws[group]
+			if !exist {
+				draw = -1
+				if total := table.weights[group]; total > 0 {
+					draw = table.random(total)
+				}
+				draws[group] = draw
+			}
+			return draw
+		},
+	}
+
+	for _, route := range table.routes {
+		ctx.vars = map[string]string{}
+		if !route.matches(ctx) {
+			continue
+		}
+		exchange := &Exchange{
+			Path:   request.URL.EscapedPath(),
+			Header: request.Header.Clone(),
+			Vars:   ctx.vars,
+		}
+		if exchange.Header == nil {
+			exchange.Header = http.Header{}
+		}
+		for _, filter := range route.filters {
+			filter.apply(exchange)
+		}
+		return route, exchange, true
+	}
+	return nil, nil, false
+}
+
+func (route *Route) matches(ctx *matchContext) bool {
+	for _, predicate := range route.predicates {
+		if !predicate.test(ctx) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package gateway
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testRoutes = `
+routes:
+  - id: orders-v2
+    uri: lb://orders
+    predicates:
+      - Path=/orders/**
+      - Header=X-Version, 2
+    filters:
+      - StripPrefix=1
+      - PrefixPath=/v2
+      - AddRequestHeader=X-Gateway, true
+  - id: orders
+    uri: lb://orders
+    predicates:
+      - Path=/orders/{id},/orders
+      - Method=GET
+    filters:
+      - SetPath=/order/{id}
+  - id: docs
+    uri: https://docs.example.com
+    predicates:
+      - Host=**.docs.example.com
+      - Query=lang, en|fr
+    filters:
+      - RewritePath=/(?P<page>.*), /pages/$\{page}
+      - RemoveRequestHeader=Cookie
+`
+
+func loadTestTable(t *testing.T, content, name string) *RouteTable {
+	dir, err := ioutil.TempDir("", "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal("load failed: ", err)
+	}
+	table, err := NewRouteTable(config)
+	if err != nil {
+		t.Fatal("invalid routes: ", err)
+	}
+	return table
+}
+
+func TestRouteTable_Match(t *testing.T) {
+	table := loadTestTable(t, testRoutes, "routes.yml")
+
+	tests := []struct {
+		method, target string
+		header         map[string]string
+		route, path    string
+	}{
+		{"POST", "/orders/42/items/", map[string]string{"X-Version": "2"}, "orders-v2", "/v2/42/items/"},
+		{"GET", "/orders", map[string]string{"X-Version": "2"}, "orders-v2", "/v2/"},
+		{"GET", "/orders/42", nil, "orders", "/order/42"},
+		{"GET", "/orders/42/", nil, "orders", "/order/42"},
+		{"POST", "/orders/42", nil, "", ""},
+		{"GET", "/orders/42/items", nil, "", ""},
+		{"GET", "http://api.docs.example.com:8080/a%2Fb/c?lang=fr", nil, "docs", "/pages/a%2Fb/c"},
+		{"GET", "http://docs.example.com/a?lang=de", nil, "", ""},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, test.target, nil)
+		request.Header.Set("Cookie", "session=1")
+		for name, value := range test.header {
+			request.Header.Set(name, value)
+		}
+		route, exchange, exist := table.Match(request)
+		if test.route == "" {
+			if exist {
+				t.Fatalf("%s %s: unexpected route %s", test.method, test.target, route.Id)
+			}
+			continue
+		}
+		if !exist || route.Id != test.route || exchange.Path != test.path {
+			t.Fatalf("%s %s: expected %s %s, actual %v %v", test.method, test.target, test.route, test.path, route, exchange)
+		}
+	}
+
+	request := httptest.NewRequest("GET", "/orders/1", nil)
+	request.Header.Set("X-Version", "2")
+	_, exchange, _ := table.Match(request)
+	if exchange.Header.Get("X-Gateway") != "true" || request.Header.Get("X-Gateway") != "" {
+		t.Fatal("the header filter should change the exchange only")
+	}
+	route, _, _ := table.Match(httptest.NewRequest("GET", "http://www.docs.example.com/?lang=en", nil))
+	if route.LoadBalanced() || route.Uri.Host != "docs.example.com" {
+		t.Fatal("wrong static target: ", route.Uri)
+	}
+}
+
+func TestRouteTable_Weight(t *testing.T) {
+	table := loadTestTable(t, `{"routes": [
+		{"id": "v1", "uri": "lb://demo-v1", "predicates": ["Path=/demo/**", "Weight=demo, 3"]},
+		{"id": "v2", "uri": "lb://demo-v2", "predicates": ["Path=/demo/**", "Weight=demo, 1"]}
+	]}`, "routes.json")
+
+	counts := map[string]int{}
+	draw := 0
+	table.random = func(n int) int {
+		draw = (draw + 1) % n
+		return draw
+	}
+	for i := 0; i < 8; i++ {
+		route, _, exist := table.Match(httptest.NewRequest("GET", "/demo/x", nil))
+		if !exist {
+			t.Fatal("no route in the weight group")
+		}
+		counts[route.ServiceId()]++
+	}
+	if counts["demo-v1"] != 6 || counts["demo-v2"] != 2 {
+		t.Fatal("wrong split: ", counts)
+	}
+}
+
+func TestNewRouteTable_Invalid(t *testing.T) {
+	_, err := NewRouteTable(&Config{Routes: []RouteDefinition{
+		{Id: "ok", Uri: "lb://demo", Predicates: []string{"Path=/demo/**"}},
+		{Id: "ok", Uri: "lb://demo"},
+		{Id: "scheme", Uri: "ftp://demo"},
+		{Id: "predicate", Uri: "lb://demo", Predicates: []string{"Cookie=a"}},
+		{Id: "filter", Uri: "lb://demo", Filters: []string{"StripPrefix=x"}},
+		{Uri: "lb://demo"},
+	}})
+	if err == nil {
+		t.Fatal("invalid routes accepted")
+	}
+	for _, expected := range []string{"route 1 (ok): duplicate id", "route 2 (scheme)", "unknown predicate:Cookie", "invalid StripPrefix:x", "route 5 (): missing id"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("error should mention %s:%s", expected, err)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package health
+
+import "github.com/pkg/errors"
+
+func diskSpace(path string) (total, free uint64, err error) {
+	return 0, 0, errors.New("disk space is not supported on this platform")
+}
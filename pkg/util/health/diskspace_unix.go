@@ -0,0 +1,14 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package health
+
+import "syscall"
+
+func diskSpace(path string) (total, free uint64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return stat.Blocks * uint64(stat.Bsize), stat.Bavail * uint64(stat.Bsize), nil
+}
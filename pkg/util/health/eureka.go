@@ -0,0 +1,29 @@
+package health
+
+import "gin-demo/pkg/util/springcloud"
+
+// EurekaStatusHandler sets the eureka status of the instance from indicator before each heartbeat.
+// It only switches between UP and DOWN, the statuses set by the application, like
+// OUT_OF_SERVICE during a drain or STARTING, are left alone
+type EurekaStatusHandler struct {
+	indicator HealthIndicator
+}
+
+// NewEurekaStatusHandler should not be given the eureka indicator, the instance would otherwise
+// take itself out of the registry whenever eureka is unreachable
+func NewEurekaStatusHandler(indicator HealthIndicator) *EurekaStatusHandler {
+	return &EurekaStatusHandler{indicator: indicator}
+}
+
+func (h *EurekaStatusHandler) GetStatus(currentStatus string) string {
+	if currentStatus != springcloud.StatusUp && currentStatus != springcloud.StatusDown {
+		return currentStatus
+	}
+
+	switch h.indicator.Health().Status {
+	case StatusUp, StatusUnknown:
+		return springcloud.StatusUp
+	default:
+		return springcloud.StatusDown
+	}
+}
@@ -0,0 +1,128 @@
+// Package health reports the health of the application in the spring boot actuator format
+// and drives the status registered with eureka from it
+package health
+
+import (
+	"sort"
+	"sync"
+)
+
+const (
+	StatusUp           = "UP"
+	StatusDown         = "DOWN"
+	StatusOutOfService = "OUT_OF_SERVICE"
+	StatusUnknown      = "UNKNOWN"
+)
+
+// statusOrder ranks the statuses, the aggregate is the most severe one, like in spring boot
+var statusOrder = map[string]int{
+	StatusDown:         0,
+	StatusOutOfService: 1,
+	StatusUp:           2,
+	StatusUnknown:      3,
+}
+
+type Health struct {
+	Status     string                 `json:"status"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	Components map[string]Health      `json:"components,omitempty"`
+}
+
+type HealthIndicator interface {
+	Health() Health
+}
+
+// IndicatorFunc adapts a function to HealthIndicator
+type IndicatorFunc func() Health
+
+func (f IndicatorFunc) Health() Health {
+	return f()
+}
+
+// Composite aggregates named indicators, it reports UP when it has none
+type Composite struct {
+	rwLock     *sync.RWMutex
+	indicators map[string]HealthIndicator
+}
+
+func NewComposite() *Composite {
+	return &Composite{
+		rwLock:     &sync.RWMutex{},
+		indicators: make(map[string]HealthIndicator),
+	}
+}
+
+// Add registers indicator under name, replacing the one registered before
+func (c *Composite) Add(name string, indicator HealthIndicator) {
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	c.indicators[name] = indicator
+}
+
+func (c *Composite) Health() Health {
+	return c.healthExcept()
+}
+
+// Without returns an indicator aggregating everything but the named indicators,
+// it follows the later changes of c
+func (c *Composite) Without(names ...string) HealthIndicator {
+	return IndicatorFunc(func() Health {
+		return c.healthExcept(names...)
+	})
+}
+
+func (c *Composite) healthExcept(excluded ...string) Health {
+	c.rwLock.RLock()
+	names := make([]string, 0, len(c.indicators))
+	indicators := make(map[string]HealthIndicator, len(c.indicators))
+	for name, indicator := range c.indicators {
+		if !contains(excluded, name) {
+			names = append(names, name)
+			indicators[name] = indicator
+		}
+	}
+	c.rwLock.RUnlock()
+	sort.Strings(names)
+
+	status := StatusUp
+	if len(names) > 0 {
+		status = StatusUnknown
+	}
+	components := make(map[string]Health, len(names))
+	for _, name := range names {
+		health := indicators[name].Health()
+		components[name] = health
+		if severity(health.Status) < severity(status) {
+			status = health.Status
+		}
+	}
+
+	return Health{Status: status, Components: components}
+}
+
+// severity places the custom statuses between OUT_OF_SERVICE and UP
+func severity(status string) int {
+	if order, exist := statusOrder[status]; exist {
+		return order * 2
+	}
+	return statusOrder[StatusOutOfService]*2 + 1
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HttpStatus is the response code for the health endpoint, 503 when the instance should not get traffic
+func HttpStatus(status string) int {
+	switch status {
+	case StatusDown, StatusOutOfService:
+		return 503
+	default:
+		return 200
+	}
+}
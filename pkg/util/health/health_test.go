@@ -0,0 +1,116 @@
+package health
+
+import (
+	"gin-demo/pkg/util/springcloud"
+	"os"
+	"testing"
+	"time"
+)
+
+func fixed(status string) HealthIndicator {
+	return IndicatorFunc(func() Health {
+		return Health{Status: status}
+	})
+}
+
+func TestComposite_Health(t *testing.T) {
+	tests := []struct {
+		statuses []string
+		want     string
+	}{
+		{nil, StatusUp},
+		{[]string{StatusUp, StatusUnknown}, StatusUp},
+		{[]string{StatusUnknown}, StatusUnknown},
+		{[]string{StatusUp, StatusOutOfService}, StatusOutOfService},
+		{[]string{StatusOutOfService, StatusDown, StatusUp}, StatusDown},
+		{[]string{StatusUp, "DEGRADED"}, "DEGRADED"},
+	}
+
+	for _, test := range tests {
+		composite := NewComposite()
+		for i, status := range test.statuses {
+			composite.Add(string(rune('a'+i)), fixed(status))
+		}
+		health := composite.Health()
+		if health.Status != test.want {
+			t.Errorf("%v: expect %s, got %s", test.statuses, test.want, health.Status)
+		}
+		if len(health.Components) != len(test.statuses) {
+			t.Errorf("%v: expect %d components, got %d", test.statuses, len(test.statuses), len(health.Components))
+		}
+	}
+}
+
+func TestComposite_Without(t *testing.T) {
+	composite := NewComposite()
+	composite.Add("db", fixed(StatusUp))
+	without := composite.Without("eureka")
+	composite.Add("eureka", fixed(StatusDown))
+
+	if status := composite.Health().Status; status != StatusDown {
+		t.Fatalf("expect DOWN, got %s", status)
+	}
+	health := without.Health()
+	if health.Status != StatusUp {
+		t.Fatalf("expect UP without eureka, got %s", health.Status)
+	}
+	if _, exist := health.Components["eureka"]; exist {
+		t.Fatal("eureka should be excluded")
+	}
+}
+
+type fetcher time.Time
+
+func (f fetcher) LastFetchTime() time.Time {
+	return time.Time(f)
+}
+
+func TestEurekaIndicator(t *testing.T) {
+	tests := []struct {
+		lastFetchTime time.Time
+		want          string
+	}{
+		{time.Time{}, StatusUnknown},
+		{time.Now(), StatusUp},
+		{time.Now().Add(-2 * time.Minute), StatusDown},
+	}
+
+	for _, test := range tests {
+		if status := EurekaIndicator(fetcher(test.lastFetchTime), time.Minute).Health().Status; status != test.want {
+			t.Errorf("%v: expect %s, got %s", test.lastFetchTime, test.want, status)
+		}
+	}
+}
+
+func TestDiskSpaceIndicator(t *testing.T) {
+	if status := DiskSpaceIndicator(os.TempDir(), 0).Health().Status; status != StatusUp {
+		t.Errorf("expect UP, got %s", status)
+	}
+	if status := DiskSpaceIndicator(os.TempDir(), 1<<62).Health().Status; status != StatusDown {
+		t.Errorf("expect DOWN below the threshold, got %s", status)
+	}
+	if status := DiskSpaceIndicator("/no/such/dir", 0).Health().Status; status != StatusDown {
+		t.Errorf("expect DOWN for a missing directory, got %s", status)
+	}
+}
+
+func TestEurekaStatusHandler(t *testing.T) {
+	tests := []struct {
+		current string
+		health  string
+		want    string
+	}{
+		{springcloud.StatusUp, StatusDown, springcloud.StatusDown},
+		{springcloud.StatusUp, StatusOutOfService, springcloud.StatusDown},
+		{springcloud.StatusDown, StatusUp, springcloud.StatusUp},
+		{springcloud.StatusDown, StatusUnknown, springcloud.StatusUp},
+		{springcloud.StatusOutOfService, StatusUp, springcloud.StatusOutOfService},
+		{springcloud.StatusStarting, StatusDown, springcloud.StatusStarting},
+	}
+
+	for _, test := range tests {
+		if status := NewEurekaStatusHandler(fixed(test.health)).GetStatus(test.current); status != test.want {
+			t.Errorf("%s with %s health: expect %s, got %s", test.current, test.health, test.want, status)
+		}
+	}
+}
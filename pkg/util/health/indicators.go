@@ -0,0 +1,94 @@
+package health
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"os"
+	"time"
+)
+
+// DatabaseIndicator pings the connection pool of db and reports its statistics
+func DatabaseIndicator(db *gorm.DB, timeout time.Duration) HealthIndicator {
+	return IndicatorFunc(func() Health {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return Health{Status: StatusDown, Details: map[string]interface{}{"error": err.Error()}}
+		}
+
+		stats := sqlDB.Stats()
+		details := map[string]interface{}{
+			"database":          db.Dialector.Name(),
+			"maxOpenConns":      stats.MaxOpenConnections,
+			"openConns":         stats.OpenConnections,
+			"inUse":             stats.InUse,
+			"idle":              stats.Idle,
+			"waitCount":         stats.WaitCount,
+			"waitDurationMs":    stats.WaitDuration.Milliseconds(),
+			"maxIdleClosed":     stats.MaxIdleClosed,
+			"maxLifetimeClosed": stats.MaxLifetimeClosed,
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := sqlDB.PingContext(ctx); err != nil {
+			details["error"] = err.Error()
+			return Health{Status: StatusDown, Details: details}
+		}
+		return Health{Status: StatusUp, Details: details}
+	})
+}
+
+// registryFetcher is the part of the eureka client the freshness check needs
+type registryFetcher interface {
+	LastFetchTime() time.Time
+}
+
+// EurekaIndicator reports DOWN when the registry was not fetched within maxAge,
+// maxAge should cover a few fetch intervals
+func EurekaIndicator(eureka registryFetcher, maxAge time.Duration) HealthIndicator {
+	return IndicatorFunc(func() Health {
+		lastFetchTime := eureka.LastFetchTime()
+		if lastFetchTime.IsZero() {
+			return Health{Status: StatusUnknown, Details: map[string]interface{}{"error": "registry not fetched yet"}}
+		}
+
+		age := time.Since(lastFetchTime)
+		details := map[string]interface{}{
+			"lastFetchTime": lastFetchTime.Format(time.RFC3339),
+			"ageSeconds":    int64(age.Seconds()),
+		}
+		if age > maxAge {
+			details["error"] = "registry is stale"
+			return Health{Status: StatusDown, Details: details}
+		}
+		return Health{Status: StatusUp, Details: details}
+	})
+}
+
+// DiskSpaceIndicator reports DOWN when the file system of path has less than threshold bytes free
+func DiskSpaceIndicator(path string, threshold uint64) HealthIndicator {
+	return IndicatorFunc(func() Health {
+		details := map[string]interface{}{
+			"path":      path,
+			"threshold": threshold,
+		}
+		if _, err := os.Stat(path); err != nil {
+			details["exists"] = false
+			details["error"] = err.Error()
+			return Health{Status: StatusDown, Details: details}
+		}
+		details["exists"] = true
+
+		total, free, err := diskSpace(path)
+		if err != nil {
+			details["error"] = err.Error()
+			return Health{Status: StatusUnknown, Details: details}
+		}
+		details["total"] = total
+		details["free"] = free
+		if free < threshold {
+			return Health{Status: StatusDown, Details: details}
+		}
+		return Health{Status: StatusUp, Details: details}
+	})
+}
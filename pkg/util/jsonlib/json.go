@@ -2,6 +2,7 @@ package jsonlib
 
 import (
 	jsoniter "github.com/json-iterator/go"
+	"io"
 )
 
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
@@ -13,3 +14,7 @@ func Marshal(v interface{}) ([]byte, error) {
 func Unmarshal(data []byte, v interface{}) error {
 	return json.Unmarshal(data, v)
 }
+
+func NewDecoder(reader io.Reader) *jsoniter.Decoder {
+	return json.NewDecoder(reader)
+}
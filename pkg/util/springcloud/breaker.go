@@ -0,0 +1,206 @@
+package springcloud
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
+	"time"
+)
+
+var circuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "circuit_breaker_state",
+	Help: "The state of the circuit breakers, 1 for the current state and 0 for the others",
+}, []string{"name", "state"})
+
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // the calls go through
+	CircuitOpen                         // the calls are rejected until OpenDuration is over
+	CircuitHalfOpen                     // a few trial calls decide whether to close or open again
+)
+
+var circuitStates = []CircuitState{CircuitClosed, CircuitOpen, CircuitHalfOpen}
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "CLOSED"
+	case CircuitOpen:
+		return "OPEN"
+	case CircuitHalfOpen:
+		return "HALF_OPEN"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// CircuitBreakerConfig opens the circuit when too many of the recent calls failed or were slow
+type CircuitBreakerConfig struct {
+	// Window is how far back the rates are computed, 10 seconds when unset
+	Window time.Duration
+	// MinRequests in the window before the rates are taken into account
+	MinRequests int
+	// FailureRate between 0 and 1 at which the circuit opens, 0 to ignore the failures
+	FailureRate float64
+	// SlowCallRate between 0 and 1 at which the circuit opens, 0 to ignore the slow calls
+	SlowCallRate float64
+	// SlowCallDuration is the duration from which a call is slow, failed or not
+	SlowCallDuration time.Duration
+	// OpenDuration is how long the calls are rejected before the trial calls
+	OpenDuration time.Duration
+	// HalfOpenRequests is the number of trial calls, their rates close or open the circuit again
+	HalfOpenRequests int
+}
+
+func DefaultCircuitBreakerConfig() CircuitBreakerConfig {
+	return CircuitBreakerConfig{
+		Window:           10 * time.Second,
+		MinRequests:      20,
+		FailureRate:      0.5,
+		SlowCallRate:     0.8,
+		SlowCallDuration: 5 * time.Second,
+		OpenDuration:     30 * time.Second,
+		HalfOpenRequests: 5,
+	}
+}
+
+// tripped tells whether the calls cross one of the rates
+func (config CircuitBreakerConfig) tripped(calls callCounts) bool {
+	requests := float64(calls.requests)
+	return (config.FailureRate > 0 && float64(calls.failures) >= config.FailureRate*requests) ||
+		(config.SlowCallRate > 0 && float64(calls.slow) >= config.SlowCallRate*requests)
+}
+
+// CircuitBreaker stops the calls to a failing or slow dependency for a while, so that callers
+// fail fast instead of waiting for it. Every call let through by Allow must be given to Record
+type CircuitBreaker struct {
+	name   string
+	config CircuitBreakerConfig
+	now    func() time.Time
+	lock   *sync.Mutex
+	state  CircuitState
+	window slidingWindow
+	// openedAt is when the circuit last opened
+	openedAt time.Time
+	// the trial calls let through and their outcome so far, while half open
+	permits int
+	trials  callCounts
+	removed bool // the state gauge is gone, see Remove
+}
+
+// NewCircuitBreaker creates a closed circuit, name labels its state gauge
+func NewCircuitBreaker(name string, config CircuitBreakerConfig) *CircuitBreaker {
+	if config.Window < windowBuckets {
+		config.Window = DefaultCircuitBreakerConfig().Window
+	}
+	breaker := &CircuitBreaker{
+		name:   name,
+		config: config,
+		now:    time.Now,
+		lock:   new(sync.Mutex),
+		window: newSlidingWindow(config.Window),
+	}
+	breaker.transition(CircuitClosed)
+	return breaker
+}
+
+func (b *CircuitBreaker) Name() string {
+	return b.name
+}
+
+// State is the current state, an open circuit turns half open once OpenDuration is over
+func (b *CircuitBreaker) State() CircuitState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.halfOpenIfDue()
+	return b.state
+}
+
+// Allow tells whether a call may go through, it takes one of the trial calls while half open
+func (b *CircuitBreaker) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.halfOpenIfDue()
+	switch b.state {
+	case CircuitClosed:
+		return true
+	case CircuitHalfOpen:
+		if b.permits < b.config.HalfOpenRequests {
+			b.permits++
+			return true
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+// Record counts the outcome of a call let through by Allow
+func (b *CircuitBreaker) Record(duration time.Duration, failed bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	slow := b.config.SlowCallDuration > 0 && duration >= b.config.SlowCallDuration
+	switch b.state {
+	case CircuitClosed:
+		calls := b.window.add(b.now(), failed, slow)
+		if calls.requests >= b.config.MinRequests && b.config.tripped(calls) {
+			b.open()
+		}
+	case CircuitHalfOpen:
+		b.trials.add(failed, slow)
+		if b.trials.requests < b.config.HalfOpenRequests {
+			return
+		}
+		if b.config.tripped(b.trials) {
+			b.open()
+			return
+		}
+		// start over with an empty window
+		b.window.reset()
+		b.transition(CircuitClosed)
+	}
+	// late answers of the calls let through before the circuit opened are ignored
+}
+
+// Remove deletes the state gauge of a breaker not used anymore, e.g. of an instance which left the
+// registry. The calls still in flight may record their outcome, the gauge does not come back
+func (b *CircuitBreaker) Remove() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.removed = true
+	for _, s := range circuitStates {
+		circuitBreakerState.DeleteLabelValues(b.name, s.String())
+	}
+}
+
+func (b *CircuitBreaker) open() {
+	b.openedAt = b.now()
+	b.transition(CircuitOpen)
+}
+
+// halfOpenIfDue lets the trial calls through once OpenDuration is over. Requires the lock
+func (b *CircuitBreaker) halfOpenIfDue() {
+	if b.state == CircuitOpen && !b.now().Before(b.openedAt.Add(b.config.OpenDuration)) {
+		b.permits = 0
+		b.trials = callCounts{}
+		b.transition(CircuitHalfOpen)
+	}
+}
+
+func (b *CircuitBreaker) transition(state CircuitState) {
+	b.state = state
+	if b.removed {
+		return
+	}
+	for _, s := range circuitStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		circuitBreakerState.WithLabelValues(b.name, s.String()).Set(value)
+	}
+}
@@ -0,0 +1,118 @@
+package springcloud
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := newFakeNow()
+	config := DefaultCircuitBreakerConfig()
+	config.MinRequests = 4
+	config.HalfOpenRequests = 2
+	breaker := NewCircuitBreaker("demo-v1", config)
+	breaker.now = now.Now
+
+	expectState := func(expected CircuitState) {
+		t.Helper()
+		if actual := breaker.State(); actual != expected {
+			t.Fatalf("wrong state, expected:%s, actual:%s", expected, actual)
+		}
+		if value := testutil.ToFloat64(circuitBreakerState.WithLabelValues("demo-v1", expected.String())); value != 1 {
+			t.Fatalf("wrong gauge of %s:%v", expected, value)
+		}
+	}
+
+	// below the minimum requests, then below the failure rate
+	for _, failed := range []bool{false, false, false, true, true, false, false} {
+		if !breaker.Allow() {
+			t.Fatal("closed circuit rejected a call")
+		}
+		breaker.Record(time.Millisecond, failed)
+	}
+	expectState(CircuitClosed)
+
+	// failures out of the window do not count
+	now.Advance(config.Window)
+	for i := 0; i < 3; i++ {
+		breaker.Record(time.Millisecond, true)
+	}
+	expectState(CircuitClosed)
+	breaker.Record(time.Millisecond, false)
+	expectState(CircuitOpen)
+	if breaker.Allow() {
+		t.Fatal("open circuit let a call through")
+	}
+
+	// a failed trial opens it again
+	now.Advance(config.OpenDuration)
+	expectState(CircuitHalfOpen)
+	if !breaker.Allow() || !breaker.Allow() || breaker.Allow() {
+		t.Fatal("expect exactly 2 trial calls")
+	}
+	breaker.Record(time.Millisecond, false)
+	breaker.Record(time.Millisecond, true)
+	expectState(CircuitOpen)
+
+	// successful trials close it
+	now.Advance(config.OpenDuration)
+	breaker.Allow()
+	breaker.Allow()
+	breaker.Record(time.Millisecond, false)
+	breaker.Record(time.Millisecond, false)
+	expectState(CircuitClosed)
+}
+
+func TestCircuitBreaker_SlowCalls(t *testing.T) {
+	now := newFakeNow()
+	config := DefaultCircuitBreakerConfig()
+	config.MinRequests = 5
+	breaker := NewCircuitBreaker("demo-v2", config)
+	breaker.now = now.Now
+
+	// 3 slow successes out of 5 stay under the slow call rate
+	for _, duration := range []time.Duration{config.SlowCallDuration, config.SlowCallDuration, config.SlowCallDuration, 0, 0} {
+		breaker.Record(duration, false)
+	}
+	if breaker.State() != CircuitClosed {
+		t.Fatal("opened under the slow call rate")
+	}
+	for i := 0; i < 15; i++ {
+		breaker.Record(config.SlowCallDuration, false)
+	}
+	if breaker.State() != CircuitOpen {
+		t.Fatal("still closed with 18 slow calls out of 20")
+	}
+}
+
+func TestCircuitBreaker_DefaultWindow(t *testing.T) {
+	breaker := NewCircuitBreaker("demo-v1", CircuitBreakerConfig{MinRequests: 2, FailureRate: 0.5, OpenDuration: time.Minute})
+	breaker.now = newFakeNow().Now
+	if breaker.config.Window != DefaultCircuitBreakerConfig().Window {
+		t.Fatalf("wrong window, expected:%s, actual:%s", DefaultCircuitBreakerConfig().Window, breaker.config.Window)
+	}
+	breaker.Record(time.Millisecond, true)
+	breaker.Record(time.Millisecond, true)
+	if state := breaker.State(); state != CircuitOpen {
+		t.Fatalf("wrong state, expected:%s, actual:%s", CircuitOpen, state)
+	}
+}
+
+func TestCircuitBreaker_Remove(t *testing.T) {
+	gauges := testutil.CollectAndCount(circuitBreakerState)
+	breaker := NewCircuitBreaker("demo-v4", CircuitBreakerConfig{MinRequests: 1, FailureRate: 0.5, OpenDuration: time.Minute})
+	if count := testutil.CollectAndCount(circuitBreakerState); count != gauges+len(circuitStates) {
+		t.Fatalf("wrong gauge count, expected:%d, actual:%d", gauges+len(circuitStates), count)
+	}
+
+	breaker.Remove()
+	// a late call opening the circuit does not bring the gauge back
+	breaker.Record(time.Millisecond, true)
+	if count := testutil.CollectAndCount(circuitBreakerState); count != gauges {
+		t.Fatalf("wrong gauge count, expected:%d, actual:%d", gauges, count)
+	}
+	if state := breaker.State(); state != CircuitOpen {
+		t.Fatalf("wrong state, expected:%s, actual:%s", CircuitOpen, state)
+	}
+}
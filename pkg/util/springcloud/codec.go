@@ -0,0 +1,131 @@
+package springcloud
+
+import (
+	"bytes"
+	"encoding/xml"
+	"gin-demo/pkg/util/jsonlib"
+	"sort"
+	"strings"
+)
+
+const (
+	FormatJson = "json"
+	FormatXml  = "xml"
+)
+
+type instanceDescriptor struct {
+	Instance ApplicationInstanceDto `json:"instance"`
+}
+
+// MetadataMap is encoded in XML as one <key>value</key> element per entry, like eureka does
+type MetadataMap map[string]string
+
+func (m MetadataMap) MarshalXML(encoder *xml.Encoder, start xml.StartElement) error {
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := encoder.EncodeElement(m[key], xml.StartElement{Name: xml.Name{Local: key}}); err != nil {
+			return err
+		}
+	}
+
+	return encoder.EncodeToken(start.End())
+}
+
+func (m *MetadataMap) UnmarshalXML(decoder *xml.Decoder, start xml.StartElement) error {
+	metadata := MetadataMap{}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			var value string
+			if err := decoder.DecodeElement(&value, &element); err != nil {
+				return err
+			}
+			metadata[element.Name.Local] = value
+		case xml.EndElement:
+			*m = metadata
+			return nil
+		}
+	}
+}
+
+// acceptHeader asks for the configured format, or for both with a preference for json
+func (e *Eureka) acceptHeader() string {
+	switch e.WireFormat {
+	case FormatJson:
+		return "application/json"
+	case FormatXml:
+		return "application/xml"
+	default:
+		return "application/json, application/xml;q=0.9"
+	}
+}
+
+// requestFormat is the configured format, or the one the server answered with last time
+func (e *Eureka) requestFormat() string {
+	if e.WireFormat != "" {
+		return e.WireFormat
+	}
+
+	e.rwLock.RLock()
+	defer e.rwLock.RUnlock()
+	if e.negotiatedFormat != "" {
+		return e.negotiatedFormat
+	}
+	return FormatJson
+}
+
+func formatOf(contentType string) string {
+	if strings.Contains(contentType, "xml") {
+		return FormatXml
+	}
+	return FormatJson
+}
+
+func contentTypeOf(format string) string {
+	if format == FormatXml {
+		return "application/xml"
+	}
+	return "application/json"
+}
+
+func decodeApplications(format string, data []byte) (*applicationsDto, error) {
+	if format == FormatXml {
+		var applications applicationsDto
+		if err := xml.Unmarshal(data, &applications); err != nil {
+			return nil, err
+		}
+		return &applications, nil
+	}
+
+	var application Application
+	if err := jsonlib.Unmarshal(data, &application); err != nil {
+		return nil, err
+	}
+	return &application.Applications, nil
+}
+
+// encodeInstance builds the registration body: {"instance":{...}} or <instance>...</instance>
+func encodeInstance(format string, instance ApplicationInstanceDto) ([]byte, error) {
+	if format == FormatXml {
+		var buffer bytes.Buffer
+		if err := xml.NewEncoder(&buffer).EncodeElement(&instance, xml.StartElement{Name: xml.Name{Local: "instance"}}); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	}
+
+	return jsonlib.Marshal(&instanceDescriptor{Instance: instance})
+}
@@ -0,0 +1,168 @@
+package springcloud
+
+import (
+	"encoding/xml"
+	"gin-demo/pkg/util/springcloud/eurekatest"
+	"strings"
+	"testing"
+)
+
+const applicationsXml = `<applications>
+  <versions__delta>1</versions__delta>
+  <apps__hashcode>UP_1_</apps__hashcode>
+  <application>
+    <name>DEMO-V1</name>
+    <instance>
+      <instanceId>demo-v1-1</instanceId>
+      <hostName>10.0.0.1</hostName>
+      <app>DEMO-V1</app>
+      <ipAddr>10.0.0.1</ipAddr>
+      <status>UP</status>
+      <overriddenstatus>UNKNOWN</overriddenstatus>
+      <port enabled="true">8080</port>
+      <securePort enabled="false">443</securePort>
+      <countryId>1</countryId>
+      <dataCenterInfo class="com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo">
+        <name>MyOwn</name>
+      </dataCenterInfo>
+      <leaseInfo>
+        <renewalIntervalInSecs>30</renewalIntervalInSecs>
+        <durationInSecs>90</durationInSecs>
+      </leaseInfo>
+      <metadata>
+        <version>2</version>
+        <zone>zone1</zone>
+      </metadata>
+      <vipAddress>demo-v1</vipAddress>
+    </instance>
+  </application>
+</applications>`
+
+func TestDecodeApplications_Xml(t *testing.T) {
+	applications, err := decodeApplications(FormatXml, []byte(applicationsXml))
+	if err != nil {
+		t.Fatal("failed to decode: ", err)
+	}
+	if applications.AppsHashcode != "UP_1_" || len(applications.Application) != 1 {
+		t.Fatalf("wrong applications: %+v", applications)
+	}
+
+	instance := applications.Application[0].Instance[0]
+	if instance.Port.Value != 8080 || instance.Port.Enabled != "true" || instance.SecurePort.Enabled != "false" {
+		t.Fatalf("wrong ports, port:%+v, securePort:%+v", instance.Port, instance.SecurePort)
+	}
+	if instance.DataCenterInfo.Name != "MyOwn" || instance.DataCenterInfo.Class != defaultDataCenterInfoClass {
+		t.Fatalf("wrong dataCenterInfo: %+v", instance.DataCenterInfo)
+	}
+	if instance.LeaseInfo == nil || instance.LeaseInfo.DurationInSecs != 90 {
+		t.Fatalf("wrong leaseInfo: %+v", instance.LeaseInfo)
+	}
+	if len(instance.Metadata) != 2 || instance.Metadata["version"] != "2" || instance.Metadata["zone"] != "zone1" {
+		t.Fatalf("wrong metadata: %v", instance.Metadata)
+	}
+}
+
+const applicationsJson = `{"applications":{"versions__delta":"1","apps__hashcode":"UP_1_","application":[{"name":"DEMO-V1","instance":[{
+	"instanceId":"demo-v1-1","hostName":"10.0.0.1","app":"DEMO-V1","ipAddr":"10.0.0.1","status":"UP","overriddenstatus":"UNKNOWN",
+	"port":{"$":8080,"@enabled":"false"},"securePort":{"$":8443,"@enabled":"true"},"countryId":1,
+	"dataCenterInfo":{"@class":"com.netflix.appinfo.AmazonInfo","name":"Amazon","metadata":{"availability-zone":"us-east-1a"}},
+	"leaseInfo":{"renewalIntervalInSecs":30,"durationInSecs":90,"registrationTimestamp":1602578393000,"lastRenewalTimestamp":1602578423000,"evictionTimestamp":0,"serviceUpTimestamp":1602578392000},
+	"metadata":{"version":"2"},"homePageUrl":"https://10.0.0.1:8443/","statusPageUrl":"https://10.0.0.1:8443/info","healthCheckUrl":"https://10.0.0.1:8443/health",
+	"vipAddress":"demo-v1","secureVipAddress":"demo-v1","isCoordinatingDiscoveryServer":"false",
+	"lastUpdatedTimestamp":"1602578393000","lastDirtyTimestamp":"1602578392000","actionType":"ADDED"}]}]}}`
+
+func TestDecodeApplications_Json(t *testing.T) {
+	applications, err := decodeApplications(FormatJson, []byte(applicationsJson))
+	if err != nil {
+		t.Fatal("failed to decode: ", err)
+	}
+
+	instanceDto := applications.Application[0].Instance[0]
+	if instanceDto.LastUpdatedTimestamp != 1602578393000 || instanceDto.LastDirtyTimestamp != 1602578392000 {
+		t.Fatalf("wrong timestamps, lastUpdated:%d, lastDirty:%d", instanceDto.LastUpdatedTimestamp, instanceDto.LastDirtyTimestamp)
+	}
+	if instanceDto.LeaseInfo == nil || instanceDto.LeaseInfo.ServiceUpTimestamp != 1602578392000 {
+		t.Fatalf("wrong leaseInfo: %+v", instanceDto.LeaseInfo)
+	}
+
+	instance := newApplicationInstance(&instanceDto)
+	if !instance.Secure() || instance.SecurePort != 8443 {
+		t.Fatalf("instance should be reached on its secure port: %+v", instance)
+	}
+	if instance.Zone() != "us-east-1a" {
+		t.Fatalf("wrong zone, expected:%s, actual:%s", "us-east-1a", instance.Zone())
+	}
+	if instance.Metadata["version"] != "2" || instance.HealthCheckUrl != "https://10.0.0.1:8443/health" {
+		t.Fatalf("wrong instance: %+v", instance)
+	}
+}
+
+func TestEncodeInstance_Xml(t *testing.T) {
+	body, err := encodeInstance(FormatXml, ApplicationInstanceDto{
+		InstanceId: "demo-v1-1",
+		Port:       PortDto{Value: 8080, Enabled: "true"},
+		Metadata:   MetadataMap{"version": "2"},
+	})
+	if err != nil {
+		t.Fatal("failed to encode: ", err)
+	}
+
+	for _, expected := range []string{"<instance>", `<port enabled="true">8080</port>`, "<metadata><version>2</version></metadata>"} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("%s not found in xml:%s", expected, string(body))
+		}
+	}
+
+	var instance ApplicationInstanceDto
+	if err := xml.Unmarshal(body, &instance); err != nil {
+		t.Fatal("failed to decode: ", err)
+	}
+	if instance.InstanceId != "demo-v1-1" || instance.Port.Value != 8080 || instance.Metadata["version"] != "2" {
+		t.Fatalf("wrong instance: %+v", instance)
+	}
+}
+
+func TestEureka_NegotiateXml(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.SetXmlOnly(true)
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-1", "10.0.0.1", 8080))
+
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, true, true)
+	eureka.HostName = "demo-host"
+	eureka.AddMetaData("version", "2")
+	if err := eureka.Start(); err != nil {
+		t.Fatal("eureka start failed: ", err)
+	}
+	defer eureka.Stop()
+
+	if _, exist := eureka.GetApplication("demo-v1"); !exist {
+		t.Fatal("application not found in xml registry")
+	}
+	instance, exist := server.Instance("gin-demo", "demo-host:gin-demo:8080")
+	if !exist {
+		t.Fatal("instance not registered with xml")
+	}
+	if instance.Metadata["version"] != "2" {
+		t.Fatalf("wrong metadata, expected:%s, actual:%s", "2", instance.Metadata["version"])
+	}
+}
+
+func TestEureka_ConfiguredXml(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-1", "10.0.0.1", 8080))
+
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, false, true)
+	eureka.WireFormat = FormatXml
+	applicationsDto, err := eureka.doFetch(server.ServiceUrl() + "apps/")
+	if err != nil {
+		t.Fatal("failed to fetch: ", err)
+	}
+	if eureka.negotiatedFormat != FormatXml {
+		t.Fatalf("wrong format, expected:%s, actual:%s", FormatXml, eureka.negotiatedFormat)
+	}
+	if len(applicationsDto.Application) != 1 {
+		t.Fatalf("wrong applications: %+v", applicationsDto)
+	}
+}
@@ -0,0 +1,124 @@
+package springcloud
+
+import (
+	"github.com/pkg/errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ActionAdded    = "ADDED"
+	ActionModified = "MODIFIED"
+	ActionDeleted  = "DELETED"
+)
+
+var errHashcodeMismatch = errors.New("apps hashcode mismatch")
+
+// fetchRegistry applies the recent changes from apps/delta to the local cache if there is one,
+// and falls back to a full fetch when the result differs from what the server has
+func (e *Eureka) fetchRegistry(baseUrl string) (ApplicationType, error) {
+	e.rwLock.RLock()
+	// the deltas of the server do not apply to a registry loaded from the snapshot
+	canApplyDelta := !e.DisableDelta && e.Applications != nil && !e.stale
+	e.rwLock.RUnlock()
+
+	if canApplyDelta {
+		applications, err := e.doGetDelta(baseUrl)
+		if err != errHashcodeMismatch {
+			return applications, err
+		}
+	}
+
+	return e.doGetApplications(baseUrl)
+}
+
+func (e *Eureka) doGetDelta(baseUrl string) (ApplicationType, error) {
+	delta, err := e.doFetch(baseUrl + "apps/delta")
+	if err != nil {
+		return nil, err
+	}
+
+	// hold the lock for the whole merge, so that concurrent fetches do not drop each other's changes
+	e.rwLock.Lock()
+	defer e.rwLock.Unlock()
+
+	applications := applyDelta(e.Applications, delta.Application)
+	if reconcileHashCode(applications) != delta.AppsHashcode {
+		return nil, errHashcodeMismatch
+	}
+
+	e.Applications = applications
+	return applications, nil
+}
+
+// applyDelta returns a copy of applications with the delta merged in, the input is left untouched
+func applyDelta(applications ApplicationType, delta []applicationDto) ApplicationType {
+	merged := make(ApplicationType, len(applications))
+	for appName, instances := range applications {
+		merged[appName] = instances
+	}
+
+	for _, app := range delta {
+		instances := make([]ApplicationInstanceDto, len(merged[app.Name]))
+		copy(instances, merged[app.Name])
+
+		for _, changed := range app.Instance {
+			index := -1
+			for i, instance := range instances {
+				if instance.InstanceId == changed.InstanceId {
+					index = i
+					break
+				}
+			}
+
+			switch changed.ActionType {
+			case ActionAdded, ActionModified:
+				changed.ActionType = ""
+				if index < 0 {
+					instances = append(instances, changed)
+				} else {
+					instances[index] = changed
+				}
+			case ActionDeleted:
+				if index >= 0 {
+					instances = append(instances[:index], instances[index+1:]...)
+				}
+			}
+		}
+
+		if len(instances) == 0 {
+			delete(merged, app.Name)
+		} else {
+			merged[app.Name] = instances
+		}
+	}
+
+	return merged
+}
+
+// reconcileHashCode computes apps__hashcode the way eureka does: the instance count
+// of every status, ordered by status, e.g. DOWN_1_UP_3_
+func reconcileHashCode(applications ApplicationType) string {
+	countByStatus := make(map[string]int)
+	for _, instances := range applications {
+		for _, instance := range instances {
+			countByStatus[instance.Status]++
+		}
+	}
+
+	statuses := make([]string, 0, len(countByStatus))
+	for status := range countByStatus {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	var builder strings.Builder
+	for _, status := range statuses {
+		builder.WriteString(status)
+		builder.WriteString("_")
+		builder.WriteString(strconv.Itoa(countByStatus[status]))
+		builder.WriteString("_")
+	}
+	return builder.String()
+}
@@ -0,0 +1,100 @@
+package springcloud
+
+import (
+	"gin-demo/pkg/util/springcloud/eurekatest"
+	"testing"
+)
+
+func TestReconcileHashCode(t *testing.T) {
+	applications := ApplicationType{
+		"DEMO-V1": {
+			{InstanceId: "a", Status: StatusUp},
+			{InstanceId: "b", Status: StatusDown},
+		},
+		"DEMO-V2": {
+			{InstanceId: "c", Status: StatusUp},
+			{InstanceId: "d", Status: StatusUp},
+		},
+	}
+
+	hashCode := reconcileHashCode(applications)
+	if hashCode != "DOWN_1_UP_3_" {
+		t.Fatalf("wrong hashcode, expected:%s, actual:%s", "DOWN_1_UP_3_", hashCode)
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	applications := ApplicationType{
+		"DEMO-V1": {
+			{InstanceId: "a", Status: StatusUp},
+			{InstanceId: "b", Status: StatusUp},
+		},
+		"DEMO-V2": {
+			{InstanceId: "c", Status: StatusUp},
+		},
+	}
+
+	merged := applyDelta(applications, []applicationDto{
+		{Name: "DEMO-V1", Instance: []ApplicationInstanceDto{
+			{InstanceId: "a", Status: StatusDown, ActionType: ActionModified},
+			{InstanceId: "e", Status: StatusUp, ActionType: ActionAdded},
+		}},
+		{Name: "DEMO-V2", Instance: []ApplicationInstanceDto{
+			{InstanceId: "c", ActionType: ActionDeleted},
+		}},
+		{Name: "DEMO-V3", Instance: []ApplicationInstanceDto{
+			{InstanceId: "f", Status: StatusUp, ActionType: ActionAdded},
+		}},
+	})
+
+	if len(merged["DEMO-V1"]) != 3 || merged["DEMO-V1"][0].Status != StatusDown || merged["DEMO-V1"][2].InstanceId != "e" {
+		t.Fatalf("wrong DEMO-V1 instances: %+v", merged["DEMO-V1"])
+	}
+	if _, exist := merged["DEMO-V2"]; exist {
+		t.Fatal("DEMO-V2 should be removed once its last instance is deleted")
+	}
+	if len(merged["DEMO-V3"]) != 1 {
+		t.Fatalf("wrong DEMO-V3 instances: %+v", merged["DEMO-V3"])
+	}
+	if applications["DEMO-V1"][0].Status != StatusUp || len(applications["DEMO-V2"]) != 1 {
+		t.Fatal("applyDelta modified its input")
+	}
+}
+
+func TestEureka_FetchDelta(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.Register(eurekatest.NewInstance("demo-v1", "a", "10.0.0.1", 8080))
+
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, false, true)
+	if _, err := eureka.GetApplications(); err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+
+	server.Register(eurekatest.NewInstance("demo-v1", "b", "10.0.0.2", 8080))
+	applications, err := eureka.GetApplications()
+	if err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+	if len(applications["DEMO-V1"]) != 2 {
+		t.Fatalf("delta not applied, instances:%+v", applications["DEMO-V1"])
+	}
+	if countRequests(server, "GET /eureka/apps/") != 1 || countRequests(server, "GET /eureka/apps/delta") != 1 {
+		t.Fatalf("wrong requests:%v", server.Requests())
+	}
+
+	// the change is gone from the delta, so the merged result disagrees with the server
+	// and the whole registry is fetched again
+	server.Register(eurekatest.NewInstance("demo-v1", "c", "10.0.0.3", 8080))
+	server.ClearDeltas()
+	applications, err = eureka.GetApplications()
+	if err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+	if len(applications["DEMO-V1"]) != 3 {
+		t.Fatalf("full registry not fetched, instances:%+v", applications["DEMO-V1"])
+	}
+	if count := countRequests(server, "GET /eureka/apps/"); count != 2 {
+		t.Fatalf("wrong full fetch count, expected:%d, actual:%d", 2, count)
+	}
+}
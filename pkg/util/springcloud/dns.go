@@ -0,0 +1,159 @@
+package springcloud
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver is the part of net.Resolver the dns discovery needs, tests replace it with a fake
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+// DnsConfig finds the eureka servers in dns, like spring cloud does with useDnsForFetchingServiceUrls.
+//
+// With TXT records, txt.<Region>.<Domain> lists the zones as <zone>.<Domain>, and txt.<zone>.<Domain>
+// lists the host names of the servers in the zone. With UseSrv, the servers come from the
+// _eureka._tcp.<Domain> SRV records, which also give their ports
+type DnsConfig struct {
+	Domain string
+	Region string
+	// Zone is the availability zone of this instance, its servers are preferred
+	Zone string
+	// Port and ContextPath build the server urls from the TXT records, 8761 and "eureka" by default
+	Port        int
+	ContextPath string
+	// Scheme of the server urls, http or https. When empty, https for the servers on port 443 and http otherwise
+	Scheme string
+	UseSrv bool
+	// RefreshInterval is how often the server list is resolved again, 5 minutes by default
+	RefreshInterval time.Duration
+	// Resolver defaults to net.DefaultResolver
+	Resolver Resolver
+}
+
+// NewEurekaWithDns resolves the eureka servers from dns, then keeps them up to date once started
+func NewEurekaWithDns(dns DnsConfig, applicationName string, registryFetchIntervalSeconds int, registerWithEureka bool, preferIpAddress bool) (*Eureka, error) {
+	if dns.Port == 0 {
+		dns.Port = 8761
+	}
+	if dns.ContextPath == "" {
+		dns.ContextPath = "eureka"
+	}
+	if dns.RefreshInterval == 0 {
+		dns.RefreshInterval = 5 * time.Minute
+	}
+	if dns.Resolver == nil {
+		dns.Resolver = net.DefaultResolver
+	}
+	if dns.Scheme != "" && dns.Scheme != "http" && dns.Scheme != "https" {
+		return nil, errors.Errorf("eureka dns scheme must be http or https, not:%s", dns.Scheme)
+	}
+
+	zones, err := dns.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	e := NewEurekaWithZones(zones, applicationName, registryFetchIntervalSeconds, registerWithEureka, preferIpAddress)
+	e.dns = &dns
+	return e, nil
+}
+
+// resolve looks the servers up, the result has at least one server url
+func (dns *DnsConfig) resolve() (ZoneConfig, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	zones := ZoneConfig{Region: dns.Region, Zone: dns.Zone, ServiceUrls: map[string]string{}}
+	if dns.UseSrv {
+		_, records, err := dns.Resolver.LookupSRV(ctx, "eureka", "tcp", dns.Domain)
+		if err != nil {
+			return zones, errors.Errorf("failed to look up the eureka srv records:%s", err)
+		}
+		// the records come sorted by priority and weight
+		urls := make([]string, 0, len(records))
+		for _, record := range records {
+			urls = append(urls, dns.serverUrl(record.Target, int(record.Port)))
+		}
+		zones.ServiceUrls[dns.Zone] = strings.Join(urls, ",")
+	} else {
+		zoneRecords, err := lookupTXT(ctx, dns.Resolver, "txt."+dns.Region+"."+dns.Domain)
+		if err != nil {
+			return zones, errors.Errorf("failed to look up the eureka zones:%s", err)
+		}
+		for _, zoneRecord := range zoneRecords {
+			hosts, err := lookupTXT(ctx, dns.Resolver, "txt."+zoneRecord)
+			if err != nil {
+				return zones, errors.Errorf("failed to look up the eureka servers of %s:%s", zoneRecord, err)
+			}
+			zone := strings.TrimSuffix(zoneRecord, "."+dns.Domain)
+			urls := make([]string, 0, len(hosts))
+			for _, host := range hosts {
+				urls = append(urls, dns.serverUrl(host, dns.Port))
+			}
+			zones.AvailabilityZones = append(zones.AvailabilityZones, zone)
+			zones.ServiceUrls[zone] = strings.Join(urls, ",")
+		}
+	}
+
+	if serverUrls, _ := zones.serverUrls(); len(serverUrls) == 0 {
+		return zones, errors.Errorf("no eureka server found in dns for %s", dns.Domain)
+	}
+	return zones, nil
+}
+
+func (dns *DnsConfig) serverUrl(host string, port int) string {
+	scheme := dns.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if port == 443 {
+			scheme = "https"
+		}
+	}
+	return scheme + "://" + strings.TrimSuffix(host, ".") + ":" + strconv.Itoa(port) + "/" + strings.Trim(dns.ContextPath, "/") + "/"
+}
+
+// lookupTXT splits the records on spaces, a record may hold several names
+func lookupTXT(ctx context.Context, resolver Resolver, name string) ([]string, error) {
+	records, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for _, record := range records {
+		for _, value := range strings.Fields(record) {
+			values = append(values, strings.TrimSuffix(value, "."))
+		}
+	}
+	return values, nil
+}
+
+// refreshServerUrls resolves the servers again, the current server is kept if it is still listed
+func (e *Eureka) refreshServerUrls() error {
+	zones, err := e.dns.resolve()
+	if err != nil {
+		return err
+	}
+	serverUrls, localServers := zones.serverUrls()
+
+	e.rwLock.Lock()
+	defer e.rwLock.Unlock()
+	currentServer := e.serverUrls[e.currentServerUrlIndex]
+	e.serverUrls = serverUrls
+	e.localServers = localServers
+	e.currentServerUrlIndex = 0
+	for i, url := range serverUrls {
+		if url == currentServer {
+			e.currentServerUrlIndex = i
+			break
+		}
+	}
+	return nil
+}
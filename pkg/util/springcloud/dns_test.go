@@ -0,0 +1,177 @@
+package springcloud
+
+import (
+	"context"
+	"gin-demo/pkg/util/springcloud/eurekatest"
+	"github.com/pkg/errors"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeResolver struct {
+	lock *sync.Mutex
+	txt  map[string][]string
+	srv  map[string][]*net.SRV
+}
+
+func newFakeResolver() *fakeResolver {
+	return &fakeResolver{lock: new(sync.Mutex), txt: map[string][]string{}, srv: map[string][]*net.SRV{}}
+}
+
+func (r *fakeResolver) setTXT(name string, records ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.txt[name] = records
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if records, exist := r.txt[name]; exist {
+		return records, nil
+	}
+	return nil, errors.New("no such host: " + name)
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	fqdn := "_" + service + "._" + proto + "." + name
+	if records, exist := r.srv[fqdn]; exist {
+		return fqdn, records, nil
+	}
+	return "", nil, errors.New("no such host: " + fqdn)
+}
+
+func TestDnsConfig_ResolveTXT(t *testing.T) {
+	resolver := newFakeResolver()
+	resolver.setTXT("txt.cn-east.eureka.example.com", "zone-a.eureka.example.com zone-b.eureka.example.com.")
+	resolver.setTXT("txt.zone-a.eureka.example.com", "a1.example.com", "a2.example.com")
+	resolver.setTXT("txt.zone-b.eureka.example.com", "b1.example.com.")
+
+	eureka, err := NewEurekaWithDns(DnsConfig{
+		Domain:   "eureka.example.com",
+		Region:   "cn-east",
+		Zone:     "zone-b",
+		Resolver: resolver,
+	}, "gin-demo", 30, false, true)
+	if err != nil {
+		t.Fatal("failed to resolve: ", err)
+	}
+
+	expected := []string{"http://b1.example.com:8761/eureka/", "http://a1.example.com:8761/eureka/", "http://a2.example.com:8761/eureka/"}
+	if !reflect.DeepEqual(eureka.serverUrls, expected) {
+		t.Fatalf("wrong server urls, expected:%v, actual:%v", expected, eureka.serverUrls)
+	}
+	if eureka.localServers != 1 {
+		t.Fatalf("wrong local server count, expected:%d, actual:%d", 1, eureka.localServers)
+	}
+}
+
+func TestDnsConfig_ResolveSRV(t *testing.T) {
+	resolver := newFakeResolver()
+	resolver.srv["_eureka._tcp.eureka.example.com"] = []*net.SRV{
+		{Target: "e1.example.com.", Port: 8761},
+		{Target: "e2.example.com.", Port: 8762},
+	}
+
+	eureka, err := NewEurekaWithDns(DnsConfig{Domain: "eureka.example.com", UseSrv: true, Resolver: resolver}, "gin-demo", 30, false, true)
+	if err != nil {
+		t.Fatal("failed to resolve: ", err)
+	}
+	expected := []string{"http://e1.example.com:8761/eureka/", "http://e2.example.com:8762/eureka/"}
+	if !reflect.DeepEqual(eureka.serverUrls, expected) {
+		t.Fatalf("wrong server urls, expected:%v, actual:%v", expected, eureka.serverUrls)
+	}
+
+	if _, err := NewEurekaWithDns(DnsConfig{Domain: "unknown.example.com", UseSrv: true, Resolver: resolver}, "gin-demo", 30, false, true); err == nil {
+		t.Fatal("expect an error without any server")
+	}
+}
+
+func TestDnsConfig_Scheme(t *testing.T) {
+	resolver := newFakeResolver()
+	resolver.srv["_eureka._tcp.eureka.example.com"] = []*net.SRV{
+		{Target: "e1.example.com.", Port: 443},
+		{Target: "e2.example.com.", Port: 8761},
+	}
+
+	tests := []struct {
+		scheme   string
+		expected []string
+	}{
+		// inferred from the port
+		{"", []string{"https://e1.example.com:443/eureka/", "http://e2.example.com:8761/eureka/"}},
+		{"https", []string{"https://e1.example.com:443/eureka/", "https://e2.example.com:8761/eureka/"}},
+		{"http", []string{"http://e1.example.com:443/eureka/", "http://e2.example.com:8761/eureka/"}},
+	}
+	for _, test := range tests {
+		eureka, err := NewEurekaWithDns(DnsConfig{Domain: "eureka.example.com", UseSrv: true, Scheme: test.scheme, Resolver: resolver}, "gin-demo", 30, false, true)
+		if err != nil {
+			t.Fatalf("scheme %q: failed to resolve: %s", test.scheme, err)
+		}
+		if !reflect.DeepEqual(eureka.serverUrls, test.expected) {
+			t.Errorf("scheme %q: wrong server urls, expected:%v, actual:%v", test.scheme, test.expected, eureka.serverUrls)
+		}
+	}
+
+	if _, err := NewEurekaWithDns(DnsConfig{Domain: "eureka.example.com", UseSrv: true, Scheme: "ftp", Resolver: resolver}, "gin-demo", 30, false, true); err == nil {
+		t.Fatal("expect an error with an unsupported scheme")
+	}
+}
+
+func TestEureka_RefreshServerUrls(t *testing.T) {
+	server1 := eurekatest.NewServer()
+	defer server1.Close()
+	server2 := eurekatest.NewServer()
+	defer server2.Close()
+	host := func(server *eurekatest.Server) (string, int) {
+		u, _ := url.Parse(server.URL)
+		port, _ := strconv.Atoi(u.Port())
+		return u.Hostname(), port
+	}
+
+	resolver := newFakeResolver()
+	host1, port1 := host(server1)
+	host2, port2 := host(server2)
+	resolver.srv["_eureka._tcp.eureka.example.com"] = []*net.SRV{{Target: host1, Port: uint16(port1)}}
+
+	eureka, err := NewEurekaWithDns(DnsConfig{
+		Domain:          "eureka.example.com",
+		UseSrv:          true,
+		RefreshInterval: time.Minute,
+		Resolver:        resolver,
+	}, "gin-demo", 30, false, true)
+	if err != nil {
+		t.Fatal("failed to resolve: ", err)
+	}
+	clock := newFakeClock()
+	eureka.clock = clock
+	if err := eureka.Start(); err != nil {
+		t.Fatal("eureka start failed: ", err)
+	}
+	defer eureka.Stop()
+
+	resolver.lock.Lock()
+	resolver.srv["_eureka._tcp.eureka.example.com"] = []*net.SRV{{Target: host2, Port: uint16(port2)}}
+	resolver.lock.Unlock()
+
+	// the fetch and refresh tasks are both waiting, advance to the refresh
+	for i := 0; i < 2; i++ {
+		<-clock.delays
+	}
+	clock.Advance(time.Minute)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for eureka.currentServer() != server2.ServiceUrl() {
+		if time.Now().After(deadline) {
+			t.Fatalf("server urls not refreshed, current server:%s", eureka.currentServer())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -3,12 +3,12 @@ package springcloud
 import (
 	"compress/gzip"
 	"context"
-	"gin-demo/pkg/util/jsonlib"
 	"github.com/pkg/errors"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -18,23 +18,71 @@ type ApplicationType map[string][]ApplicationInstanceDto
 
 const (
 	StatusUp               = "UP"
+	StatusDown             = "DOWN"
+	StatusStarting         = "STARTING"
+	StatusOutOfService     = "OUT_OF_SERVICE"
+	StatusUnknown          = "UNKNOWN"
 	maxRetryTimesIfFailure = 2
 )
 
 type Eureka struct {
 	serverUrls                   []string
 	currentServerUrlIndex        int
+	localServers                 int // the first servers are in the local zone, see NewEurekaWithZones
+	dns                          *DnsConfig
 	ApplicationName              string
 	registryFetchIntervalSeconds int
 	RegisterWithEureka           bool
 	PreferIpAddress              bool
-	Applications                 ApplicationType
-	metaData                     map[string]string
-	httpClient                   *http.Client
-	rwLock                       *sync.RWMutex
-	stop                         chan bool
-	registryFetchTimer           *time.Timer
-	updateSubscriber             func(applications ApplicationType)
+	DisableDelta                 bool
+	// SnapshotFile keeps the last fetched registry, Start falls back to it when no server is reachable
+	SnapshotFile string
+	// SnapshotMaxAge is how old a snapshot may be to be used, 0 for any age
+	SnapshotMaxAge   time.Duration
+	snapshotHashCode string    // apps__hashcode of the last saved snapshot
+	snapshotSavedAt  time.Time // when the last snapshot was saved
+	stale            bool
+	// FormatJson or FormatXml, both are accepted and the server decides when left empty
+	WireFormat       string
+	negotiatedFormat string
+	// the fetch and heartbeat delays grow up to this multiple of their interval while eureka is unreachable
+	ExponentialBackOffBound int
+	Applications            ApplicationType
+	metaData                map[string]string
+	httpClient              *http.Client
+	bearerToken             string
+	rwLock                  *sync.RWMutex
+	clock                   clock
+	random                  func() float64
+	cancelTasks             context.CancelFunc
+	tasks                   *sync.WaitGroup
+	started                 bool
+	stopOnce                *sync.Once
+	done                    chan struct{}
+	subscribers             map[int]func(event RegistryEvent)
+	nextSubscriberId        int
+	subscriberLock          *sync.Mutex
+	published               ApplicationType // what the subscribers have been told about
+	publishLock             *sync.Mutex
+	lastFetchTime           time.Time
+	healthCheckHandler      HealthCheckHandler
+	instanceFilter          InstanceFilter
+
+	// instance settings used for registration, adjust them before Start
+	Region                           string // registered as the "region" metadata
+	Zone                             string // registered as the "zone" metadata
+	HostName                         string
+	IpAddr                           string
+	Port                             int
+	HomePageUrl                      string
+	StatusPageUrl                    string
+	HealthCheckUrl                   string
+	LeaseRenewalIntervalInSeconds    int
+	LeaseExpirationDurationInSeconds int
+	instanceStatus                   string
+	statusOverride                   string // set with SetStatusOverride, empty once cleared
+	lastDirtyTimestamp               int64
+	registered                       bool
 }
 
 type (
@@ -43,29 +91,60 @@ type (
 	}
 
 	applicationsDto struct {
-		VersionsDelta string           `json:"versions__delta"`
-		AppsHashcode  string           `json:"apps__hashcode"`
-		Application   []applicationDto `json:"application"`
+		VersionsDelta string           `json:"versions__delta" xml:"versions__delta"`
+		AppsHashcode  string           `json:"apps__hashcode" xml:"apps__hashcode"`
+		Application   []applicationDto `json:"application" xml:"application"`
 	}
 
 	applicationDto struct {
-		Name     string                   `json:"name"`
-		Instance []ApplicationInstanceDto `json:"instance"`
+		Name     string                   `json:"name" xml:"name"`
+		Instance []ApplicationInstanceDto `json:"instance" xml:"instance"`
 	}
 
 	PortDto struct {
-		Value   int    `json:"$"`
-		Enabled string `json:"@enabled"` // true|false
+		Value   int    `json:"$" xml:",chardata"`
+		Enabled string `json:"@enabled" xml:"enabled,attr"` // true|false
+	}
+
+	DataCenterInfoDto struct {
+		Class    string      `json:"@class" xml:"class,attr"`
+		Name     string      `json:"name" xml:"name"`                             // MyOwn|Amazon
+		Metadata MetadataMap `json:"metadata,omitempty" xml:"metadata,omitempty"` // only for Amazon, e.g. availability-zone
+	}
+
+	// timestamps are milliseconds since the epoch
+	LeaseInfoDto struct {
+		RenewalIntervalInSecs int   `json:"renewalIntervalInSecs" xml:"renewalIntervalInSecs"`
+		DurationInSecs        int   `json:"durationInSecs" xml:"durationInSecs"`
+		RegistrationTimestamp int64 `json:"registrationTimestamp,omitempty" xml:"registrationTimestamp,omitempty"`
+		LastRenewalTimestamp  int64 `json:"lastRenewalTimestamp,omitempty" xml:"lastRenewalTimestamp,omitempty"`
+		EvictionTimestamp     int64 `json:"evictionTimestamp,omitempty" xml:"evictionTimestamp,omitempty"`
+		ServiceUpTimestamp    int64 `json:"serviceUpTimestamp,omitempty" xml:"serviceUpTimestamp,omitempty"`
 	}
 
 	ApplicationInstanceDto struct {
-		InstanceId       string  `json:"instanceId,omitempty"`
-		HostName         string  `json:"hostName"`
-		App              string  `json:"app"`
-		IpAddr           string  `json:"ipAddr"`
-		Port             PortDto `json:"port"`
-		Status           string  `json:"status"`
-		Overriddenstatus string  `json:"overriddenstatus"`
+		InstanceId       string            `json:"instanceId,omitempty" xml:"instanceId,omitempty"`
+		HostName         string            `json:"hostName" xml:"hostName"`
+		App              string            `json:"app" xml:"app"`
+		IpAddr           string            `json:"ipAddr" xml:"ipAddr"`
+		Status           string            `json:"status" xml:"status"`
+		Overriddenstatus string            `json:"overriddenstatus" xml:"overriddenstatus"`
+		Port             PortDto           `json:"port" xml:"port"`
+		SecurePort       PortDto           `json:"securePort" xml:"securePort"`
+		CountryId        int               `json:"countryId,omitempty" xml:"countryId,omitempty"`
+		DataCenterInfo   DataCenterInfoDto `json:"dataCenterInfo" xml:"dataCenterInfo"`
+		LeaseInfo        *LeaseInfoDto     `json:"leaseInfo,omitempty" xml:"leaseInfo,omitempty"`
+		Metadata         MetadataMap       `json:"metadata,omitempty" xml:"metadata,omitempty"`
+		HomePageUrl      string            `json:"homePageUrl,omitempty" xml:"homePageUrl,omitempty"`
+		StatusPageUrl    string            `json:"statusPageUrl,omitempty" xml:"statusPageUrl,omitempty"`
+		HealthCheckUrl   string            `json:"healthCheckUrl,omitempty" xml:"healthCheckUrl,omitempty"`
+		VipAddress       string            `json:"vipAddress,omitempty" xml:"vipAddress,omitempty"`
+		SecureVipAddress string            `json:"secureVipAddress,omitempty" xml:"secureVipAddress,omitempty"`
+		// eureka sends these as strings in json
+		IsCoordinatingDiscoveryServer bool   `json:"isCoordinatingDiscoveryServer,string,omitempty" xml:"isCoordinatingDiscoveryServer,omitempty"`
+		LastUpdatedTimestamp          int64  `json:"lastUpdatedTimestamp,string,omitempty" xml:"lastUpdatedTimestamp,omitempty"`
+		LastDirtyTimestamp            int64  `json:"lastDirtyTimestamp,string,omitempty" xml:"lastDirtyTimestamp,omitempty"`
+		ActionType                    string `json:"actionType,omitempty" xml:"actionType,omitempty"` // ADDED|MODIFIED|DELETED, only set in deltas
 	}
 )
 
@@ -111,69 +190,197 @@ func NewEureka(serverUrl string, applicationName string, registryFetchIntervalSe
 		// Timeout: 10 * time.Second,
 	}
 
+	hostName, err := os.Hostname()
+	if err != nil {
+		hostName = "localhost"
+	}
+
 	e := &Eureka{
-		serverUrls:                   serverUrls,
-		currentServerUrlIndex:        0,
-		ApplicationName:              applicationName,
-		registryFetchIntervalSeconds: registryFetchIntervalSeconds,
-		RegisterWithEureka:           registerWithEureka,
-		PreferIpAddress:              preferIpAddress,
-		metaData:                     map[string]string{},
-		httpClient:                   httpClient,
-		rwLock:                       new(sync.RWMutex),
-		stop:                         make(chan bool),
+		serverUrls:                       serverUrls,
+		currentServerUrlIndex:            0,
+		ApplicationName:                  applicationName,
+		registryFetchIntervalSeconds:     registryFetchIntervalSeconds,
+		RegisterWithEureka:               registerWithEureka,
+		PreferIpAddress:                  preferIpAddress,
+		metaData:                         map[string]string{},
+		httpClient:                       httpClient,
+		rwLock:                           new(sync.RWMutex),
+		clock:                            realClock{},
+		random:                           defaultRandom,
+		tasks:                            new(sync.WaitGroup),
+		stopOnce:                         new(sync.Once),
+		done:                             make(chan struct{}),
+		subscribers:                      map[int]func(event RegistryEvent){},
+		subscriberLock:                   new(sync.Mutex),
+		publishLock:                      new(sync.Mutex),
+		ExponentialBackOffBound:          10,
+		instanceFilter:                   DefaultInstanceFilter(),
+		HostName:                         hostName,
+		IpAddr:                           localIpAddr(),
+		Port:                             8080,
+		LeaseRenewalIntervalInSeconds:    30,
+		LeaseExpirationDurationInSeconds: 90,
+		instanceStatus:                   StatusUp,
 	}
 
 	return e
 }
 
 func (e *Eureka) Start() error {
-	if _, err := e.GetApplications(); err != nil {
+	e.rwLock.Lock()
+	if e.started {
+		e.rwLock.Unlock()
+		return errors.New("eureka client already started")
+	}
+	select {
+	case <-e.done:
+		e.rwLock.Unlock()
+		return errors.New("eureka client already stopped")
+	default:
+	}
+	e.started = true
+	e.rwLock.Unlock()
+
+	if err := e.initialize(); err != nil {
+		e.rwLock.Lock()
+		e.started = false
+		e.rwLock.Unlock()
 		return err
 	}
 
-	e.registryFetchTimer = time.NewTimer(time.Second)
-	go func() {
-		for {
-			select {
-			case <-e.stop:
-				return
-			case <-e.registryFetchTimer.C:
-				_, _ = e.GetApplications()
-				e.registryFetchTimer.Reset(time.Duration(e.registryFetchIntervalSeconds) * time.Second)
-			default:
-
-			}
+	ctx, cancel := context.WithCancel(context.Background())
+	e.rwLock.Lock()
+	defer e.rwLock.Unlock()
+	select {
+	case <-e.done:
+		cancel()
+		return errors.New("eureka client stopped while starting")
+	default:
+	}
+	e.cancelTasks = cancel
+
+	e.runTask(ctx, time.Duration(e.registryFetchIntervalSeconds)*time.Second, func() error {
+		_, err := e.GetApplications()
+		return err
+	})
+	if e.RegisterWithEureka {
+		e.runTask(ctx, time.Duration(e.LeaseRenewalIntervalInSeconds)*time.Second, e.heartbeat)
+	}
+	if e.dns != nil {
+		e.runTask(ctx, e.dns.RefreshInterval, e.refreshServerUrls)
+	}
+
+	return nil
+}
+
+// initialize fetches the registry and registers the instance before the tasks take over
+func (e *Eureka) initialize() error {
+	if _, err := e.GetApplications(); err != nil {
+		if e.SnapshotFile == "" {
+			return err
 		}
-	}()
+		// start with the last known registry, the tasks fetch and register once a server answers
+		if snapshotErr := e.loadSnapshot(); snapshotErr != nil {
+			return errors.Errorf("%s, no snapshot to start from:%s", err, snapshotErr)
+		}
+		return nil
+	}
+
+	if e.RegisterWithEureka {
+		if err := e.register(); err != nil {
+			return err
+		}
+		e.rwLock.Lock()
+		e.registered = true
+		e.rwLock.Unlock()
+	}
 
 	return nil
 }
 
+func (e *Eureka) runTask(ctx context.Context, interval time.Duration, task func() error) {
+	scheduled := &timedTask{
+		interval:     interval,
+		backoffBound: e.ExponentialBackOffBound,
+		task:         task,
+		clock:        e.clock,
+		random:       e.random,
+	}
+
+	e.tasks.Add(1)
+	go func() {
+		defer e.tasks.Done()
+		scheduled.run(ctx)
+	}()
+}
+
+// Stop ends the fetch and heartbeat loops and removes the instance from eureka if it was registered.
+// It may be called more than once, and before Start
 func (e *Eureka) Stop() {
-	e.stop <- true
-	if e.registryFetchTimer != nil {
-		if !e.registryFetchTimer.Stop() {
-			_, _ = <-e.registryFetchTimer.C
+	e.stopOnce.Do(func() {
+		e.rwLock.Lock()
+		cancel := e.cancelTasks
+		e.rwLock.Unlock()
+
+		if cancel != nil {
+			cancel()
 		}
+		e.tasks.Wait()
+		_ = e.cancel()
+		close(e.done)
+	})
+}
+
+// Done is closed once the client has been stopped and deregistered
+func (e *Eureka) Done() <-chan struct{} {
+	return e.done
+}
+
+// Wait blocks until the client has been stopped
+func (e *Eureka) Wait() {
+	<-e.done
+}
+
+// Status returns the status reported to eureka for this instance
+func (e *Eureka) Status() string {
+	e.rwLock.RLock()
+	defer e.rwLock.RUnlock()
+	return e.instanceStatus
+}
+
+// SetStatus changes the status reported to eureka, a registered instance is updated right away
+// instead of waiting for the next heartbeat
+func (e *Eureka) SetStatus(status string) error {
+	e.rwLock.Lock()
+	changed := e.instanceStatus != status
+	e.instanceStatus = status
+	registered := e.registered
+	e.rwLock.Unlock()
+
+	if !changed || !registered {
+		return nil
 	}
+	return e.register()
 }
 
 func (e *Eureka) AddMetaData(key, value string) {
+	e.rwLock.Lock()
+	defer e.rwLock.Unlock()
 	e.metaData[key] = value
 }
 
 func (e *Eureka) GetApplications() (ApplicationType, error) {
-	applications, err := e.doGetApplications(e.currentServer())
+	e.preferLocalZone()
+	applications, err := e.fetchRegistry(e.currentServer())
 	if err == nil {
-		e.tryNotifySubscriber(applications)
+		e.fetched(applications)
 		return applications, nil
 	}
 
 	// retry
-	for i := 0; i < maxRetryTimesIfFailure; i++ {
-		if applications, err := e.doGetApplications(e.nextServer()); err == nil {
-			e.tryNotifySubscriber(applications)
+	for i := 0; i < e.maxRetries(); i++ {
+		if applications, err := e.fetchRegistry(e.nextServer()); err == nil {
+			e.fetched(applications)
 			return applications, nil
 		}
 	}
@@ -181,6 +388,35 @@ func (e *Eureka) GetApplications() (ApplicationType, error) {
 	return nil, errors.New("no available server")
 }
 
+// fetched records a successful fetch, tells the subscribers about it and saves the snapshot
+func (e *Eureka) fetched(applications ApplicationType) {
+	e.rwLock.Lock()
+	e.lastFetchTime = time.Now()
+	e.stale = false
+	e.rwLock.Unlock()
+
+	e.publish(applications)
+
+	if e.SnapshotFile != "" {
+		registryStale.WithLabelValues(e.SnapshotFile).Set(0)
+		e.saveSnapshotIfChanged(applications)
+	}
+}
+
+// LastFetchTime is when the registry was last fetched successfully, zero if it never was
+func (e *Eureka) LastFetchTime() time.Time {
+	e.rwLock.RLock()
+	defer e.rwLock.RUnlock()
+	return e.lastFetchTime
+}
+
+// CachedApplications is the registry as of the last fetch, or from the snapshot, without fetching it
+func (e *Eureka) CachedApplications() ApplicationType {
+	e.rwLock.RLock()
+	defer e.rwLock.RUnlock()
+	return e.Applications
+}
+
 func (e *Eureka) GetApplication(applicationName string) ([]ApplicationInstanceDto, bool) {
 	e.rwLock.RLock()
 	defer e.rwLock.RUnlock()
@@ -189,12 +425,9 @@ func (e *Eureka) GetApplication(applicationName string) ([]ApplicationInstanceDt
 		if !strings.EqualFold(appName, applicationName) {
 			continue
 		}
-		applications := make([]ApplicationInstanceDto, 0, len(instanceDtos))
-		for _, instanceDto := range instanceDtos {
-			if strings.EqualFold(instanceDto.App, applicationName) && instanceDto.Status == StatusUp {
-				applications = append(applications, instanceDto)
-			}
-		}
+		applications := e.instanceFilter.Filter(filterInstances(instanceDtos, func(instance *ApplicationInstanceDto) bool {
+			return strings.EqualFold(instance.App, applicationName)
+		}))
 		if len(applications) == 0 {
 			return nil, false
 		}
@@ -205,22 +438,18 @@ func (e *Eureka) GetApplication(applicationName string) ([]ApplicationInstanceDt
 }
 
 func (e *Eureka) currentServer() string {
-	if len(e.serverUrls) == 1 {
-		return e.serverUrls[0]
-	}
-
 	e.rwLock.RLock()
 	defer e.rwLock.RUnlock()
 	return e.serverUrls[e.currentServerUrlIndex]
 }
 
 func (e *Eureka) nextServer() string {
+	e.rwLock.Lock()
+	defer e.rwLock.Unlock()
 	if len(e.serverUrls) == 1 {
 		return e.serverUrls[0]
 	}
 
-	e.rwLock.Lock()
-	defer e.rwLock.Unlock()
 	if e.currentServerUrlIndex == len(e.serverUrls)-1 {
 		e.currentServerUrlIndex = 0
 	} else {
@@ -231,22 +460,48 @@ func (e *Eureka) nextServer() string {
 }
 
 func (e *Eureka) doGetApplications(baseUrl string) (ApplicationType, error) {
+	applicationsDto, err := e.doFetch(baseUrl + "apps/")
+	if err != nil {
+		return nil, err
+	}
+
+	applications := make(ApplicationType)
+	for _, app := range applicationsDto.Application {
+		applications[app.Name] = app.Instance
+	}
+
+	e.rwLock.Lock()
+	e.Applications = applications
+	e.rwLock.Unlock()
+
+	return applications, nil
+}
+
+func (e *Eureka) client() *http.Client {
+	e.rwLock.RLock()
+	defer e.rwLock.RUnlock()
+	return e.httpClient
+}
+
+func (e *Eureka) doFetch(url string) (*applicationsDto, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	request, err := http.NewRequestWithContext(ctx, "GET", baseUrl+"apps/", nil)
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
-	request.Header.Add("Accept", "application/json")
+	e.authorize(request)
+	request.Header.Add("Accept", e.acceptHeader())
 	request.Header.Add("Accept-Encoding", "gzip")
 	request.Header.Add("Connection", "Keep-Alive")
-	response, err := e.httpClient.Do(request)
+	response, err := e.client().Do(request)
 	if err != nil {
 		return nil, err
 	}
 
 	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
 		return nil, errors.Errorf("server response code:%d", response.StatusCode)
 	}
 
@@ -267,31 +522,20 @@ func (e *Eureka) doGetApplications(baseUrl string) (ApplicationType, error) {
 	}
 	defer reader.Close()
 
-	var application Application
 	bodyBytes, err := ioutil.ReadAll(reader)
 	if err != nil {
 		return nil, errors.Errorf("error while reading body:%s", err.Error())
 	}
 
-	err = jsonlib.Unmarshal(bodyBytes, &application)
+	format := formatOf(response.Header.Get("Content-Type"))
+	applications, err := decodeApplications(format, bodyBytes)
 	if err != nil {
 		return nil, errors.Errorf("error while unmarshalling body:%s", err.Error())
 	}
 
-	applications := make(ApplicationType)
-	for _, app := range application.Applications.Application {
-		applications[app.Name] = app.Instance
-	}
-
 	e.rwLock.Lock()
-	e.Applications = applications
+	e.negotiatedFormat = format
 	e.rwLock.Unlock()
 
-	return e.Applications, nil
-}
-
-func (e *Eureka) tryNotifySubscriber(applications ApplicationType) {
-	if e.updateSubscriber != nil {
-		e.updateSubscriber(applications)
-	}
+	return applications, nil
 }
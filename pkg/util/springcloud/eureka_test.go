@@ -2,16 +2,33 @@ package springcloud
 
 import (
 	"fmt"
+	"gin-demo/pkg/util/springcloud/eurekatest"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
 	"time"
 )
 
+func countRequests(server *eurekatest.Server, request string) int {
+	count := 0
+	for _, r := range server.Requests() {
+		if r == request {
+			count++
+		}
+	}
+	return count
+}
+
 func TestGetApplications(t *testing.T) {
-	eureka := NewEureka("http://localhost:1111/eureka/", "gin-demo", 30, true, true)
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-1", "10.0.0.1", 8080))
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-2", "10.0.0.2", 8080))
+
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, true, true)
 	err := eureka.Start()
 	if err != nil {
 		t.Fatal("eureka start failed: ", err)
@@ -22,8 +39,12 @@ func TestGetApplications(t *testing.T) {
 	if err != nil {
 		t.Fatal("failed to get applications: ", err)
 	}
-	if len(applications) == 0 {
-		t.Fatal("no applications found")
+	// demo-v1 and ourselves
+	if len(applications) != 2 {
+		t.Fatalf("wrong application count, expected:%d, actual:%d", 2, len(applications))
+	}
+	if len(applications["DEMO-V1"]) != 2 {
+		t.Fatalf("wrong instance count, expected:%d, actual:%d", 2, len(applications["DEMO-V1"]))
 	}
 
 	for appId, app := range applications {
@@ -37,7 +58,12 @@ func TestGetApplications(t *testing.T) {
 }
 
 func TestCurrentServer(t *testing.T) {
-	eureka := NewEureka("http://localhost:1111/eureka/,http://localhost:1112/eureka/", "gin-demo", 30, true, true)
+	server1 := eurekatest.NewServer()
+	defer server1.Close()
+	server2 := eurekatest.NewServer()
+	defer server2.Close()
+
+	eureka := NewEureka(server1.ServiceUrl()+","+server2.ServiceUrl(), "gin-demo", 30, true, true)
 	err := eureka.Start()
 	if err != nil {
 		t.Fatal("eureka start failed:", err)
@@ -45,23 +71,37 @@ func TestCurrentServer(t *testing.T) {
 	defer eureka.Stop()
 
 	currentServer := eureka.currentServer()
-	if currentServer != "http://localhost:1111/eureka/" {
-		t.Fatalf("wrong current server, expected:%s, actual:%s", "http://localhost:1111/eureka/", currentServer)
+	if currentServer != server1.ServiceUrl() {
+		t.Fatalf("wrong current server, expected:%s, actual:%s", server1.ServiceUrl(), currentServer)
 	}
 
 	nextServer := eureka.nextServer()
-	if nextServer != "http://localhost:1112/eureka/" {
-		t.Fatalf("wrong next server, expected:%s, actual:%s", "http://localhost:1112/eureka/", nextServer)
+	if nextServer != server2.ServiceUrl() {
+		t.Fatalf("wrong next server, expected:%s, actual:%s", server2.ServiceUrl(), nextServer)
 	}
 
 	currentServer = eureka.currentServer()
-	if currentServer != "http://localhost:1112/eureka/" {
-		t.Fatalf("wrong current server, expected:%s, actual:%s", "http://localhost:1112/eureka/", currentServer)
+	if currentServer != server2.ServiceUrl() {
+		t.Fatalf("wrong current server, expected:%s, actual:%s", server2.ServiceUrl(), currentServer)
 	}
 }
 
 func TestEureka_GetApplication(t *testing.T) {
-	eureka := NewEureka("http://localhost:1112/eureka/,http://localhost:1111/eureka/,http://localhost:1113/eureka/", "gin-demo", 5, true, true)
+	// the first server is broken, the client has to move on to the next one
+	server1 := eurekatest.NewServer()
+	defer server1.Close()
+	server1.InjectFault(eurekatest.Fault{StatusCode: http.StatusServiceUnavailable})
+	server2 := eurekatest.NewServer()
+	defer server2.Close()
+	server3 := eurekatest.NewServer()
+	defer server3.Close()
+
+	zuul := eurekatest.NewInstance("gateway-zuul", "gateway-zuul-1", "10.0.0.1", 8765)
+	zuul.Status = StatusDown
+	server2.Register(zuul)
+	server2.Register(eurekatest.NewInstance("demo-v1", "demo-v1-1", "10.0.0.2", 8080))
+
+	eureka := NewEureka(server1.ServiceUrl()+","+server2.ServiceUrl()+","+server3.ServiceUrl(), "gin-demo", 5, true, true)
 	err := eureka.Start()
 	if err != nil {
 		t.Fatal("eureka start failed", err)
@@ -69,27 +109,50 @@ func TestEureka_GetApplication(t *testing.T) {
 	defer eureka.Stop()
 
 	applicationName := "gateway-zuul"
-	applications, exist := eureka.GetApplication(applicationName)
-	if !exist {
-		t.Log("application not exist: ", applicationName)
-	} else {
-		for _, application := range applications {
-			t.Log("instanceId:", application.InstanceId)
-		}
+	if _, exist := eureka.GetApplication(applicationName); exist {
+		t.Fatal("application without UP instances should not exist: ", applicationName)
 	}
 
 	applicationName = "demo-v1"
-	applications, exist = eureka.GetApplication(applicationName)
+	applications, exist := eureka.GetApplication(applicationName)
 	if !exist {
-		t.Log("application not exist: ", applicationName)
-	} else {
-		for _, application := range applications {
-			t.Log("instanceId:", application.InstanceId)
-		}
+		t.Fatal("application not exist: ", applicationName)
+	}
+	for _, application := range applications {
+		t.Log("instanceId:", application.InstanceId)
+	}
+}
+
+func TestEureka_Failover(t *testing.T) {
+	server1 := eurekatest.NewServer()
+	defer server1.Close()
+	server1.InjectFault(eurekatest.Fault{DropConnection: true})
+	server2 := eurekatest.NewServer()
+	defer server2.Close()
+	server2.InjectFault(eurekatest.Fault{Delay: 100 * time.Millisecond, Count: 1})
+	server2.SetGzip(false)
+	server2.Register(eurekatest.NewInstance("demo-v1", "demo-v1-1", "10.0.0.1", 8080))
+
+	eureka := NewEureka(server1.ServiceUrl()+","+server2.ServiceUrl(), "gin-demo", 30, false, true)
+	applications, err := eureka.GetApplications()
+	if err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+	if len(applications["DEMO-V1"]) != 1 {
+		t.Fatalf("wrong instance count, expected:%d, actual:%d", 1, len(applications["DEMO-V1"]))
+	}
+	if eureka.currentServer() != server2.ServiceUrl() {
+		t.Fatalf("wrong current server, expected:%s, actual:%s", server2.ServiceUrl(), eureka.currentServer())
 	}
 }
 
 func TestHttpClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte(`{"status":"UP"}`))
+	}))
+	defer server.Close()
+
 	httpClient := &http.Client{
 		Transport: &http.Transport{
 			DialContext: (&net.Dialer{
@@ -122,14 +185,15 @@ func TestHttpClient(t *testing.T) {
 			defer waitGroup.Done()
 			fmt.Println("begin request: ", index)
 
-			response, err := httpClient.Get("http://localhost:8765/health")
+			response, err := httpClient.Get(server.URL + "/health")
 			if err != nil {
-				fmt.Println("request: ", index, " failed with: ", err)
+				t.Error("request: ", index, " failed with: ", err)
 				return
 			}
+			defer response.Body.Close()
 			bodyBytes, err := ioutil.ReadAll(response.Body)
 			if err != nil {
-				fmt.Println("request: ", index, ", failed with: ", err)
+				t.Error("request: ", index, ", failed with: ", err)
 				return
 			}
 
@@ -139,3 +203,205 @@ func TestHttpClient(t *testing.T) {
 
 	waitGroup.Wait()
 }
+
+func TestEureka_RegisterAndRenew(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, true, true)
+	eureka.HostName = "demo-host"
+	eureka.IpAddr = "10.0.0.1"
+	eureka.Port = 8081
+	eureka.AddMetaData("version", "1")
+	if err := eureka.Start(); err != nil {
+		t.Fatal("eureka start failed: ", err)
+	}
+	defer eureka.Stop()
+
+	instance, exist := server.Instance("gin-demo", "demo-host:gin-demo:8081")
+	if !exist {
+		t.Fatal("instance not registered")
+	}
+	if instance.HostName != "10.0.0.1" {
+		t.Fatalf("wrong hostName, expected:%s, actual:%s", "10.0.0.1", instance.HostName)
+	}
+	if instance.HealthCheckUrl != "http://10.0.0.1:8081/health" {
+		t.Fatalf("wrong healthCheckUrl, expected:%s, actual:%s", "http://10.0.0.1:8081/health", instance.HealthCheckUrl)
+	}
+	if instance.StatusPageUrl != "http://10.0.0.1:8081/health" {
+		t.Fatalf("wrong statusPageUrl, expected:%s, actual:%s", "http://10.0.0.1:8081/health", instance.StatusPageUrl)
+	}
+	if instance.Metadata["version"] != "1" {
+		t.Fatalf("wrong metadata, expected:%s, actual:%s", "1", instance.Metadata["version"])
+	}
+
+	if err := eureka.renew(); err != nil {
+		t.Fatal("renew failed: ", err)
+	}
+	if count := countRequests(server, "POST /eureka/apps/GIN-DEMO"); count != 1 {
+		t.Fatalf("unexpected registration, register count:%d", count)
+	}
+
+	// the lease expired on the server, the next heartbeat registers again
+	server.Evict("gin-demo", "demo-host:gin-demo:8081")
+	if err := eureka.renew(); err != nil {
+		t.Fatal("renew failed: ", err)
+	}
+	if count := countRequests(server, "POST /eureka/apps/GIN-DEMO"); count != 2 {
+		t.Fatalf("instance not registered again, register count:%d", count)
+	}
+	if _, exist := server.Instance("gin-demo", "demo-host:gin-demo:8081"); !exist {
+		t.Fatal("instance not registered again")
+	}
+}
+
+func TestEureka_Deregister(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, true, true)
+	eureka.HostName = "demo-host"
+	if err := eureka.Start(); err != nil {
+		t.Fatal("eureka start failed: ", err)
+	}
+	if err := eureka.SetStatus(StatusOutOfService); err != nil {
+		t.Fatal("failed to set status: ", err)
+	}
+
+	instance, _ := server.Instance("gin-demo", "demo-host:gin-demo:8080")
+	if instance.Status != StatusOutOfService {
+		t.Fatalf("wrong status, expected:%s, actual:%s", StatusOutOfService, instance.Status)
+	}
+
+	eureka.Stop()
+	if _, exist := server.Instance("gin-demo", "demo-host:gin-demo:8080"); exist {
+		t.Fatal("instance not deregistered")
+	}
+	if count := countRequests(server, "DELETE /eureka/apps/GIN-DEMO/demo-host:gin-demo:8080"); count != 1 {
+		t.Fatalf("wrong cancel count, expected:%d, actual:%d", 1, count)
+	}
+}
+
+func TestEureka_StopBeforeStart(t *testing.T) {
+	eureka := NewEureka("http://localhost:1111/eureka/", "gin-demo", 30, true, true)
+	eureka.Stop()
+	eureka.Stop()
+
+	select {
+	case <-eureka.Done():
+	default:
+		t.Fatal("done not closed after stop")
+	}
+	if err := eureka.Start(); err == nil {
+		t.Fatal("a stopped client should not start")
+	}
+}
+
+func TestEureka_RefreshLoop(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+
+	clock := newFakeClock()
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, false, true)
+	eureka.DisableDelta = true
+	eureka.clock = clock
+	if err := eureka.Start(); err != nil {
+		t.Fatal("eureka start failed: ", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		delay := <-clock.delays
+		if delay != 30*time.Second {
+			t.Fatalf("wrong delay, expected:%s, actual:%s", 30*time.Second, delay)
+		}
+		if count := countRequests(server, "GET /eureka/apps/"); count != i {
+			t.Fatalf("wrong fetch count, expected:%d, actual:%d", i, count)
+		}
+		clock.Advance(delay)
+	}
+
+	eureka.Stop()
+	eureka.Stop()
+	eureka.Wait()
+}
+
+func TestEureka_StatusOverride(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, true, true)
+	eureka.HostName = "demo-host"
+	if err := eureka.SetStatusOverride(StatusOutOfService); err == nil {
+		t.Fatal("an unregistered instance has no status to override")
+	}
+	if err := eureka.Start(); err != nil {
+		t.Fatal("eureka start failed: ", err)
+	}
+	defer eureka.Stop()
+
+	if err := eureka.SetStatusOverride(StatusOutOfService); err != nil {
+		t.Fatal("failed to override status: ", err)
+	}
+	// heartbeats and registrations do not undo an override
+	if err := eureka.renew(); err != nil {
+		t.Fatal("renew failed: ", err)
+	}
+	if err := eureka.register(); err != nil {
+		t.Fatal("register failed: ", err)
+	}
+	instance, _ := server.Instance("gin-demo", "demo-host:gin-demo:8080")
+	if instance.Status != StatusOutOfService || instance.OverriddenStatus != StatusOutOfService {
+		t.Fatalf("status not overridden, status:%s, overriddenstatus:%s", instance.Status, instance.OverriddenStatus)
+	}
+	if eureka.StatusOverride() != StatusOutOfService {
+		t.Fatalf("wrong status override, expected:%s, actual:%s", StatusOutOfService, eureka.StatusOverride())
+	}
+
+	if err := eureka.ClearStatusOverride(); err != nil {
+		t.Fatal("failed to clear status override: ", err)
+	}
+	instance, _ = server.Instance("gin-demo", "demo-host:gin-demo:8080")
+	if instance.Status != StatusUp || instance.OverriddenStatus != StatusUnknown {
+		t.Fatalf("status override not cleared, status:%s, overriddenstatus:%s", instance.Status, instance.OverriddenStatus)
+	}
+	if eureka.StatusOverride() != "" {
+		t.Fatalf("status override not cleared, actual:%s", eureka.StatusOverride())
+	}
+}
+
+type statusFunc func(currentStatus string) string
+
+func (f statusFunc) GetStatus(currentStatus string) string {
+	return f(currentStatus)
+}
+
+func TestEureka_HealthCheckHandler(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, true, true)
+	eureka.HostName = "demo-host"
+	if err := eureka.Start(); err != nil {
+		t.Fatal("eureka start failed: ", err)
+	}
+	defer eureka.Stop()
+
+	healthy := false
+	eureka.SetHealthCheckHandler(statusFunc(func(currentStatus string) string {
+		if healthy {
+			return StatusUp
+		}
+		return StatusDown
+	}))
+
+	for _, want := range []string{StatusDown, StatusUp} {
+		if err := eureka.heartbeat(); err != nil {
+			t.Fatal("heartbeat failed: ", err)
+		}
+		instance, _ := server.Instance("gin-demo", "demo-host:gin-demo:8080")
+		if eureka.Status() != want || instance.Status != want {
+			t.Fatalf("expect status %s, local:%s, registered:%s", want, eureka.Status(), instance.Status)
+		}
+		healthy = true
+	}
+}
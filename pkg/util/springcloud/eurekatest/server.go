@@ -0,0 +1,650 @@
+// Package eurekatest provides an in-process eureka server for tests and local development.
+//
+// It speaks the subset of the eureka REST API used by springcloud.Eureka: register, renew,
+// cancel, full and delta fetch and status overrides, in JSON or XML, and can be told to misbehave.
+package eurekatest
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"gin-demo/pkg/util/jsonlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	actionAdded    = "ADDED"
+	actionModified = "MODIFIED"
+	actionDeleted  = "DELETED"
+	statusUp       = "UP"
+	statusUnknown  = "UNKNOWN"
+)
+
+type (
+	Port struct {
+		Value   int    `json:"$" xml:",chardata"`
+		Enabled string `json:"@enabled" xml:"enabled,attr"`
+	}
+
+	DataCenterInfo struct {
+		Class string `json:"@class" xml:"class,attr"`
+		Name  string `json:"name" xml:"name"`
+	}
+
+	LeaseInfo struct {
+		RenewalIntervalInSecs int   `json:"renewalIntervalInSecs" xml:"renewalIntervalInSecs"`
+		DurationInSecs        int   `json:"durationInSecs" xml:"durationInSecs"`
+		RegistrationTimestamp int64 `json:"registrationTimestamp" xml:"registrationTimestamp"`
+		LastRenewalTimestamp  int64 `json:"lastRenewalTimestamp" xml:"lastRenewalTimestamp"`
+		EvictionTimestamp     int64 `json:"evictionTimestamp" xml:"evictionTimestamp"`
+		ServiceUpTimestamp    int64 `json:"serviceUpTimestamp" xml:"serviceUpTimestamp"`
+	}
+
+	// Instance is an instance as the server stores and returns it
+	Instance struct {
+		InstanceId                    string         `json:"instanceId" xml:"instanceId"`
+		HostName                      string         `json:"hostName" xml:"hostName"`
+		App                           string         `json:"app" xml:"app"`
+		IpAddr                        string         `json:"ipAddr" xml:"ipAddr"`
+		Status                        string         `json:"status" xml:"status"`
+		OverriddenStatus              string         `json:"overriddenstatus" xml:"overriddenstatus"`
+		Port                          Port           `json:"port" xml:"port"`
+		SecurePort                    Port           `json:"securePort" xml:"securePort"`
+		CountryId                     int            `json:"countryId" xml:"countryId"`
+		DataCenterInfo                DataCenterInfo `json:"dataCenterInfo" xml:"dataCenterInfo"`
+		LeaseInfo                     LeaseInfo      `json:"leaseInfo" xml:"leaseInfo"`
+		Metadata                      MetadataMap    `json:"metadata,omitempty" xml:"metadata,omitempty"`
+		HomePageUrl                   string         `json:"homePageUrl,omitempty" xml:"homePageUrl,omitempty"`
+		StatusPageUrl                 string         `json:"statusPageUrl,omitempty" xml:"statusPageUrl,omitempty"`
+		HealthCheckUrl                string         `json:"healthCheckUrl,omitempty" xml:"healthCheckUrl,omitempty"`
+		VipAddress                    string         `json:"vipAddress,omitempty" xml:"vipAddress,omitempty"`
+		SecureVipAddress              string         `json:"secureVipAddress,omitempty" xml:"secureVipAddress,omitempty"`
+		IsCoordinatingDiscoveryServer string         `json:"isCoordinatingDiscoveryServer" xml:"isCoordinatingDiscoveryServer"`
+		LastUpdatedTimestamp          string         `json:"lastUpdatedTimestamp" xml:"lastUpdatedTimestamp"`
+		LastDirtyTimestamp            string         `json:"lastDirtyTimestamp" xml:"lastDirtyTimestamp"`
+		ActionType                    string         `json:"actionType,omitempty" xml:"actionType,omitempty"`
+	}
+
+	application struct {
+		Name     string     `json:"name" xml:"name"`
+		Instance []Instance `json:"instance" xml:"instance"`
+	}
+
+	applications struct {
+		XMLName       xml.Name      `json:"-" xml:"applications"`
+		VersionsDelta string        `json:"versions__delta" xml:"versions__delta"`
+		AppsHashcode  string        `json:"apps__hashcode" xml:"apps__hashcode"`
+		Application   []application `json:"application" xml:"application"`
+	}
+
+	applicationsWrapper struct {
+		Applications applications `json:"applications"`
+	}
+
+	instanceWrapper struct {
+		Instance Instance `json:"instance"`
+	}
+)
+
+// MetadataMap is encoded in XML as one <key>value</key> element per entry
+type MetadataMap map[string]string
+
+func (m MetadataMap) MarshalXML(encoder *xml.Encoder, start xml.StartElement) error {
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := encoder.EncodeElement(m[key], xml.StartElement{Name: xml.Name{Local: key}}); err != nil {
+			return err
+		}
+	}
+
+	return encoder.EncodeToken(start.End())
+}
+
+func (m *MetadataMap) UnmarshalXML(decoder *xml.Decoder, start xml.StartElement) error {
+	metadata := MetadataMap{}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			var value string
+			if err := decoder.DecodeElement(&value, &element); err != nil {
+				return err
+			}
+			metadata[element.Name.Local] = value
+		case xml.EndElement:
+			*m = metadata
+			return nil
+		}
+	}
+}
+
+// Fault makes the server misbehave on the next Count requests, or on all of them if Count is 0.
+// Only requests with the given Method are affected when it is set
+type Fault struct {
+	Method         string
+	StatusCode     int           // answer with this code instead of handling the request
+	Delay          time.Duration // wait before answering
+	DropConnection bool          // close the connection without answering
+	Count          int
+}
+
+type Server struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	apps      map[string][]*Instance
+	overrides map[string]string // instanceId -> status, survives re-registration like in eureka
+	deltas    []Instance        // recently changed instances, with their ActionType
+	version   int
+	faults    []*Fault
+	requests  []string
+	gzip      bool
+	xmlOnly   bool
+	// authorization is the Authorization header every request must carry, if set
+	authorization string
+}
+
+// NewServer starts a server, the caller should Close it when done
+func NewServer() *Server {
+	s := newServer()
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// NewTLSServer starts a server on https with a self-signed certificate, see Certificate.
+// When clientCAs is not nil, the clients must present a certificate signed by one of them
+func NewTLSServer(clientCAs *x509.CertPool) *Server {
+	s := newServer()
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	if clientCAs != nil {
+		s.Server.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	}
+	s.Server.StartTLS()
+	return s
+}
+
+// RequireAuthorization makes the server answer 401 to the requests without this Authorization header
+func (s *Server) RequireAuthorization(authorization string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.authorization = authorization
+}
+
+func newServer() *Server {
+	return &Server{
+		apps:      map[string][]*Instance{},
+		overrides: map[string]string{},
+		gzip:      true,
+	}
+}
+
+// ServiceUrl is the url to hand to springcloud.NewEureka
+func (s *Server) ServiceUrl() string {
+	return s.URL + "/eureka/"
+}
+
+// NewInstance returns an UP instance with the given address
+func NewInstance(app, instanceId, ipAddr string, port int) Instance {
+	return Instance{
+		InstanceId:       instanceId,
+		HostName:         ipAddr,
+		App:              strings.ToUpper(app),
+		IpAddr:           ipAddr,
+		Status:           statusUp,
+		OverriddenStatus: statusUnknown,
+		Port:             Port{Value: port, Enabled: "true"},
+		SecurePort:       Port{Value: 443, Enabled: "false"},
+		CountryId:        1,
+		DataCenterInfo: DataCenterInfo{
+			Class: "com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo",
+			Name:  "MyOwn",
+		},
+		LeaseInfo:  LeaseInfo{RenewalIntervalInSecs: 30, DurationInSecs: 90},
+		VipAddress: strings.ToLower(app),
+	}
+}
+
+// Register adds or replaces an instance as if it had registered itself
+func (s *Server) Register(instance Instance) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.register(instance)
+}
+
+// Evict removes an instance as if its lease had expired, its next heartbeat gets a 404
+func (s *Server) Evict(app, instanceId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cancel(strings.ToUpper(app), instanceId)
+}
+
+// SetStatus changes the status of a registered instance without going through an override
+func (s *Server) SetStatus(app, instanceId, status string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	instance := s.find(strings.ToUpper(app), instanceId)
+	if instance == nil {
+		return false
+	}
+	instance.Status = status
+	s.changed(instance, actionModified)
+	return true
+}
+
+// Instance returns a copy of a registered instance
+func (s *Server) Instance(app, instanceId string) (Instance, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	instance := s.find(strings.ToUpper(app), instanceId)
+	if instance == nil {
+		return Instance{}, false
+	}
+	return *instance, true
+}
+
+// ClearDeltas forgets the recent changes, as eureka does after a few minutes
+func (s *Server) ClearDeltas() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.deltas = nil
+}
+
+// SetGzip decides whether responses are compressed for clients accepting gzip, they are by default
+func (s *Server) SetGzip(enabled bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.gzip = enabled
+}
+
+// SetXmlOnly makes the server behave like an old eureka: it answers in XML whatever the
+// client accepts, and rejects JSON registrations
+func (s *Server) SetXmlOnly(xmlOnly bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.xmlOnly = xmlOnly
+}
+
+func (s *Server) InjectFault(fault Fault) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+func (s *Server) ClearFaults() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults = nil
+}
+
+// Requests lists the requests received so far, as "METHOD /path"
+func (s *Server) Requests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	requests := make([]string, len(s.requests))
+	copy(requests, s.requests)
+	return requests
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	fault := s.nextFault(r)
+	authorization := s.authorization
+	s.lock.Unlock()
+
+	if authorization != "" && r.Header.Get("Authorization") != authorization {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if fault != nil {
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if fault.DropConnection {
+			if hijacker, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hijacker.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+		if fault.StatusCode != 0 {
+			w.WriteHeader(fault.StatusCode)
+			return
+		}
+	}
+
+	segments, ok := pathSegments(r.URL.EscapedPath())
+	if !ok || len(segments) < 2 || segments[0] != "eureka" || segments[1] != "apps" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	segments = segments[2:]
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		s.writeApplications(w, r, s.allApplications())
+	case len(segments) == 1 && segments[0] == "delta" && r.Method == http.MethodGet:
+		s.writeApplications(w, r, s.deltaApplications())
+	case len(segments) == 1 && r.Method == http.MethodPost:
+		s.handleRegister(w, r, strings.ToUpper(segments[0]))
+	case len(segments) == 2 && r.Method == http.MethodPut:
+		s.handleRenew(w, strings.ToUpper(segments[0]), segments[1])
+	case len(segments) == 2 && r.Method == http.MethodDelete:
+		if s.cancel(strings.ToUpper(segments[0]), segments[1]) {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case len(segments) == 3 && segments[2] == "status" && r.Method == http.MethodPut:
+		s.handleStatusOverride(w, strings.ToUpper(segments[0]), segments[1], r.URL.Query().Get("value"), true)
+	case len(segments) == 3 && segments[2] == "status" && r.Method == http.MethodDelete:
+		s.handleStatusOverride(w, strings.ToUpper(segments[0]), segments[1], r.URL.Query().Get("value"), false)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *Server) nextFault(r *http.Request) *Fault {
+	for i, fault := range s.faults {
+		if fault.Method != "" && fault.Method != r.Method {
+			continue
+		}
+		if fault.Count > 0 {
+			fault.Count--
+			if fault.Count == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return fault
+	}
+	return nil
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request, app string) {
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var instance Instance
+	if strings.Contains(r.Header.Get("Content-Type"), "xml") {
+		err = xml.Unmarshal(bodyBytes, &instance)
+	} else if s.xmlOnly {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	} else {
+		var wrapper instanceWrapper
+		err = jsonlib.Unmarshal(bodyBytes, &wrapper)
+		instance = wrapper.Instance
+	}
+	if err != nil || instance.InstanceId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	instance.App = app
+	s.register(instance)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleRenew(w http.ResponseWriter, app, instanceId string) {
+	instance := s.find(app, instanceId)
+	if instance == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	instance.LeaseInfo.LastRenewalTimestamp = now()
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleStatusOverride sets or removes an override, when it is removed the instance gets
+// the given status, UNKNOWN by default, until it registers again
+func (s *Server) handleStatusOverride(w http.ResponseWriter, app, instanceId, status string, override bool) {
+	instance := s.find(app, instanceId)
+	if instance == nil || (override && status == "") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !override {
+		if status == "" {
+			status = statusUnknown
+		}
+		delete(s.overrides, instanceId)
+		instance.OverriddenStatus = statusUnknown
+		instance.Status = status
+	} else {
+		s.overrides[instanceId] = status
+		instance.OverriddenStatus = status
+		instance.Status = status
+	}
+	s.changed(instance, actionModified)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) register(instance Instance) {
+	instance.App = strings.ToUpper(instance.App)
+	instance.ActionType = ""
+	if override, exist := s.overrides[instance.InstanceId]; exist {
+		instance.OverriddenStatus = override
+		instance.Status = override
+	}
+	timestamp := now()
+	if instance.LastDirtyTimestamp == "" {
+		instance.LastDirtyTimestamp = strconv.FormatInt(timestamp, 10)
+	}
+	if instance.IsCoordinatingDiscoveryServer == "" {
+		instance.IsCoordinatingDiscoveryServer = "false"
+	}
+	instance.LeaseInfo.RegistrationTimestamp = timestamp
+	instance.LeaseInfo.LastRenewalTimestamp = timestamp
+	if instance.Status == statusUp {
+		instance.LeaseInfo.ServiceUpTimestamp = timestamp
+	}
+
+	action := actionAdded
+	if existing := s.find(instance.App, instance.InstanceId); existing != nil {
+		*existing = instance
+		action = actionModified
+		s.changed(existing, action)
+		return
+	}
+
+	stored := &instance
+	s.apps[instance.App] = append(s.apps[instance.App], stored)
+	s.changed(stored, action)
+}
+
+func (s *Server) cancel(app, instanceId string) bool {
+	instances := s.apps[app]
+	for i, instance := range instances {
+		if instance.InstanceId != instanceId {
+			continue
+		}
+		s.apps[app] = append(instances[:i:i], instances[i+1:]...)
+		if len(s.apps[app]) == 0 {
+			delete(s.apps, app)
+		}
+		s.changed(instance, actionDeleted)
+		return true
+	}
+	return false
+}
+
+func (s *Server) find(app, instanceId string) *Instance {
+	for _, instance := range s.apps[app] {
+		if instance.InstanceId == instanceId {
+			return instance
+		}
+	}
+	return nil
+}
+
+func (s *Server) changed(instance *Instance, action string) {
+	instance.LastUpdatedTimestamp = strconv.FormatInt(now(), 10)
+	change := *instance
+	change.ActionType = action
+	s.deltas = append(s.deltas, change)
+	s.version++
+}
+
+func (s *Server) allApplications() applications {
+	appNames := make([]string, 0, len(s.apps))
+	for appName := range s.apps {
+		appNames = append(appNames, appName)
+	}
+	sort.Strings(appNames)
+
+	result := applications{Application: make([]application, 0, len(appNames))}
+	for _, appName := range appNames {
+		app := application{Name: appName}
+		for _, instance := range s.apps[appName] {
+			app.Instance = append(app.Instance, *instance)
+		}
+		result.Application = append(result.Application, app)
+	}
+	return s.withHeader(result)
+}
+
+// deltaApplications returns the latest change of every recently changed instance
+func (s *Server) deltaApplications() applications {
+	result := applications{Application: []application{}}
+	for _, change := range s.deltas {
+		appIndex := -1
+		for i, app := range result.Application {
+			if app.Name == change.App {
+				appIndex = i
+			}
+		}
+		if appIndex < 0 {
+			result.Application = append(result.Application, application{Name: change.App})
+			appIndex = len(result.Application) - 1
+		}
+
+		app := &result.Application[appIndex]
+		replaced := false
+		for i, instance := range app.Instance {
+			if instance.InstanceId == change.InstanceId {
+				app.Instance[i] = change
+				replaced = true
+			}
+		}
+		if !replaced {
+			app.Instance = append(app.Instance, change)
+		}
+	}
+	return s.withHeader(result)
+}
+
+func (s *Server) withHeader(result applications) applications {
+	result.VersionsDelta = strconv.Itoa(s.version)
+	result.AppsHashcode = s.hashCode()
+	return result
+}
+
+// hashCode is the instance count of every status, ordered by status, e.g. DOWN_1_UP_3_
+func (s *Server) hashCode() string {
+	countByStatus := make(map[string]int)
+	for _, instances := range s.apps {
+		for _, instance := range instances {
+			countByStatus[instance.Status]++
+		}
+	}
+
+	statuses := make([]string, 0, len(countByStatus))
+	for status := range countByStatus {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	var builder strings.Builder
+	for _, status := range statuses {
+		builder.WriteString(status + "_" + strconv.Itoa(countByStatus[status]) + "_")
+	}
+	return builder.String()
+}
+
+func (s *Server) writeApplications(w http.ResponseWriter, r *http.Request, result applications) {
+	var bodyBytes []byte
+	var err error
+	if s.xmlOnly || prefersXml(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "application/xml")
+		bodyBytes, err = xml.Marshal(&result)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		bodyBytes, err = jsonlib.Marshal(&applicationsWrapper{Applications: result})
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var writer io.Writer = w
+	if s.gzip && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gzipWriter := gzip.NewWriter(w)
+		defer gzipWriter.Close()
+		writer = gzipWriter
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = writer.Write(bodyBytes)
+}
+
+// prefersXml tells whether xml comes before json in the Accept header, quality values are ignored
+func prefersXml(accept string) bool {
+	xmlIndex := strings.Index(accept, "xml")
+	jsonIndex := strings.Index(accept, "json")
+	return xmlIndex >= 0 && (jsonIndex < 0 || xmlIndex < jsonIndex)
+}
+
+func pathSegments(escapedPath string) ([]string, bool) {
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(escapedPath, "/"), "/") {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, false
+		}
+		if unescaped != "" {
+			segments = append(segments, unescaped)
+		}
+	}
+	return segments, true
+}
+
+func now() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,174 @@
+package springcloud
+
+import (
+	"reflect"
+	"sort"
+)
+
+type RegistryEventType int
+
+const (
+	ApplicationAdded RegistryEventType = iota
+	ApplicationRemoved
+	InstanceUp      // an instance appeared as UP, or its status changed to UP
+	InstanceDown    // an UP instance disappeared, or its status changed from UP to anything else
+	InstanceChanged // any other change, including instances that appear or disappear while not UP
+)
+
+func (t RegistryEventType) String() string {
+	switch t {
+	case ApplicationAdded:
+		return "ApplicationAdded"
+	case ApplicationRemoved:
+		return "ApplicationRemoved"
+	case InstanceUp:
+		return "InstanceUp"
+	case InstanceDown:
+		return "InstanceDown"
+	case InstanceChanged:
+		return "InstanceChanged"
+	default:
+		return "Unknown"
+	}
+}
+
+type RegistryEvent struct {
+	Type    RegistryEventType
+	AppName string
+	// Instance is the state after the change, nil when the instance is gone or for application events
+	Instance *ApplicationInstanceDto
+	// Previous is the state before the change, nil when the instance is new or for application events
+	Previous *ApplicationInstanceDto
+}
+
+// Subscribe registers fn to be told about registry changes between successive fetches.
+// fn first receives the current registry as added events, then every later change, in order.
+// It is called on the fetching goroutine, so it should not block
+func (e *Eureka) Subscribe(fn func(event RegistryEvent)) (unsubscribe func()) {
+	e.publishLock.Lock()
+	defer e.publishLock.Unlock()
+
+	e.subscriberLock.Lock()
+	id := e.nextSubscriberId
+	e.nextSubscriberId++
+	e.subscribers[id] = fn
+	e.subscriberLock.Unlock()
+
+	for _, event := range diffApplications(nil, e.published) {
+		fn(event)
+	}
+
+	return func() {
+		e.subscriberLock.Lock()
+		defer e.subscriberLock.Unlock()
+		delete(e.subscribers, id)
+	}
+}
+
+// publish tells the subscribers what changed since the previous call
+func (e *Eureka) publish(applications ApplicationType) {
+	e.publishLock.Lock()
+	defer e.publishLock.Unlock()
+
+	events := diffApplications(e.published, applications)
+	e.published = applications
+	if len(events) == 0 {
+		return
+	}
+
+	e.subscriberLock.Lock()
+	subscribers := make([]func(event RegistryEvent), 0, len(e.subscribers))
+	for _, subscriber := range e.subscribers {
+		subscribers = append(subscribers, subscriber)
+	}
+	e.subscriberLock.Unlock()
+
+	for _, subscriber := range subscribers {
+		for _, event := range events {
+			subscriber(event)
+		}
+	}
+}
+
+// diffApplications lists the changes from previous to current. Within an application,
+// ApplicationAdded comes before the instance events and ApplicationRemoved after them
+func diffApplications(previous, current ApplicationType) []RegistryEvent {
+	appNames := make([]string, 0, len(previous)+len(current))
+	for appName := range previous {
+		appNames = append(appNames, appName)
+	}
+	for appName := range current {
+		if _, exist := previous[appName]; !exist {
+			appNames = append(appNames, appName)
+		}
+	}
+	sort.Strings(appNames)
+
+	var events []RegistryEvent
+	for _, appName := range appNames {
+		previousInstances, existed := previous[appName]
+		currentInstances, exists := current[appName]
+		if !existed {
+			events = append(events, RegistryEvent{Type: ApplicationAdded, AppName: appName})
+		}
+		events = append(events, diffInstances(appName, previousInstances, currentInstances)...)
+		if !exists {
+			events = append(events, RegistryEvent{Type: ApplicationRemoved, AppName: appName})
+		}
+	}
+
+	return events
+}
+
+func diffInstances(appName string, previous, current []ApplicationInstanceDto) []RegistryEvent {
+	previousById := make(map[string]*ApplicationInstanceDto, len(previous))
+	for i := range previous {
+		previousById[previous[i].InstanceId] = &previous[i]
+	}
+
+	var events []RegistryEvent
+	for i := range current {
+		instance := &current[i]
+		previousInstance, existed := previousById[instance.InstanceId]
+		delete(previousById, instance.InstanceId)
+
+		wasUp := existed && previousInstance.Status == StatusUp
+		isUp := instance.Status == StatusUp
+		switch {
+		case isUp && !wasUp:
+			events = append(events, RegistryEvent{Type: InstanceUp, AppName: appName, Instance: instance, Previous: previousInstance})
+		case wasUp && !isUp:
+			events = append(events, RegistryEvent{Type: InstanceDown, AppName: appName, Instance: instance, Previous: previousInstance})
+		case !existed || !sameInstance(previousInstance, instance):
+			events = append(events, RegistryEvent{Type: InstanceChanged, AppName: appName, Instance: instance, Previous: previousInstance})
+		}
+	}
+
+	// what is left is gone, keep the original order
+	for i := range previous {
+		previousInstance, gone := previousById[previous[i].InstanceId]
+		if !gone {
+			continue
+		}
+		eventType := InstanceChanged
+		if previousInstance.Status == StatusUp {
+			eventType = InstanceDown
+		}
+		events = append(events, RegistryEvent{Type: eventType, AppName: appName, Previous: previousInstance})
+	}
+
+	return events
+}
+
+// sameInstance compares two states of an instance, ignoring how they were delivered
+// and the lease renewals, which change with every heartbeat
+func sameInstance(a, b *ApplicationInstanceDto) bool {
+	x, y := *a, *b
+	x.ActionType, y.ActionType = "", ""
+	if x.LeaseInfo != nil && y.LeaseInfo != nil {
+		xLease, yLease := *x.LeaseInfo, *y.LeaseInfo
+		xLease.LastRenewalTimestamp, yLease.LastRenewalTimestamp = 0, 0
+		x.LeaseInfo, y.LeaseInfo = &xLease, &yLease
+	}
+	return reflect.DeepEqual(x, y)
+}
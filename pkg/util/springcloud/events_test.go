@@ -0,0 +1,113 @@
+package springcloud
+
+import (
+	"gin-demo/pkg/util/springcloud/eurekatest"
+	"strings"
+	"testing"
+)
+
+func eventsToString(events []RegistryEvent) string {
+	descriptions := make([]string, 0, len(events))
+	for _, event := range events {
+		description := event.Type.String() + ":" + event.AppName
+		if event.Instance != nil {
+			description += ":" + event.Instance.InstanceId
+		} else if event.Previous != nil {
+			description += ":" + event.Previous.InstanceId
+		}
+		descriptions = append(descriptions, description)
+	}
+	return strings.Join(descriptions, ",")
+}
+
+func TestDiffApplications(t *testing.T) {
+	previous := ApplicationType{
+		"DEMO-V1": {
+			{InstanceId: "a", Status: StatusUp},
+			{InstanceId: "b", Status: StatusUp},
+			{InstanceId: "c", Status: StatusUp, HostName: "host-c"},
+			{InstanceId: "d", Status: StatusStarting},
+		},
+		"DEMO-V2": {
+			{InstanceId: "e", Status: StatusUp},
+		},
+	}
+	current := ApplicationType{
+		"DEMO-V1": {
+			{InstanceId: "a", Status: StatusUp, ActionType: ActionAdded},
+			{InstanceId: "b", Status: StatusOutOfService},
+			{InstanceId: "c", Status: StatusUp, HostName: "host-c2"},
+			{InstanceId: "d", Status: StatusUp},
+			{InstanceId: "f", Status: StatusStarting},
+		},
+		"DEMO-V3": {
+			{InstanceId: "g", Status: StatusUp},
+		},
+	}
+
+	expected := "InstanceDown:DEMO-V1:b,InstanceChanged:DEMO-V1:c,InstanceUp:DEMO-V1:d,InstanceChanged:DEMO-V1:f," +
+		"InstanceDown:DEMO-V2:e,ApplicationRemoved:DEMO-V2," +
+		"ApplicationAdded:DEMO-V3,InstanceUp:DEMO-V3:g"
+	actual := eventsToString(diffApplications(previous, current))
+	if actual != expected {
+		t.Fatalf("wrong events, expected:%s, actual:%s", expected, actual)
+	}
+}
+
+func TestSameInstance(t *testing.T) {
+	a := ApplicationInstanceDto{InstanceId: "a", LeaseInfo: &LeaseInfoDto{LastRenewalTimestamp: 1}}
+	b := ApplicationInstanceDto{InstanceId: "a", LeaseInfo: &LeaseInfoDto{LastRenewalTimestamp: 2}, ActionType: ActionModified}
+	if !sameInstance(&a, &b) {
+		t.Fatal("a heartbeat is not a change")
+	}
+
+	b.Metadata = MetadataMap{"version": "2"}
+	if sameInstance(&a, &b) {
+		t.Fatal("a metadata update is a change")
+	}
+}
+
+func TestEureka_Subscribe(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.Register(eurekatest.NewInstance("demo-v1", "a", "10.0.0.1", 8080))
+
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, false, true)
+	if _, err := eureka.GetApplications(); err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+
+	var events []RegistryEvent
+	unsubscribe := eureka.Subscribe(func(event RegistryEvent) {
+		events = append(events, event)
+	})
+	if actual := eventsToString(events); actual != "ApplicationAdded:DEMO-V1,InstanceUp:DEMO-V1:a" {
+		t.Fatalf("current registry not replayed, events:%s", actual)
+	}
+
+	events = nil
+	if _, err := eureka.GetApplications(); err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("unexpected events:%s", eventsToString(events))
+	}
+
+	server.SetStatus("demo-v1", "a", StatusDown)
+	if _, err := eureka.GetApplications(); err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+	if actual := eventsToString(events); actual != "InstanceDown:DEMO-V1:a" {
+		t.Fatalf("wrong events, expected:%s, actual:%s", "InstanceDown:DEMO-V1:a", actual)
+	}
+
+	unsubscribe()
+	events = nil
+	server.SetStatus("demo-v1", "a", StatusUp)
+	if _, err := eureka.GetApplications(); err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("events received after unsubscribe:%s", eventsToString(events))
+	}
+}
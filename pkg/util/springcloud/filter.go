@@ -0,0 +1,158 @@
+package springcloud
+
+import (
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+)
+
+// InstanceFilter narrows the instances of an application down to those which may take traffic.
+// It returns a new slice and leaves instances untouched, it is called concurrently
+type InstanceFilter interface {
+	Filter(instances []ApplicationInstanceDto) []ApplicationInstanceDto
+}
+
+// FilterChain applies its filters in order
+type FilterChain []InstanceFilter
+
+func (chain FilterChain) Filter(instances []ApplicationInstanceDto) []ApplicationInstanceDto {
+	for _, filter := range chain {
+		instances = filter.Filter(instances)
+	}
+	return instances
+}
+
+// DefaultInstanceFilter only keeps the UP instances
+func DefaultInstanceFilter() InstanceFilter {
+	return FilterChain{StatusFilter{StatusUp}}
+}
+
+// filterInstances keeps the instances accept returns true for
+func filterInstances(instances []ApplicationInstanceDto, accept func(instance *ApplicationInstanceDto) bool) []ApplicationInstanceDto {
+	filtered := make([]ApplicationInstanceDto, 0, len(instances))
+	for i := range instances {
+		if accept(&instances[i]) {
+			filtered = append(filtered, instances[i])
+		}
+	}
+	return filtered
+}
+
+// StatusFilter keeps the instances with one of the statuses, an overridden status wins over the reported one
+type StatusFilter []string
+
+func (filter StatusFilter) Filter(instances []ApplicationInstanceDto) []ApplicationInstanceDto {
+	return filterInstances(instances, func(instance *ApplicationInstanceDto) bool {
+		status := instance.Status
+		if instance.Overriddenstatus != "" && instance.Overriddenstatus != StatusUnknown {
+			status = instance.Overriddenstatus
+		}
+		for _, accepted := range filter {
+			if status == accepted {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// MetadataFilter keeps the instances whose metadata has Key set to Value
+type MetadataFilter struct {
+	Key   string
+	Value string
+}
+
+// ParseMetadataFilter reads a "key=value" predicate, e.g. "version=2"
+func ParseMetadataFilter(predicate string) (MetadataFilter, error) {
+	parts := strings.SplitN(predicate, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return MetadataFilter{}, errors.Errorf("invalid metadata predicate:%s", predicate)
+	}
+	return MetadataFilter{Key: parts[0], Value: parts[1]}, nil
+}
+
+func (filter MetadataFilter) Filter(instances []ApplicationInstanceDto) []ApplicationInstanceDto {
+	return filterInstances(instances, func(instance *ApplicationInstanceDto) bool {
+		value, exist := instance.Metadata[filter.Key]
+		return exist && value == filter.Value
+	})
+}
+
+// ZoneAffinityFilter keeps the instances of Zone, or all of them when none is in Zone,
+// so that the calls only cross zones when they have to
+type ZoneAffinityFilter struct {
+	Zone string
+}
+
+func (filter ZoneAffinityFilter) Filter(instances []ApplicationInstanceDto) []ApplicationInstanceDto {
+	if filter.Zone == "" {
+		return instances
+	}
+	local := filterInstances(instances, func(instance *ApplicationInstanceDto) bool {
+		return zoneOf(instance.Metadata, instance.DataCenterInfo) == filter.Zone
+	})
+	if len(local) == 0 {
+		return instances
+	}
+	return local
+}
+
+// DenyList drops the instances listed by hand, by instance id. It is safe for concurrent use,
+// the ribbons using it need a RefreshFilters after a change
+type DenyList struct {
+	lock        *sync.RWMutex
+	instanceIds map[string]bool
+}
+
+func NewDenyList() *DenyList {
+	return &DenyList{lock: new(sync.RWMutex), instanceIds: map[string]bool{}}
+}
+
+func (list *DenyList) Add(instanceId string) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	list.instanceIds[instanceId] = true
+}
+
+func (list *DenyList) Remove(instanceId string) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	delete(list.instanceIds, instanceId)
+}
+
+// InstanceIds lists the denied instances, in no particular order
+func (list *DenyList) InstanceIds() []string {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+
+	instanceIds := make([]string, 0, len(list.instanceIds))
+	for instanceId := range list.instanceIds {
+		instanceIds = append(instanceIds, instanceId)
+	}
+	return instanceIds
+}
+
+func (list *DenyList) Filter(instances []ApplicationInstanceDto) []ApplicationInstanceDto {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	return filterInstances(instances, func(instance *ApplicationInstanceDto) bool {
+		return !list.instanceIds[instance.InstanceId]
+	})
+}
+
+// SetInstanceFilter decides which instances GetApplication returns, and the ribbons on this client
+// choose from, DefaultInstanceFilter when nil
+func (e *Eureka) SetInstanceFilter(filter InstanceFilter) {
+	e.rwLock.Lock()
+	if filter == nil {
+		filter = DefaultInstanceFilter()
+	}
+	e.instanceFilter = filter
+	e.rwLock.Unlock()
+}
+
+func (e *Eureka) InstanceFilter() InstanceFilter {
+	e.rwLock.RLock()
+	defer e.rwLock.RUnlock()
+	return e.instanceFilter
+}
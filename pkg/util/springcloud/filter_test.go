@@ -0,0 +1,139 @@
+package springcloud
+
+import (
+	"gin-demo/pkg/util/springcloud/eurekatest"
+	"strings"
+	"testing"
+)
+
+func instanceIdsOf(instances []ApplicationInstanceDto) string {
+	instanceIds := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		instanceIds = append(instanceIds, instance.InstanceId)
+	}
+	return strings.Join(instanceIds, ",")
+}
+
+func TestInstanceFilters(t *testing.T) {
+	instances := []ApplicationInstanceDto{
+		{InstanceId: "up-a", Status: StatusUp, Overriddenstatus: StatusUnknown, Metadata: map[string]string{"zone": "a", "version": "1"}},
+		{InstanceId: "up-b", Status: StatusUp, Metadata: map[string]string{"zone": "b", "version": "2"}},
+		{InstanceId: "down-a", Status: StatusDown, Metadata: map[string]string{"zone": "a", "version": "2"}},
+		{InstanceId: "oos-b", Status: StatusUp, Overriddenstatus: StatusOutOfService,
+			DataCenterInfo: DataCenterInfoDto{Metadata: map[string]string{"availability-zone": "b"}}},
+		{InstanceId: "starting-c", Status: StatusStarting, Metadata: map[string]string{"zone": "c"}},
+	}
+
+	version, err := ParseMetadataFilter("version=2")
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	if _, err := ParseMetadataFilter("version"); err == nil {
+		t.Fatal("predicate without a value accepted")
+	}
+	denyList := NewDenyList()
+	denyList.Add("up-a")
+
+	tests := []struct {
+		name     string
+		filter   InstanceFilter
+		expected string
+	}{
+		{"default", DefaultInstanceFilter(), "up-a,up-b"},
+		{"status", StatusFilter{StatusDown, StatusOutOfService}, "down-a,oos-b"},
+		{"metadata", version, "up-b,down-a"},
+		{"zone", ZoneAffinityFilter{Zone: "b"}, "up-b,oos-b"},
+		{"no instance in zone", ZoneAffinityFilter{Zone: "d"}, "up-a,up-b,down-a,oos-b,starting-c"},
+		{"deny list", denyList, "up-b,down-a,oos-b,starting-c"},
+		// zone affinity after the status, the zone with UP instances wins
+		{"chain", FilterChain{StatusFilter{StatusUp}, ZoneAffinityFilter{Zone: "c"}}, "up-a,up-b"},
+	}
+	for _, test := range tests {
+		if actual := instanceIdsOf(test.filter.Filter(instances)); actual != test.expected {
+			t.Fatalf("%s: wrong instances, expected:%s, actual:%s", test.name, test.expected, actual)
+		}
+	}
+	if len(instances) != 5 {
+		t.Fatal("the filters modified their input")
+	}
+}
+
+func TestRibbon_InstanceFilter(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+	v1 := eurekatest.NewInstance("demo-v1", "demo-v1-1", "10.0.0.1", 8080)
+	v1.Metadata = eurekatest.MetadataMap{"version": "1"}
+	v2 := eurekatest.NewInstance("demo-v1", "demo-v1-2", "10.0.0.2", 8080)
+	v2.Metadata = eurekatest.MetadataMap{"version": "2"}
+	starting := eurekatest.NewInstance("demo-v1", "demo-v1-3", "10.0.0.3", 8080)
+	starting.Status = StatusStarting
+	server.Register(v1)
+	server.Register(v2)
+	server.Register(starting)
+
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, false, true)
+	if err := eureka.Start(); err != nil {
+		t.Fatal("eureka start failed: ", err)
+	}
+	defer eureka.Stop()
+	ribbon := NewRibbonWithEureka(eureka)
+	defer ribbon.Stop()
+
+	chosen := func() string {
+		counts := map[string]int{}
+		for i := 0; i < 6; i++ {
+			instance, exist := ribbon.GetApplicationInstance("demo-v1", "")
+			if !exist {
+				return ""
+			}
+			counts[instance.InstanceId]++
+		}
+		instanceIds := make([]string, 0, len(counts))
+		for _, instanceId := range []string{"demo-v1-1", "demo-v1-2", "demo-v1-3"} {
+			if counts[instanceId] > 0 {
+				instanceIds = append(instanceIds, instanceId)
+			}
+		}
+		return strings.Join(instanceIds, ",")
+	}
+	expect := func(expected string) {
+		t.Helper()
+		if actual := chosen(); actual != expected {
+			t.Fatalf("wrong instances chosen, expected:%s, actual:%s", expected, actual)
+		}
+	}
+
+	// the STARTING instance is registered but takes no traffic, like in GetApplication
+	expect("demo-v1-1,demo-v1-2")
+	if applications, _ := eureka.GetApplication("demo-v1"); instanceIdsOf(applications) != "demo-v1-1,demo-v1-2" {
+		t.Fatal("wrong instances from GetApplication: ", instanceIdsOf(applications))
+	}
+
+	// once UP it does
+	server.SetStatus("demo-v1", "demo-v1-3", StatusUp)
+	if _, err := eureka.GetApplications(); err != nil {
+		t.Fatal("fetch failed: ", err)
+	}
+	expect("demo-v1-1,demo-v1-2,demo-v1-3")
+
+	denyList := NewDenyList()
+	denyList.Add("demo-v1-1")
+	ribbon.SetInstanceFilter(FilterChain{DefaultInstanceFilter(), denyList})
+	expect("demo-v1-2,demo-v1-3")
+	denyList.Add("demo-v1-2")
+	denyList.Add("demo-v1-3")
+	ribbon.RefreshFilters()
+	expect("")
+	denyList.Remove("demo-v1-2")
+	ribbon.RefreshFilters()
+	expect("demo-v1-2")
+
+	// back to the filter of eureka, shared with GetApplication
+	ribbon.SetInstanceFilter(nil)
+	eureka.SetInstanceFilter(FilterChain{DefaultInstanceFilter(), MetadataFilter{Key: "version", Value: "2"}})
+	ribbon.RefreshFilters()
+	expect("demo-v1-2")
+	if applications, _ := eureka.GetApplication("demo-v1"); instanceIdsOf(applications) != "demo-v1-2" {
+		t.Fatal("wrong instances from GetApplication: ", instanceIdsOf(applications))
+	}
+}
@@ -0,0 +1,101 @@
+package springcloud
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// defaultVirtualNodes spreads each instance over the ring, the more points the more even the load
+const defaultVirtualNodes = 160
+
+// ConsistentHashRule sends the requests with the same key to the same instance, through a hash ring
+// with virtual nodes: when an instance comes or goes, only the keys on its points move.
+// Requests without a key are balanced round robin
+type ConsistentHashRule struct {
+	virtualNodes int
+	fallback     RoundRobinRule
+
+	lock *sync.Mutex
+	ring *hashRing
+}
+
+func NewConsistentHashRule(virtualNodes int) *ConsistentHashRule {
+	if virtualNodes <= 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+	return &ConsistentHashRule{virtualNodes: virtualNodes, lock: new(sync.Mutex)}
+}
+
+func (rule *ConsistentHashRule) Choose(key string, instances []ApplicationInstance, stats *LoadBalancerStats) *ApplicationInstance {
+	if key == "" {
+		return rule.fallback.Choose(key, instances, stats)
+	}
+	return rule.ringOf(instances).lookup(key)
+}
+
+// ringOf returns the ring of instances, the ribbon replaces the slice on every change,
+// so the ring is only rebuilt when the instances change
+func (rule *ConsistentHashRule) ringOf(instances []ApplicationInstance) *hashRing {
+	rule.lock.Lock()
+	defer rule.lock.Unlock()
+
+	if rule.ring == nil || !rule.ring.builtFrom(instances) {
+		rule.ring = newHashRing(instances, rule.virtualNodes)
+	}
+	return rule.ring
+}
+
+type hashRing struct {
+	instances []ApplicationInstance
+	points    []uint32 // sorted
+	owners    []int    // owners[i] is the index of the instance at points[i]
+}
+
+func newHashRing(instances []ApplicationInstance, virtualNodes int) *hashRing {
+	ring := &hashRing{
+		instances: instances,
+		points:    make([]uint32, 0, len(instances)*virtualNodes),
+	}
+	owners := make(map[uint32]int, len(instances)*virtualNodes)
+	for i := range instances {
+		for node := 0; node < virtualNodes; node++ {
+			// placed by instance id, so that the points of an instance do not depend on the others
+			point := hashOf(instances[i].InstanceId + "#" + strconv.Itoa(node))
+			if _, taken := owners[point]; taken {
+				continue
+			}
+			owners[point] = i
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+
+	ring.owners = make([]int, len(ring.points))
+	for i, point := range ring.points {
+		ring.owners[i] = owners[point]
+	}
+	return ring
+}
+
+func (ring *hashRing) builtFrom(instances []ApplicationInstance) bool {
+	return len(ring.instances) == len(instances) && len(instances) > 0 && &ring.instances[0] == &instances[0]
+}
+
+// lookup returns the instance owning the first point at or after the hash of key
+func (ring *hashRing) lookup(key string) *ApplicationInstance {
+	hash := hashOf(key)
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hash })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return &ring.instances[ring.owners[i]]
+}
+
+// hashOf takes the first bytes of md5 like ketama, the faster hashes place similar ids too close
+func hashOf(value string) uint32 {
+	sum := md5.Sum([]byte(value))
+	return binary.LittleEndian.Uint32(sum[:4])
+}
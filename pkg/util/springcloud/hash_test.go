@@ -0,0 +1,49 @@
+package springcloud
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestConsistentHashRule_Sticky(t *testing.T) {
+	instances := newInstances(5)
+	rule := NewConsistentHashRule(0)
+
+	counts := map[string]int{}
+	for i := 0; i < 5000; i++ {
+		key := "user-" + strconv.Itoa(i)
+		chosen := rule.Choose(key, instances, nil)
+		if again := rule.Choose(key, instances, nil); again != chosen {
+			t.Fatalf("%s moved from %s to %s", key, chosen.InstanceId, again.InstanceId)
+		}
+		counts[chosen.InstanceId]++
+	}
+	for _, instance := range instances {
+		if count := counts[instance.InstanceId]; count < 600 || count > 1400 {
+			t.Fatalf("uneven distribution: %v", counts)
+		}
+	}
+
+	if counts := countChoices(rule, instances, nil, 10); len(counts) != 5 {
+		t.Fatalf("requests without a key should be balanced round robin: %v", counts)
+	}
+}
+
+func TestConsistentHashRule_MinimalRemapping(t *testing.T) {
+	instances := newInstances(5)
+	rule := NewConsistentHashRule(0)
+	before := map[string]string{}
+	for i := 0; i < 5000; i++ {
+		key := "user-" + strconv.Itoa(i)
+		before[key] = rule.Choose(key, instances, nil).InstanceId
+	}
+
+	// demo-2 leaves, the ribbon hands a new slice
+	remaining := append(append([]ApplicationInstance{}, instances[:2]...), instances[3:]...)
+	for key, previous := range before {
+		chosen := rule.Choose(key, remaining, nil).InstanceId
+		if previous != "demo-2" && chosen != previous {
+			t.Fatalf("%s moved from %s to %s although its instance stayed", key, previous, chosen)
+		}
+	}
+}
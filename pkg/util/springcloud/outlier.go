@@ -0,0 +1,171 @@
+package springcloud
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
+	"time"
+)
+
+var instanceEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ribbon_instance_ejections_total",
+	Help: "The number of times an instance was ejected for failing too many requests",
+}, []string{"application", "instance"})
+
+// OutlierConfig ejects the instances failing too many requests, the requests being reported
+// with ReportSuccess and ReportFailure
+type OutlierConfig struct {
+	// Window is how far back the failure rate is computed, 30 seconds when unset
+	Window time.Duration
+	// MinRequests in the window before the failure rate is taken into account
+	MinRequests int
+	// FailureRate between 0 and 1 above which the instance is ejected
+	FailureRate float64
+	// BaseEjectionTime is multiplied by the number of successive ejections, up to MaxEjectionTime
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+	// MaxEjectionPercent of the instances of an application may be ejected at once
+	MaxEjectionPercent int
+}
+
+func DefaultOutlierConfig() OutlierConfig {
+	return OutlierConfig{
+		Window:             30 * time.Second,
+		MinRequests:        10,
+		FailureRate:        0.5,
+		BaseEjectionTime:   30 * time.Second,
+		MaxEjectionTime:    5 * time.Minute,
+		MaxEjectionPercent: 50,
+	}
+}
+
+type outlierState struct {
+	window       slidingWindow
+	ejections    int // successive ejections, forgotten after MaxEjectionTime without one
+	ejectedUntil time.Time
+}
+
+// outlierDetector keeps the outcome of the recent requests by instance id
+type outlierDetector struct {
+	config OutlierConfig
+	now    func() time.Time
+	lock   *sync.Mutex
+	states map[string]*outlierState
+}
+
+func newOutlierDetector(config OutlierConfig, now func() time.Time) *outlierDetector {
+	if config.Window < windowBuckets {
+		config.Window = DefaultOutlierConfig().Window
+	}
+	return &outlierDetector{
+		config: config,
+		now:    now,
+		lock:   new(sync.Mutex),
+		states: map[string]*outlierState{},
+	}
+}
+
+// record counts a request, it returns whether the instance crossed the failure rate
+func (d *outlierDetector) record(instanceId string, failed bool) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	state, exist := d.states[instanceId]
+	if !exist {
+		state = &outlierState{window: newSlidingWindow(d.config.Window)}
+		d.states[instanceId] = state
+	}
+
+	now := d.now()
+	if now.Before(state.ejectedUntil) {
+		// late answers of the requests sent before the ejection
+		return false
+	}
+
+	calls := state.window.add(now, failed, false)
+	return calls.requests >= d.config.MinRequests && float64(calls.failures) >= d.config.FailureRate*float64(calls.requests)
+}
+
+// eject takes the instance out if fewer than MaxEjectionPercent of the total instances of its
+// application would be out, otherwise it stays in and its window goes on
+func (d *outlierDetector) eject(instanceId string, applicationInstances []ApplicationInstance) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := d.now()
+	ejected := 1
+	for _, instance := range applicationInstances {
+		if state, exist := d.states[instance.InstanceId]; exist && now.Before(state.ejectedUntil) {
+			ejected++
+		}
+	}
+	if ejected*100 > d.config.MaxEjectionPercent*len(applicationInstances) {
+		return false
+	}
+
+	state := d.states[instanceId]
+	if now.Sub(state.ejectedUntil) > d.config.MaxEjectionTime {
+		state.ejections = 0
+	}
+	state.ejections++
+	ejectionTime := d.config.BaseEjectionTime * time.Duration(state.ejections)
+	if ejectionTime > d.config.MaxEjectionTime {
+		ejectionTime = d.config.MaxEjectionTime
+	}
+	state.ejectedUntil = now.Add(ejectionTime)
+	// start over once back
+	state.window.reset()
+	return true
+}
+
+// ejectedUntil is the zero time if the instance is not ejected
+func (d *outlierDetector) ejectedUntil(instanceId string, now time.Time) time.Time {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if state, exist := d.states[instanceId]; exist && now.Before(state.ejectedUntil) {
+		return state.ejectedUntil
+	}
+	return time.Time{}
+}
+
+func (d *outlierDetector) forget(instanceId string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.states, instanceId)
+}
+
+// SetOutlierDetection ejects the instances failing too many of the reported requests
+func (r *Ribbon) SetOutlierDetection(config OutlierConfig) {
+	r.rwLock.Lock()
+	defer r.rwLock.Unlock()
+	r.outliers = newOutlierDetector(config, r.now)
+}
+
+// ReportSuccess tells that the instance answered the request
+func (r *Ribbon) ReportSuccess(instance *ApplicationInstance) {
+	r.report(instance, false)
+}
+
+// ReportFailure tells that the request to the instance failed: no connection, a timeout or a 5xx
+func (r *Ribbon) ReportFailure(instance *ApplicationInstance) {
+	r.report(instance, true)
+}
+
+func (r *Ribbon) report(instance *ApplicationInstance, failed bool) {
+	r.rwLock.RLock()
+	outliers := r.outliers
+	r.rwLock.RUnlock()
+	if outliers == nil || !outliers.record(instance.InstanceId, failed) {
+		return
+	}
+
+	r.rwLock.Lock()
+	defer r.rwLock.Unlock()
+	chooser, exist := r.instanceInfo[instance.App]
+	if !exist || r.outliers != outliers || !outliers.eject(instance.InstanceId, chooser.instances) {
+		return
+	}
+	instanceEjections.WithLabelValues(instance.App, instance.InstanceId).Inc()
+	r.refreshAvailable(chooser)
+}
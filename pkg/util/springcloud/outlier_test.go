@@ -0,0 +1,196 @@
+package springcloud
+
+import (
+	"gin-demo/pkg/util/springcloud/eurekatest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeNow struct {
+	lock *sync.Mutex
+	now  time.Time
+}
+
+func newFakeNow() *fakeNow {
+	return &fakeNow{lock: new(sync.Mutex), now: time.Unix(1000, 0)}
+}
+
+func (f *fakeNow) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *fakeNow) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func TestOutlierDetector_Record(t *testing.T) {
+	now := newFakeNow()
+	config := DefaultOutlierConfig()
+	config.MinRequests = 4
+	detector := newOutlierDetector(config, now.Now)
+
+	for i, failed := range []bool{true, false, true} {
+		if detector.record("demo-1", failed) {
+			t.Fatalf("crossed before the minimum requests, at %d", i)
+		}
+	}
+	// old requests slide out of the window
+	now.Advance(config.Window)
+	if detector.record("demo-1", true) {
+		t.Fatal("the requests out of the window still count")
+	}
+	for i := 0; i < 2; i++ {
+		detector.record("demo-1", false)
+	}
+	if !detector.record("demo-1", true) {
+		t.Fatal("expect 2 failures out of 4 to cross the rate")
+	}
+}
+
+func TestOutlierDetector_DefaultWindow(t *testing.T) {
+	now := newFakeNow()
+	detector := newOutlierDetector(OutlierConfig{MinRequests: 2, FailureRate: 0.5}, now.Now)
+	if detector.config.Window != DefaultOutlierConfig().Window {
+		t.Fatalf("wrong window, expected:%s, actual:%s", DefaultOutlierConfig().Window, detector.config.Window)
+	}
+	detector.record("demo-1", true)
+	if !detector.record("demo-1", true) {
+		t.Fatal("expect 2 failures out of 2 to cross the rate")
+	}
+}
+
+func TestRibbon_OutlierEjection(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-1", "10.0.0.1", 8080))
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-2", "10.0.0.2", 8080))
+
+	ribbon := NewRibbon(server.ServiceUrl(), "gin-demo", 30, false, true)
+	now := newFakeNow()
+	ribbon.now = now.Now
+	if err := ribbon.Start(); err != nil {
+		t.Fatal("ribbon start failed: ", err)
+	}
+	defer ribbon.Stop()
+
+	config := DefaultOutlierConfig()
+	config.MinRequests = 4
+	ribbon.SetOutlierDetection(config)
+
+	choose := func() map[string]int {
+		counts := map[string]int{}
+		for i := 0; i < 4; i++ {
+			instance, _ := ribbon.GetApplicationInstance("demo-v1", "")
+			counts[instance.InstanceId]++
+		}
+		return counts
+	}
+	failing := &ApplicationInstance{InstanceId: "demo-v1-1", App: "DEMO-V1"}
+	healthy := &ApplicationInstance{InstanceId: "demo-v1-2", App: "DEMO-V1"}
+
+	for i := 0; i < 4; i++ {
+		ribbon.ReportFailure(failing)
+	}
+	if counts := choose(); counts["demo-v1-2"] != 4 {
+		t.Fatalf("the failing instance should be ejected: %v", counts)
+	}
+
+	// at most half of the instances are ejected
+	for i := 0; i < 4; i++ {
+		ribbon.ReportFailure(healthy)
+	}
+	if counts := choose(); counts["demo-v1-2"] != 4 {
+		t.Fatalf("the second instance should stay: %v", counts)
+	}
+
+	now.Advance(config.BaseEjectionTime)
+	if counts := choose(); counts["demo-v1-1"] != 2 {
+		t.Fatalf("the instance should be back after the ejection time: %v", counts)
+	}
+
+	// ejected again, for twice as long. The other one is not failing anymore
+	for i := 0; i < 8; i++ {
+		ribbon.ReportSuccess(healthy)
+	}
+	now.Advance(config.Window)
+	for i := 0; i < 4; i++ {
+		ribbon.ReportFailure(failing)
+	}
+	now.Advance(config.BaseEjectionTime)
+	if counts := choose(); counts["demo-v1-2"] != 4 {
+		t.Fatalf("the second ejection should last longer: %v", counts)
+	}
+	now.Advance(config.BaseEjectionTime)
+	if counts := choose(); counts["demo-v1-1"] != 2 {
+		t.Fatalf("the instance should be back after the second ejection: %v", counts)
+	}
+}
+
+// firstRule always chooses the first instance
+type firstRule struct{}
+
+func (firstRule) Choose(key string, instances []ApplicationInstance, stats *LoadBalancerStats) *ApplicationInstance {
+	return &instances[0]
+}
+
+func TestRibbon_EjectionOverDuringRegistryUpdate(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-1", "10.0.0.1", 8080))
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-2", "10.0.0.2", 8080))
+
+	ribbon := NewRibbon(server.ServiceUrl(), "gin-demo", 30, false, true)
+	now := newFakeNow()
+	ribbon.now = now.Now
+	if err := ribbon.Start(); err != nil {
+		t.Fatal("ribbon start failed: ", err)
+	}
+	defer ribbon.Stop()
+	ribbon.SetRule("demo-v1", firstRule{})
+	config := DefaultOutlierConfig()
+	config.MinRequests = 4
+	ribbon.SetOutlierDetection(config)
+
+	ejected := &ApplicationInstance{InstanceId: "demo-v1-1", App: "DEMO-V1"}
+	for i := 0; i < 4; i++ {
+		ribbon.ReportFailure(ejected)
+	}
+	if instance, _ := ribbon.GetApplicationInstance("demo-v1", ""); instance.InstanceId != "demo-v1-2" {
+		t.Fatalf("the failing instance should be ejected, got %s", instance.InstanceId)
+	}
+	registered, _ := ribbon.eureka.GetApplication("demo-v1")
+	var removed *ApplicationInstanceDto
+	for i := range registered {
+		if registered[i].InstanceId == ejected.InstanceId {
+			removed = &registered[i]
+		}
+	}
+
+	// the ejection is over, and the instance leaves the registry while the lock is upgraded:
+	// the update is waiting for the lock by the time the read lock is released
+	now.Advance(config.BaseEjectionTime)
+	updated := make(chan struct{})
+	var once sync.Once
+	ribbon.now = func() time.Time {
+		once.Do(func() {
+			go func() {
+				ribbon.onRegistryEvent(RegistryEvent{Type: InstanceDown, AppName: "DEMO-V1", Previous: removed})
+				close(updated)
+			}()
+			time.Sleep(50 * time.Millisecond)
+		})
+		return now.Now()
+	}
+	for i := 0; i < 4; i++ {
+		instance, exist := ribbon.GetApplicationInstance("demo-v1", "")
+		if !exist || instance.InstanceId != "demo-v1-2" {
+			t.Fatalf("request %d: expect the instance left in the registry, got %+v", i, instance)
+		}
+	}
+	<-updated
+}
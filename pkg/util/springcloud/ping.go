@@ -0,0 +1,148 @@
+package springcloud
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var instanceAlive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ribbon_instance_alive",
+	Help: "Whether the last ping of the instance succeeded, only set when pinging is enabled",
+}, []string{"application", "instance"})
+
+// IPing probes an instance, like the pings of netflix ribbon. It is called concurrently
+type IPing interface {
+	IsAlive(instance *ApplicationInstance) bool
+}
+
+// UrlPing gets the health check url of the instance, it is alive when the answer is 2xx.
+// The instances without a health check url are considered alive
+type UrlPing struct {
+	client *http.Client
+}
+
+func NewUrlPing(timeout time.Duration) *UrlPing {
+	return &UrlPing{client: &http.Client{Timeout: timeout}}
+}
+
+func (ping *UrlPing) IsAlive(instance *ApplicationInstance) bool {
+	if instance.HealthCheckUrl == "" {
+		return true
+	}
+
+	response, err := ping.client.Get(instance.HealthCheckUrl)
+	if err != nil {
+		return false
+	}
+	response.Body.Close()
+	return response.StatusCode >= 200 && response.StatusCode < 300
+}
+
+// TcpPing connects to the port of the instance, the secure one if it only takes https
+type TcpPing struct {
+	Timeout time.Duration
+}
+
+func (ping TcpPing) IsAlive(instance *ApplicationInstance) bool {
+	port := instance.Port
+	if instance.Secure() {
+		port = instance.SecurePort
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(instance.IpAddr, strconv.Itoa(port)), ping.Timeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// SetPing probes every instance with ping each interval, until Stop. The instances failing
+// the probe leave the choice until they pass it again, unless all of them fail.
+// A nil ping stops probing and brings every instance back
+func (r *Ribbon) SetPing(ping IPing, interval time.Duration) {
+	r.rwLock.Lock()
+	if r.pingCancel != nil {
+		r.pingCancel()
+		r.pingCancel = nil
+	}
+	r.dead = map[string]bool{}
+	for _, chooser := range r.instanceInfo {
+		r.refreshAvailable(chooser)
+	}
+	if ping == nil {
+		r.rwLock.Unlock()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.pingCancel = cancel
+	r.rwLock.Unlock()
+
+	task := &timedTask{
+		interval:     interval,
+		backoffBound: 1,
+		clock:        realClock{},
+		random:       defaultRandom,
+	}
+	task.task = func() error {
+		r.pingAll(ctx, ping)
+		return nil
+	}
+	go func() {
+		r.pingAll(ctx, ping)
+		task.run(ctx)
+	}()
+}
+
+// pingAll probes the instances in parallel, then updates the choice of the applications
+func (r *Ribbon) pingAll(ctx context.Context, ping IPing) {
+	r.rwLock.RLock()
+	var instances []ApplicationInstance
+	for _, chooser := range r.instanceInfo {
+		instances = append(instances, chooser.instances...)
+	}
+	r.rwLock.RUnlock()
+
+	alive := make([]bool, len(instances))
+	var wg sync.WaitGroup
+	for i := range instances {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			alive[i] = ping.IsAlive(&instances[i])
+		}(i)
+	}
+	wg.Wait()
+
+	r.rwLock.Lock()
+	defer r.rwLock.Unlock()
+	if ctx.Err() != nil {
+		// stopped or replaced while pinging
+		return
+	}
+	for i, instance := range instances {
+		r.dead[instance.InstanceId] = !alive[i]
+		value := 0.0
+		if alive[i] {
+			value = 1
+		}
+		instanceAlive.WithLabelValues(instance.App, instance.InstanceId).Set(value)
+	}
+	for _, chooser := range r.instanceInfo {
+		r.refreshAvailable(chooser)
+	}
+}
+
+// forgetPing drops the probe result of an instance which left the registry or the filter. Requires the write lock
+func (r *Ribbon) forgetPing(appName string, instanceId string) {
+	if _, exist := r.dead[instanceId]; exist {
+		delete(r.dead, instanceId)
+		instanceAlive.DeleteLabelValues(appName, instanceId)
+	}
+}
@@ -0,0 +1,97 @@
+package springcloud
+
+import (
+	"context"
+	"gin-demo/pkg/util/springcloud/eurekatest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRibbon_Ping(t *testing.T) {
+	var healthy int32 = 0
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer unhealthy.Close()
+	alive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer alive.Close()
+
+	server := eurekatest.NewServer()
+	defer server.Close()
+	instance1 := eurekatest.NewInstance("demo-v1", "demo-v1-1", "10.0.0.1", 8080)
+	instance1.HealthCheckUrl = unhealthy.URL + "/health"
+	server.Register(instance1)
+	instance2 := eurekatest.NewInstance("demo-v1", "demo-v1-2", "10.0.0.2", 8080)
+	instance2.HealthCheckUrl = alive.URL + "/health"
+	server.Register(instance2)
+
+	ribbon := NewRibbon(server.ServiceUrl(), "gin-demo", 30, false, true)
+	if err := ribbon.Start(); err != nil {
+		t.Fatal("ribbon start failed: ", err)
+	}
+	defer ribbon.Stop()
+
+	ping := NewUrlPing(time.Second)
+	ribbon.pingAll(context.Background(), ping)
+	for i := 0; i < 4; i++ {
+		if instance, _ := ribbon.GetApplicationInstance("demo-v1", ""); instance.InstanceId != "demo-v1-2" {
+			t.Fatalf("the instance failing the ping got traffic: %s", instance.InstanceId)
+		}
+	}
+	if value := testutil.ToFloat64(instanceAlive.WithLabelValues("DEMO-V1", "demo-v1-1")); value != 0 {
+		t.Fatalf("wrong alive gauge, expected:%v, actual:%v", 0, value)
+	}
+
+	// recovered
+	atomic.StoreInt32(&healthy, 1)
+	ribbon.pingAll(context.Background(), ping)
+	counts := map[string]int{}
+	for i := 0; i < 4; i++ {
+		instance, _ := ribbon.GetApplicationInstance("demo-v1", "")
+		counts[instance.InstanceId]++
+	}
+	if counts["demo-v1-1"] != 2 {
+		t.Fatalf("the recovered instance should be back: %v", counts)
+	}
+}
+
+func TestRibbon_PingAllDead(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-1", "10.0.0.1", 8080))
+
+	ribbon := NewRibbon(server.ServiceUrl(), "gin-demo", 30, false, true)
+	if err := ribbon.Start(); err != nil {
+		t.Fatal("ribbon start failed: ", err)
+	}
+	defer ribbon.Stop()
+
+	ribbon.pingAll(context.Background(), TcpPing{Timeout: 10 * time.Millisecond})
+	if _, exist := ribbon.GetApplicationInstance("demo-v1", ""); !exist {
+		t.Fatal("an application whose instances all fail the ping should still be routed")
+	}
+}
+
+func TestTcpPing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	u, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(u.Port())
+	instance := &ApplicationInstance{IpAddr: u.Hostname(), Port: port, PortEnabled: true}
+
+	ping := TcpPing{Timeout: time.Second}
+	if !ping.IsAlive(instance) {
+		t.Fatal("expect the listening instance to be alive")
+	}
+	server.Close()
+	if ping.IsAlive(instance) {
+		t.Fatal("expect the closed instance to be dead")
+	}
+}
@@ -0,0 +1,329 @@
+package springcloud
+
+import (
+	"bytes"
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultDataCenterInfoClass = "com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo"
+
+var errInstanceNotFound = errors.New("instance not registered")
+
+// InstanceId follows the spring cloud default: ${hostName}:${applicationName}:${port}
+func (e *Eureka) InstanceId() string {
+	return e.HostName + ":" + strings.ToLower(e.ApplicationName) + ":" + strconv.Itoa(e.Port)
+}
+
+func (e *Eureka) appId() string {
+	return strings.ToUpper(e.ApplicationName)
+}
+
+func (e *Eureka) instanceInfo() ApplicationInstanceDto {
+	host := e.HostName
+	if e.PreferIpAddress {
+		host = e.IpAddr
+	}
+
+	homePageUrl := e.HomePageUrl
+	if homePageUrl == "" {
+		homePageUrl = "http://" + host + ":" + strconv.Itoa(e.Port) + "/"
+	}
+	statusPageUrl := e.StatusPageUrl
+	if statusPageUrl == "" {
+		// the health endpoint, the service has no separate info page
+		statusPageUrl = homePageUrl + "health"
+	}
+	healthCheckUrl := e.HealthCheckUrl
+	if healthCheckUrl == "" {
+		healthCheckUrl = homePageUrl + "health"
+	}
+
+	e.rwLock.RLock()
+	defer e.rwLock.RUnlock()
+
+	metadata := make(map[string]string, len(e.metaData))
+	for key, value := range e.metaData {
+		metadata[key] = value
+	}
+	if e.Region != "" {
+		metadata["region"] = e.Region
+	}
+	if e.Zone != "" {
+		metadata["zone"] = e.Zone
+	}
+
+	vipAddress := strings.ToLower(e.ApplicationName)
+	return ApplicationInstanceDto{
+		InstanceId:       e.InstanceId(),
+		HostName:         host,
+		App:              e.appId(),
+		IpAddr:           e.IpAddr,
+		Port:             PortDto{Value: e.Port, Enabled: "true"},
+		SecurePort:       PortDto{Value: 443, Enabled: "false"},
+		CountryId:        1,
+		Status:           e.instanceStatus,
+		Overriddenstatus: StatusUnknown,
+		VipAddress:       vipAddress,
+		SecureVipAddress: vipAddress,
+		HomePageUrl:      homePageUrl,
+		StatusPageUrl:    statusPageUrl,
+		HealthCheckUrl:   healthCheckUrl,
+		DataCenterInfo: DataCenterInfoDto{
+			Class: defaultDataCenterInfoClass,
+			Name:  "MyOwn",
+		},
+		LeaseInfo: &LeaseInfoDto{
+			RenewalIntervalInSecs: e.LeaseRenewalIntervalInSeconds,
+			DurationInSecs:        e.LeaseExpirationDurationInSeconds,
+		},
+		Metadata:             metadata,
+		LastUpdatedTimestamp: e.lastDirtyTimestamp,
+		LastDirtyTimestamp:   e.lastDirtyTimestamp,
+	}
+}
+
+// register sends the instance descriptor to POST /apps/{appId}
+func (e *Eureka) register() error {
+	e.rwLock.Lock()
+	e.lastDirtyTimestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	e.rwLock.Unlock()
+
+	format := e.requestFormat()
+	body, err := encodeInstance(format, e.instanceInfo())
+	if err != nil {
+		return errors.Errorf("error while marshalling instance:%s", err.Error())
+	}
+
+	return e.executeOnServers(func(baseUrl string) error {
+		statusCode, err := e.send(http.MethodPost, baseUrl+"apps/"+e.appId(), body, format)
+		if err != nil {
+			return err
+		}
+		if statusCode != http.StatusNoContent && statusCode != http.StatusOK {
+			return errors.Errorf("failed to register, server response code:%d", statusCode)
+		}
+		return nil
+	})
+}
+
+// HealthCheckHandler decides the status of the instance, it is asked before every heartbeat
+type HealthCheckHandler interface {
+	// GetStatus returns the status to report, given the one currently reported
+	GetStatus(currentStatus string) string
+}
+
+func (e *Eureka) SetHealthCheckHandler(handler HealthCheckHandler) {
+	e.rwLock.Lock()
+	defer e.rwLock.Unlock()
+	e.healthCheckHandler = handler
+}
+
+// heartbeat registers the instance if it could not at the start, lets the health check
+// handler update the status, then renews the lease
+func (e *Eureka) heartbeat() error {
+	e.rwLock.RLock()
+	handler := e.healthCheckHandler
+	registered := e.registered
+	e.rwLock.RUnlock()
+
+	// started from the snapshot, eureka was unreachable at the time
+	if !registered {
+		if err := e.register(); err != nil {
+			return err
+		}
+		e.rwLock.Lock()
+		e.registered = true
+		e.rwLock.Unlock()
+	}
+
+	if handler != nil {
+		if err := e.SetStatus(handler.GetStatus(e.Status())); err != nil {
+			return err
+		}
+	}
+	return e.renew()
+}
+
+// renew sends a heartbeat to PUT /apps/{appId}/{instanceId}, and registers again
+// if the server does not know the instance anymore, e.g. after its lease expired
+func (e *Eureka) renew() error {
+	e.rwLock.RLock()
+	query := url.Values{}
+	query.Set("status", e.instanceStatus)
+	query.Set("lastDirtyTimestamp", strconv.FormatInt(e.lastDirtyTimestamp, 10))
+	e.rwLock.RUnlock()
+
+	err := e.executeOnServers(func(baseUrl string) error {
+		statusCode, err := e.send(http.MethodPut, baseUrl+"apps/"+e.appId()+"/"+url.PathEscape(e.InstanceId())+"?"+query.Encode(), nil, "")
+		if err != nil {
+			return err
+		}
+		switch statusCode {
+		case http.StatusOK:
+			return nil
+		case http.StatusNotFound:
+			return errInstanceNotFound
+		default:
+			return errors.Errorf("failed to renew, server response code:%d", statusCode)
+		}
+	})
+
+	if err == errInstanceNotFound {
+		e.rwLock.RLock()
+		registered := e.registered
+		e.rwLock.RUnlock()
+		// a heartbeat racing with cancel must not bring the instance back
+		if !registered {
+			return nil
+		}
+		return e.register()
+	}
+	return err
+}
+
+// cancel removes the instance from eureka with DELETE /apps/{appId}/{instanceId}
+func (e *Eureka) cancel() error {
+	e.rwLock.Lock()
+	registered := e.registered
+	e.registered = false
+	e.rwLock.Unlock()
+
+	if !registered {
+		return nil
+	}
+
+	return e.executeOnServers(func(baseUrl string) error {
+		statusCode, err := e.send(http.MethodDelete, baseUrl+"apps/"+e.appId()+"/"+url.PathEscape(e.InstanceId()), nil, "")
+		if err != nil {
+			return err
+		}
+		if statusCode != http.StatusOK {
+			return errors.Errorf("failed to cancel, server response code:%d", statusCode)
+		}
+		return nil
+	})
+}
+
+// SetStatusOverride makes eureka report the instance with the given status whatever the instance
+// itself reports, with PUT /apps/{appId}/{instanceId}/status?value=
+func (e *Eureka) SetStatusOverride(status string) error {
+	query := url.Values{}
+	query.Set("value", status)
+	if err := e.sendStatusOverride(http.MethodPut, query); err != nil {
+		return err
+	}
+	e.rwLock.Lock()
+	defer e.rwLock.Unlock()
+	e.statusOverride = status
+	return nil
+}
+
+// ClearStatusOverride removes the override with DELETE /apps/{appId}/{instanceId}/status,
+// the instance is reported with its own status again
+func (e *Eureka) ClearStatusOverride() error {
+	query := url.Values{}
+	query.Set("value", e.Status())
+	if err := e.sendStatusOverride(http.MethodDelete, query); err != nil {
+		return err
+	}
+	e.rwLock.Lock()
+	defer e.rwLock.Unlock()
+	e.statusOverride = ""
+	return nil
+}
+
+// StatusOverride is the status set with SetStatusOverride, empty when there is none
+func (e *Eureka) StatusOverride() string {
+	e.rwLock.RLock()
+	defer e.rwLock.RUnlock()
+	return e.statusOverride
+}
+
+func (e *Eureka) sendStatusOverride(method string, query url.Values) error {
+	e.rwLock.RLock()
+	registered := e.registered
+	e.rwLock.RUnlock()
+	if !registered {
+		return errors.New("instance not registered")
+	}
+
+	return e.executeOnServers(func(baseUrl string) error {
+		statusCode, err := e.send(method, baseUrl+"apps/"+e.appId()+"/"+url.PathEscape(e.InstanceId())+"/status?"+query.Encode(), nil, "")
+		if err != nil {
+			return err
+		}
+		switch statusCode {
+		case http.StatusOK:
+			return nil
+		case http.StatusNotFound:
+			return errInstanceNotFound
+		default:
+			return errors.Errorf("failed to update status override, server response code:%d", statusCode)
+		}
+	})
+}
+
+// executeOnServers runs fn against the current server, moving on to the next ones on failure.
+// errInstanceNotFound is an answer from the server rather than a failure, so it is not retried
+func (e *Eureka) executeOnServers(fn func(baseUrl string) error) error {
+	e.preferLocalZone()
+	err := fn(e.currentServer())
+	for i := 0; err != nil && err != errInstanceNotFound && i < e.maxRetries(); i++ {
+		err = fn(e.nextServer())
+	}
+	return err
+}
+
+// send performs a request whose response body is of no interest and returns the status code,
+// format tells how the body is encoded
+func (e *Eureka) send(method string, url string, body []byte, format string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		request.Header.Add("Content-Type", contentTypeOf(format))
+	}
+	e.authorize(request)
+	request.Header.Add("Accept", e.acceptHeader())
+	request.Header.Add("Connection", "Keep-Alive")
+	response, err := e.client().Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	return response.StatusCode, nil
+}
+
+func localIpAddr() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "127.0.0.1"
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+	}
+
+	return "127.0.0.1"
+}
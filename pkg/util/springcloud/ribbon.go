@@ -1,92 +1,384 @@
 package springcloud
 
 import (
+	"context"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Ribbon struct {
 	eureka       *Eureka
+	ownsEureka   bool // Start and Stop only go to eureka when the ribbon created it
+	unsubscribe  func()
 	rwLock       *sync.RWMutex
 	instanceInfo map[string]*instanceChooser
+	rules        map[string]IRule // by upper case application name
+	newRule      func() IRule     // creates the rule of the applications without one
+	stats        *LoadBalancerStats
+	pingCancel   context.CancelFunc
+	dead         map[string]bool // instances failing the ping, by instance id
+	outliers     *outlierDetector
+	filter       InstanceFilter // the filter of eureka when nil
+	now          func() time.Time
 }
 
 type ApplicationInstance struct {
-	InstanceId string
-	HostName   string
-	App        string
-	IpAddr     string
-	Port       int
+	InstanceId           string
+	HostName             string
+	App                  string
+	IpAddr               string
+	Port                 int
+	PortEnabled          bool
+	SecurePort           int
+	SecurePortEnabled    bool
+	Status               string
+	Overriddenstatus     string
+	VipAddress           string
+	SecureVipAddress     string
+	HomePageUrl          string
+	StatusPageUrl        string
+	HealthCheckUrl       string
+	Metadata             map[string]string
+	DataCenterInfo       DataCenterInfoDto
+	LeaseInfo            LeaseInfoDto
+	LastUpdatedTimestamp int64
 }
 
-type instanceChooser struct {
-	index     int
-	instances []ApplicationInstance
+// Zone is the availability zone the instance registered in, see zoneOf
+func (instance *ApplicationInstance) Zone() string {
+	return zoneOf(instance.Metadata, instance.DataCenterInfo)
 }
 
-func (chooser *instanceChooser) next() *ApplicationInstance {
-	defer func() {
-		if chooser.index == len(chooser.instances)-1 {
-			chooser.index = 0
-		} else {
-			chooser.index++
-		}
-	}()
+// zoneOf reads the zone from the metadata like spring cloud does, or from the amazon data center info
+func zoneOf(metadata map[string]string, dataCenterInfo DataCenterInfoDto) string {
+	if zone, exist := metadata["zone"]; exist {
+		return zone
+	}
+	return dataCenterInfo.Metadata["availability-zone"]
+}
+
+// Secure tells whether the instance should be reached with https, on SecurePort
+func (instance *ApplicationInstance) Secure() bool {
+	return instance.SecurePortEnabled && !instance.PortEnabled
+}
 
-	return &chooser.instances[chooser.index]
+// instanceChooser holds the instances of an application, the slices are replaced and never modified
+type instanceChooser struct {
+	rule       IRule
+	registered []ApplicationInstanceDto // every instance in the registry, whatever its status
+	instances  []ApplicationInstance    // the registered instances the filter accepts
+	available  []ApplicationInstance    // the instances taking traffic, see refreshAvailable
+	// availableUntil is when the first ejection ends and available must be refreshed, zero if never
+	availableUntil time.Time
 }
 
 func NewRibbon(serverUrl string, applicationName string, registryFetchIntervalSeconds int, registerWithEureka bool, preferIpAddress bool) *Ribbon {
-	eureka := NewEureka(serverUrl, applicationName, registryFetchIntervalSeconds, registerWithEureka, preferIpAddress)
+	return newRibbon(NewEureka(serverUrl, applicationName, registryFetchIntervalSeconds, registerWithEureka, preferIpAddress), true)
+}
+
+// NewRibbonWithEureka balances over the registry of a client shared with other components.
+// The caller keeps the lifecycle of eureka, Start and Stop of the ribbon leave it alone
+func NewRibbonWithEureka(eureka *Eureka) *Ribbon {
+	return newRibbon(eureka, false)
+}
+
+// NewRibbonWithDns is NewRibbon with the eureka servers resolved from dns
+func NewRibbonWithDns(dns DnsConfig, applicationName string, registryFetchIntervalSeconds int, registerWithEureka bool, preferIpAddress bool) (*Ribbon, error) {
+	eureka, err := NewEurekaWithDns(dns, applicationName, registryFetchIntervalSeconds, registerWithEureka, preferIpAddress)
+	if err != nil {
+		return nil, err
+	}
+	return newRibbon(eureka, true), nil
+}
+
+func newRibbon(eureka *Eureka, ownsEureka bool) *Ribbon {
 	ribbon := &Ribbon{
-		eureka: eureka,
-		rwLock: new(sync.RWMutex),
+		eureka:       eureka,
+		ownsEureka:   ownsEureka,
+		rwLock:       new(sync.RWMutex),
+		instanceInfo: map[string]*instanceChooser{},
+		rules:        map[string]IRule{},
+		newRule:      func() IRule { return &RoundRobinRule{} },
+		stats:        NewLoadBalancerStats(),
+		dead:         map[string]bool{},
+		now:          time.Now,
 	}
-	eureka.updateSubscriber = ribbon.onApplicationsUpdate
+	ribbon.unsubscribe = eureka.Subscribe(ribbon.onRegistryEvent)
 	return ribbon
 }
 
-func (r *Ribbon) GetApplicationInstance(applicationName string) (*ApplicationInstance, bool) {
+// GetApplicationInstance chooses an instance of the application the filter accepts, key identifies the request
+// for the sticky rules like ConsistentHashRule and may be empty
+func (r *Ribbon) GetApplicationInstance(applicationName string, key string) (*ApplicationInstance, bool) {
 	r.rwLock.RLock()
 	defer r.rwLock.RUnlock()
 
+	appId, chooser, exist := r.chooserOf(applicationName)
+	if exist && ejectionOver(chooser, r.now()) {
+		// upgrade the lock to bring the instance back. The registry may replace the chooser while
+		// no lock is held, it is looked up again under each lock
+		r.rwLock.RUnlock()
+		r.rwLock.Lock()
+		if chooser, exist = r.instanceInfo[appId]; exist && ejectionOver(chooser, r.now()) {
+			r.refreshAvailable(chooser)
+		}
+		r.rwLock.Unlock()
+		r.rwLock.RLock()
+		chooser, exist = r.instanceInfo[appId]
+	}
+	if !exist || len(chooser.available) == 0 {
+		return nil, false
+	}
+	return chooser.rule.Choose(key, chooser.available, r.stats), true
+}
+
+// chooserOf finds the chooser of the application whatever the case of its name. Requires the lock
+func (r *Ribbon) chooserOf(applicationName string) (string, *instanceChooser, bool) {
+	if chooser, exist := r.instanceInfo[applicationName]; exist {
+		return applicationName, chooser, true
+	}
 	for appId, chooser := range r.instanceInfo {
 		if strings.EqualFold(appId, applicationName) {
-			return chooser.next(), true
+			return appId, chooser, true
 		}
 	}
+	return "", nil, false
+}
 
-	return nil, false
+// ejectionOver tells whether an instance ejected from chooser may take traffic again
+func ejectionOver(chooser *instanceChooser, now time.Time) bool {
+	return !chooser.availableUntil.IsZero() && !now.Before(chooser.availableUntil)
+}
+
+// SetRule makes the application balance its requests with rule, rule must not be shared with other applications
+func (r *Ribbon) SetRule(applicationName string, rule IRule) {
+	r.rwLock.Lock()
+	defer r.rwLock.Unlock()
+
+	r.rules[strings.ToUpper(applicationName)] = rule
+	for appId, chooser := range r.instanceInfo {
+		if strings.EqualFold(appId, applicationName) {
+			chooser.rule = rule
+		}
+	}
+}
+
+// SetDefaultRule sets how the rule of the applications without SetRule is created, RoundRobinRule by default
+func (r *Ribbon) SetDefaultRule(newRule func() IRule) {
+	r.rwLock.Lock()
+	defer r.rwLock.Unlock()
+	r.newRule = newRule
+}
+
+// ServerStats lets the caller report the requests it sends to the instance, the rules decide from them
+func (r *Ribbon) ServerStats(instance *ApplicationInstance) *ServerStats {
+	return r.stats.ServerStats(instance.InstanceId)
+}
+
+// ruleOf returns the rule of the application, creating it if needed. Requires the write lock
+func (r *Ribbon) ruleOf(applicationName string) IRule {
+	key := strings.ToUpper(applicationName)
+	rule, exist := r.rules[key]
+	if !exist {
+		rule = r.newRule()
+		r.rules[key] = rule
+	}
+	return rule
 }
 
 func (r *Ribbon) Start() error {
+	if !r.ownsEureka {
+		return nil
+	}
 	return r.eureka.Start()
 }
 
+// Stop stops following the registry and pinging, and stops eureka if the ribbon created it
 func (r *Ribbon) Stop() {
-	r.eureka.Stop()
-}
-
-func (r *Ribbon) onApplicationsUpdate(applications ApplicationType) {
-	instanceInfo := make(map[string]*instanceChooser)
-	for applicationName, applicationInfo := range applications {
-		instances := make([]ApplicationInstance, 0, len(applicationInfo))
-		for _, instanceDto := range applicationInfo {
-			instances = append(instances, ApplicationInstance{
-				InstanceId: instanceDto.InstanceId,
-				HostName:   instanceDto.HostName,
-				App:        instanceDto.App,
-				IpAddr:     instanceDto.IpAddr,
-				Port:       instanceDto.Port.Value,
-			})
+	r.unsubscribe()
+	r.rwLock.Lock()
+	if r.pingCancel != nil {
+		r.pingCancel()
+	}
+	r.rwLock.Unlock()
+	if r.ownsEureka {
+		r.eureka.Stop()
+	}
+}
+
+func (r *Ribbon) SetStatus(status string) error {
+	return r.eureka.SetStatus(status)
+}
+
+func (r *Ribbon) onRegistryEvent(event RegistryEvent) {
+	r.rwLock.Lock()
+	defer r.rwLock.Unlock()
+
+	switch event.Type {
+	case ApplicationAdded:
+		return
+	case ApplicationRemoved:
+		delete(r.instanceInfo, event.AppName)
+		return
+	}
+
+	var previous []ApplicationInstanceDto
+	if chooser, exist := r.instanceInfo[event.AppName]; exist {
+		previous = chooser.registered
+	}
+	registered := make([]ApplicationInstanceDto, 0, len(previous)+1)
+	for _, instance := range previous {
+		if event.Previous == nil || instance.InstanceId != event.Previous.InstanceId {
+			registered = append(registered, instance)
 		}
-		instanceInfo[applicationName] = &instanceChooser{
-			index:     0,
-			instances: instances,
+	}
+	if event.Instance != nil {
+		registered = append(registered, *event.Instance)
+	}
+	if event.Instance == nil && event.Previous != nil {
+		r.stats.remove(event.Previous.InstanceId)
+		if r.outliers != nil {
+			r.outliers.forget(event.Previous.InstanceId)
 		}
 	}
 
+	if len(registered) == 0 {
+		delete(r.instanceInfo, event.AppName)
+	} else {
+		r.instanceInfo[event.AppName] = r.newChooser(event.AppName, registered)
+	}
+	if event.Previous != nil && !r.chooses(event.AppName, event.Previous.InstanceId) {
+		r.forgetPing(event.Previous.App, event.Previous.InstanceId)
+	}
+}
+
+// SetInstanceFilter decides which of the registered instances take traffic, nil goes back to
+// the filter of eureka, see Eureka.SetInstanceFilter
+func (r *Ribbon) SetInstanceFilter(filter InstanceFilter) {
+	r.rwLock.Lock()
+	r.filter = filter
+	r.rwLock.Unlock()
+	r.RefreshFilters()
+}
+
+// RefreshFilters applies the filter again to every application, for filters changing over time like DenyList
+func (r *Ribbon) RefreshFilters() {
 	r.rwLock.Lock()
 	defer r.rwLock.Unlock()
-	r.instanceInfo = instanceInfo
+
+	for appName, chooser := range r.instanceInfo {
+		r.instanceInfo[appName] = r.newChooser(appName, chooser.registered)
+		for _, instance := range chooser.instances {
+			if !r.chooses(appName, instance.InstanceId) {
+				r.forgetPing(instance.App, instance.InstanceId)
+			}
+		}
+	}
+}
+
+// newChooser filters the registered instances of the application. Requires the write lock
+func (r *Ribbon) newChooser(appName string, registered []ApplicationInstanceDto) *instanceChooser {
+	filter := r.filter
+	if filter == nil {
+		filter = r.eureka.InstanceFilter()
+	}
+	accepted := filter.Filter(registered)
+	instances := make([]ApplicationInstance, 0, len(accepted))
+	for i := range accepted {
+		instances = append(instances, newApplicationInstance(&accepted[i]))
+	}
+
+	chooser := &instanceChooser{
+		rule:       r.ruleOf(appName),
+		registered: registered,
+		instances:  instances,
+	}
+	r.refreshAvailable(chooser)
+	return chooser
+}
+
+// chooses tells whether the instance passes the filter of its application. Requires the lock
+func (r *Ribbon) chooses(appName string, instanceId string) bool {
+	chooser, exist := r.instanceInfo[appName]
+	if !exist {
+		return false
+	}
+	for _, instance := range chooser.instances {
+		if instance.InstanceId == instanceId {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshAvailable lists the instances of chooser which may take traffic: those neither failing
+// the ping nor ejected as outliers. Requires the write lock
+func (r *Ribbon) refreshAvailable(chooser *instanceChooser) {
+	now := r.now()
+	chooser.availableUntil = time.Time{}
+	available := make([]ApplicationInstance, 0, len(chooser.instances))
+	for _, instance := range chooser.instances {
+		if r.dead[instance.InstanceId] {
+			continue
+		}
+		if r.outliers != nil {
+			if ejectedUntil := r.outliers.ejectedUntil(instance.InstanceId, now); !ejectedUntil.IsZero() {
+				if chooser.availableUntil.IsZero() || ejectedUntil.Before(chooser.availableUntil) {
+					chooser.availableUntil = ejectedUntil
+				}
+				continue
+			}
+		}
+		available = append(available, instance)
+	}
+
+	// keep the same slice when nothing is excluded, or when everything is: better try a
+	// failing instance than none, and the rules keep their state for the same slice
+	if len(available) == len(chooser.instances) || len(available) == 0 {
+		available = chooser.instances
+	}
+	if sameInstanceIds(available, chooser.available) {
+		return
+	}
+	chooser.available = available
+}
+
+func sameInstanceIds(a, b []ApplicationInstance) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].InstanceId != b[i].InstanceId {
+			return false
+		}
+	}
+	return true
+}
+
+func newApplicationInstance(instanceDto *ApplicationInstanceDto) ApplicationInstance {
+	instance := ApplicationInstance{
+		InstanceId:           instanceDto.InstanceId,
+		HostName:             instanceDto.HostName,
+		App:                  instanceDto.App,
+		IpAddr:               instanceDto.IpAddr,
+		Port:                 instanceDto.Port.Value,
+		PortEnabled:          instanceDto.Port.Enabled == "true",
+		SecurePort:           instanceDto.SecurePort.Value,
+		SecurePortEnabled:    instanceDto.SecurePort.Enabled == "true",
+		Status:               instanceDto.Status,
+		Overriddenstatus:     instanceDto.Overriddenstatus,
+		VipAddress:           instanceDto.VipAddress,
+		SecureVipAddress:     instanceDto.SecureVipAddress,
+		HomePageUrl:          instanceDto.HomePageUrl,
+		StatusPageUrl:        instanceDto.StatusPageUrl,
+		HealthCheckUrl:       instanceDto.HealthCheckUrl,
+		Metadata:             instanceDto.Metadata,
+		DataCenterInfo:       instanceDto.DataCenterInfo,
+		LastUpdatedTimestamp: instanceDto.LastUpdatedTimestamp,
+	}
+	if instanceDto.LeaseInfo != nil {
+		instance.LeaseInfo = *instanceDto.LeaseInfo
+	}
+	return instance
 }
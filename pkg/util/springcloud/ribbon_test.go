@@ -1,52 +1,67 @@
 package springcloud
 
-import "testing"
+import (
+	"gin-demo/pkg/util/springcloud/eurekatest"
+	"testing"
+)
 
 func TestRibbon_GetApplicationInstance(t *testing.T) {
-	ribbon := NewRibbon("http://localhost:1111/eureka/", "gin-demo", 30, true, true)
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-1", "10.0.0.1", 8080))
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-2", "10.0.0.2", 8080))
+
+	ribbon := NewRibbon(server.ServiceUrl(), "gin-demo", 30, true, true)
 	if err := ribbon.Start(); err != nil {
 		t.Fatal("ribbon start failed: ", err)
 	}
+	defer ribbon.Stop()
 
-	instance, exist := ribbon.GetApplicationInstance("demo-v1")
-	if exist {
+	expected := []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.2"}
+	for _, expectedIpAddr := range expected {
+		instance, exist := ribbon.GetApplicationInstance("demo-v1", "")
+		if !exist {
+			t.Fatal("application not found")
+		}
 		t.Log("ip: ", instance.IpAddr, ", port: ", instance.Port)
-	} else {
-		t.Error("application not found")
+		if instance.IpAddr != expectedIpAddr {
+			t.Fatalf("wrong instance, expected:%s, actual:%s", expectedIpAddr, instance.IpAddr)
+		}
 	}
 
-	instance, exist = ribbon.GetApplicationInstance("demo-v1")
-	if exist {
-		t.Log("ip: ", instance.IpAddr, ", port: ", instance.Port)
-	} else {
-		t.Error("application not found")
+	if _, exist := ribbon.GetApplicationInstance("demo-v2", ""); exist {
+		t.Fatal("unknown application found")
 	}
+}
 
-	instance, exist = ribbon.GetApplicationInstance("demo-v1")
-	if exist {
-		t.Log("ip: ", instance.IpAddr, ", port: ", instance.Port)
-	} else {
-		t.Error("application not found")
-	}
+func TestNewRibbonWithEureka(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-1", "10.0.0.1", 8080))
 
-	instance, exist = ribbon.GetApplicationInstance("demo-v1")
-	if exist {
-		t.Log("ip: ", instance.IpAddr, ", port: ", instance.Port)
-	} else {
-		t.Error("application not found")
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, true, true)
+	eureka.HostName = "demo-host"
+	if err := eureka.Start(); err != nil {
+		t.Fatal("eureka start failed: ", err)
 	}
+	defer eureka.Stop()
 
-	instance, exist = ribbon.GetApplicationInstance("demo-v1")
-	if exist {
-		t.Log("ip: ", instance.IpAddr, ", port: ", instance.Port)
-	} else {
-		t.Error("application not found")
+	// created after the start, the ribbon still sees the registry
+	ribbon := NewRibbonWithEureka(eureka)
+	if err := ribbon.Start(); err != nil {
+		t.Fatal("ribbon start failed: ", err)
+	}
+	if instance, exist := ribbon.GetApplicationInstance("demo-v1", ""); !exist || instance.IpAddr != "10.0.0.1" {
+		t.Fatal("instance not found through the shared eureka")
 	}
 
-	instance, exist = ribbon.GetApplicationInstance("demo-v1")
-	if exist {
-		t.Log("ip: ", instance.IpAddr, ", port: ", instance.Port)
-	} else {
-		t.Error("application not found")
+	ribbon.Stop()
+	select {
+	case <-eureka.Done():
+		t.Fatal("the ribbon stopped the shared eureka")
+	default:
+	}
+	if count := countRequests(server, "POST /eureka/apps/GIN-DEMO"); count != 1 {
+		t.Fatalf("wrong registration count, expected:%d, actual:%d", 1, count)
 	}
 }
@@ -0,0 +1,155 @@
+package springcloud
+
+import (
+	"github.com/pkg/errors"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// IRule picks the instance a request goes to among the UP instances of an application,
+// like the rules of netflix ribbon. A rule serves a single application and may keep state,
+// Choose is called concurrently and instances is never empty. key identifies the request
+// for the sticky rules, it may be empty
+type IRule interface {
+	Choose(key string, instances []ApplicationInstance, stats *LoadBalancerStats) *ApplicationInstance
+}
+
+const (
+	RoundRobinRuleName        = "RoundRobinRule"
+	RandomRuleName            = "RandomRule"
+	WeightedRuleName          = "WeightedRule"
+	LeastActiveRuleName       = "LeastActiveRule"
+	BestAvailableRuleName     = "BestAvailableRule"
+	PowerOfTwoChoicesRuleName = "PowerOfTwoChoicesRule"
+	ConsistentHashRuleName    = "ConsistentHashRule"
+
+	// WeightMetadataKey is the instance metadata read by WeightedRule, 1 when missing or invalid
+	WeightMetadataKey = "weight"
+)
+
+// ruleFactories creates the rules by name, each application gets its own rule
+var ruleFactories = map[string]func() IRule{
+	RoundRobinRuleName:        func() IRule { return &RoundRobinRule{} },
+	RandomRuleName:            func() IRule { return RandomRule{} },
+	WeightedRuleName:          func() IRule { return WeightedRule{} },
+	LeastActiveRuleName:       func() IRule { return LeastActiveRule{} },
+	BestAvailableRuleName:     func() IRule { return &BestAvailableRule{} },
+	PowerOfTwoChoicesRuleName: func() IRule { return PowerOfTwoChoicesRule{} },
+	ConsistentHashRuleName:    func() IRule { return NewConsistentHashRule(defaultVirtualNodes) },
+}
+
+// NewRule creates a rule from its name, e.g. for configuration files
+func NewRule(name string) (IRule, error) {
+	factory, exist := ruleFactories[name]
+	if !exist {
+		return nil, errors.Errorf("unknown load balancing rule:%s", name)
+	}
+	return factory(), nil
+}
+
+// RoundRobinRule takes the instances in turn, it is the default
+type RoundRobinRule struct {
+	counter uint64
+}
+
+func (rule *RoundRobinRule) Choose(key string, instances []ApplicationInstance, stats *LoadBalancerStats) *ApplicationInstance {
+	next := atomic.AddUint64(&rule.counter, 1) - 1
+	return &instances[next%uint64(len(instances))]
+}
+
+type RandomRule struct{}
+
+func (RandomRule) Choose(key string, instances []ApplicationInstance, stats *LoadBalancerStats) *ApplicationInstance {
+	return &instances[rand.Intn(len(instances))]
+}
+
+// WeightedRule picks at random, in proportion to the weight in the metadata of the instances
+type WeightedRule struct{}
+
+func (WeightedRule) Choose(key string, instances []ApplicationInstance, stats *LoadBalancerStats) *ApplicationInstance {
+	total := 0
+	for i := range instances {
+		total += weightOf(&instances[i])
+	}
+	if total == 0 {
+		return RandomRule{}.Choose(key, instances, stats)
+	}
+
+	target := rand.Intn(total)
+	for i := range instances {
+		target -= weightOf(&instances[i])
+		if target < 0 {
+			return &instances[i]
+		}
+	}
+	return &instances[len(instances)-1]
+}
+
+func weightOf(instance *ApplicationInstance) int {
+	weight, err := strconv.Atoi(instance.Metadata[WeightMetadataKey])
+	if err != nil || weight < 0 {
+		return 1
+	}
+	return weight
+}
+
+// LeastActiveRule picks the instance with the fewest requests in flight,
+// starting from a random one so that the ties are spread
+type LeastActiveRule struct{}
+
+func (LeastActiveRule) Choose(key string, instances []ApplicationInstance, stats *LoadBalancerStats) *ApplicationInstance {
+	return leastActive(instances, stats, time.Time{})
+}
+
+// BestAvailableRule is LeastActiveRule skipping the instances whose circuit is tripped,
+// it falls back to round robin when all of them are
+type BestAvailableRule struct {
+	fallback RoundRobinRule
+}
+
+func (rule *BestAvailableRule) Choose(key string, instances []ApplicationInstance, stats *LoadBalancerStats) *ApplicationInstance {
+	if chosen := leastActive(instances, stats, time.Now()); chosen != nil {
+		return chosen
+	}
+	return rule.fallback.Choose(key, instances, stats)
+}
+
+// leastActive skips the tripped instances unless now is zero, it returns nil if all are skipped
+func leastActive(instances []ApplicationInstance, stats *LoadBalancerStats, now time.Time) *ApplicationInstance {
+	var chosen *ApplicationInstance
+	var minActiveRequests int64
+	offset := rand.Intn(len(instances))
+	for i := range instances {
+		instance := &instances[(offset+i)%len(instances)]
+		serverStats := stats.ServerStats(instance.InstanceId)
+		if !now.IsZero() && serverStats.CircuitTripped(now) {
+			continue
+		}
+		if activeRequests := serverStats.ActiveRequests(); chosen == nil || activeRequests < minActiveRequests {
+			chosen, minActiveRequests = instance, activeRequests
+		}
+	}
+	return chosen
+}
+
+// PowerOfTwoChoicesRule picks two instances at random and keeps the one with fewer requests in flight
+type PowerOfTwoChoicesRule struct{}
+
+func (PowerOfTwoChoicesRule) Choose(key string, instances []ApplicationInstance, stats *LoadBalancerStats) *ApplicationInstance {
+	if len(instances) == 1 {
+		return &instances[0]
+	}
+
+	first := rand.Intn(len(instances))
+	second := rand.Intn(len(instances) - 1)
+	if second >= first {
+		second++
+	}
+	a, b := &instances[first], &instances[second]
+	if stats.ServerStats(b.InstanceId).ActiveRequests() < stats.ServerStats(a.InstanceId).ActiveRequests() {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,186 @@
+package springcloud
+
+import (
+	"gin-demo/pkg/util/springcloud/eurekatest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newInstances(count int) []ApplicationInstance {
+	instances := make([]ApplicationInstance, count)
+	for i := range instances {
+		instances[i] = ApplicationInstance{InstanceId: "demo-" + strconv.Itoa(i), Metadata: map[string]string{}}
+	}
+	return instances
+}
+
+func countChoices(rule IRule, instances []ApplicationInstance, stats *LoadBalancerStats, times int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < times; i++ {
+		counts[rule.Choose("", instances, stats).InstanceId]++
+	}
+	return counts
+}
+
+func TestNewRule(t *testing.T) {
+	for name := range ruleFactories {
+		if _, err := NewRule(name); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	if _, err := NewRule("NoSuchRule"); err == nil {
+		t.Error("expect an error for an unknown rule")
+	}
+}
+
+func TestRoundRobinRule(t *testing.T) {
+	instances := newInstances(3)
+	rule := &RoundRobinRule{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				rule.Choose("", instances, nil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	counts := countChoices(rule, instances, nil, 300)
+	for _, instance := range instances {
+		if counts[instance.InstanceId] != 100 {
+			t.Fatalf("uneven round robin: %v", counts)
+		}
+	}
+}
+
+func TestRandomRule(t *testing.T) {
+	instances := newInstances(3)
+	counts := countChoices(RandomRule{}, instances, nil, 300)
+	if len(counts) != 3 {
+		t.Fatalf("not every instance chosen: %v", counts)
+	}
+}
+
+func TestWeightedRule(t *testing.T) {
+	instances := newInstances(3)
+	instances[0].Metadata[WeightMetadataKey] = "3"
+	instances[1].Metadata[WeightMetadataKey] = "0"
+	instances[2].Metadata[WeightMetadataKey] = "invalid" // counts as 1
+
+	counts := countChoices(WeightedRule{}, instances, nil, 4000)
+	if counts["demo-1"] != 0 {
+		t.Fatalf("an instance of weight 0 was chosen: %v", counts)
+	}
+	if counts["demo-0"] < 2700 || counts["demo-0"] > 3300 {
+		t.Fatalf("choices not in proportion to the weights: %v", counts)
+	}
+}
+
+func TestLeastActiveRule(t *testing.T) {
+	instances := newInstances(3)
+	stats := NewLoadBalancerStats()
+	stats.ServerStats("demo-0").IncrementActiveRequests()
+	stats.ServerStats("demo-2").IncrementActiveRequests()
+	stats.ServerStats("demo-2").IncrementActiveRequests()
+
+	counts := countChoices(LeastActiveRule{}, instances, stats, 100)
+	if counts["demo-1"] != 100 {
+		t.Fatalf("expect the idle instance, got %v", counts)
+	}
+}
+
+func TestBestAvailableRule(t *testing.T) {
+	instances := newInstances(2)
+	stats := NewLoadBalancerStats()
+	for i := 0; i < connectionFailureThreshold; i++ {
+		stats.ServerStats("demo-0").NoteConnectionFailure()
+	}
+	stats.ServerStats("demo-1").IncrementActiveRequests()
+
+	rule := &BestAvailableRule{}
+	if counts := countChoices(rule, instances, stats, 100); counts["demo-1"] != 100 {
+		t.Fatalf("expect the tripped instance to be skipped, got %v", counts)
+	}
+
+	// all tripped: round robin
+	for i := 0; i < connectionFailureThreshold; i++ {
+		stats.ServerStats("demo-1").NoteConnectionFailure()
+	}
+	if counts := countChoices(rule, instances, stats, 100); counts["demo-0"] != 50 || counts["demo-1"] != 50 {
+		t.Fatalf("expect round robin when all are tripped, got %v", counts)
+	}
+}
+
+func TestPowerOfTwoChoicesRule(t *testing.T) {
+	instances := newInstances(2)
+	stats := NewLoadBalancerStats()
+	stats.ServerStats("demo-0").IncrementActiveRequests()
+
+	// with two instances, both are always compared
+	if counts := countChoices(PowerOfTwoChoicesRule{}, instances, stats, 100); counts["demo-1"] != 100 {
+		t.Fatalf("expect the less loaded instance, got %v", counts)
+	}
+	if chosen := (PowerOfTwoChoicesRule{}).Choose("", instances[:1], stats); chosen.InstanceId != "demo-0" {
+		t.Fatalf("expect the only instance, got %s", chosen.InstanceId)
+	}
+}
+
+func TestServerStats_CircuitTripped(t *testing.T) {
+	stats := &ServerStats{}
+	now := time.Now()
+	for i := 0; i < connectionFailureThreshold-1; i++ {
+		stats.NoteConnectionFailure()
+	}
+	if stats.CircuitTripped(now) {
+		t.Fatal("tripped below the threshold")
+	}
+
+	stats.NoteConnectionFailure()
+	if !stats.CircuitTripped(time.Now()) || stats.CircuitTripped(time.Now().Add(11*time.Second)) {
+		t.Fatal("expect a 10s blackout after the threshold")
+	}
+	stats.NoteConnectionFailure()
+	if !stats.CircuitTripped(time.Now().Add(11 * time.Second)) {
+		t.Fatal("expect the blackout to double")
+	}
+
+	stats.NoteSuccess()
+	if stats.CircuitTripped(time.Now()) {
+		t.Fatal("a success resets the circuit")
+	}
+}
+
+func TestRibbon_SetRule(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-1", "10.0.0.1", 8080))
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-2", "10.0.0.2", 8080))
+	down := eurekatest.NewInstance("demo-v1", "demo-v1-3", "10.0.0.3", 8080)
+	down.Status = StatusDown
+	server.Register(down)
+
+	ribbon := NewRibbon(server.ServiceUrl(), "gin-demo", 30, false, true)
+	if err := ribbon.Start(); err != nil {
+		t.Fatal("ribbon start failed: ", err)
+	}
+	defer ribbon.Stop()
+
+	instance, _ := ribbon.GetApplicationInstance("demo-v1", "")
+	ribbon.ServerStats(instance).IncrementActiveRequests()
+	ribbon.SetRule("demo-v1", LeastActiveRule{})
+	for i := 0; i < 10; i++ {
+		chosen, exist := ribbon.GetApplicationInstance("demo-v1", "")
+		if !exist {
+			t.Fatal("application not found")
+		}
+		if chosen.InstanceId == instance.InstanceId || chosen.InstanceId == "demo-v1-3" {
+			t.Fatalf("wrong instance chosen: %s", chosen.InstanceId)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package springcloud
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// clock is the source of time for the scheduled tasks, tests replace it to control the timing
+type clock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// timedTask runs task every interval until the context is cancelled. While the task fails,
+// the delay is doubled up to interval*backoffBound and randomized, so that clients failing
+// together do not retry together
+type timedTask struct {
+	interval     time.Duration
+	backoffBound int
+	task         func() error
+	clock        clock
+	random       func() float64 // [0, 1)
+}
+
+func (t *timedTask) run(ctx context.Context) {
+	delay := t.interval
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.clock.After(delay):
+		}
+
+		if err := t.task(); err != nil {
+			failures++
+			delay = t.backoff(failures)
+		} else {
+			failures = 0
+			delay = t.interval
+		}
+	}
+}
+
+// backoff returns the delay after the given number of consecutive failures
+func (t *timedTask) backoff(failures int) time.Duration {
+	maxDelay := t.interval * time.Duration(t.backoffBound)
+	delay := t.interval
+	for i := 0; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	// keep at least half of the delay, randomize the other half
+	return delay/2 + time.Duration(t.random()*float64(delay/2))
+}
+
+func defaultRandom() float64 {
+	return rand.Float64()
+}
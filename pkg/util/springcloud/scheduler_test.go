@@ -0,0 +1,101 @@
+package springcloud
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves forward when Advance is called, every delay asked for is reported on delays
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+	delays chan time.Duration
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Unix(0, 0),
+		delays: make(chan time.Duration, 16),
+	}
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	timer := fakeTimer{deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	c.lock.Unlock()
+
+	c.delays <- d
+	return timer.c
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.deadline.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+func TestTimedTask_Backoff(t *testing.T) {
+	results := []error{errors.New("1"), errors.New("2"), errors.New("3"), errors.New("4"), nil}
+	calls := 0
+	clock := newFakeClock()
+	task := &timedTask{
+		interval:     10 * time.Second,
+		backoffBound: 4,
+		task: func() error {
+			result := results[calls]
+			calls++
+			return result
+		},
+		clock:  clock,
+		random: func() float64 { return 0.5 },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		task.run(ctx)
+		close(done)
+	}()
+
+	// delays are 3/4 of the backoff because of the fixed jitter, and capped at 40s
+	expected := []time.Duration{10 * time.Second, 15 * time.Second, 30 * time.Second, 30 * time.Second, 30 * time.Second, 10 * time.Second}
+	for i, expectedDelay := range expected {
+		delay := <-clock.delays
+		if delay != expectedDelay {
+			t.Fatalf("wrong delay %d, expected:%s, actual:%s", i, expectedDelay, delay)
+		}
+		if i < len(expected)-1 {
+			clock.Advance(delay)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("task not stopped by its context")
+	}
+	if calls != len(results) {
+		t.Fatalf("wrong call count, expected:%d, actual:%d", len(results), calls)
+	}
+}
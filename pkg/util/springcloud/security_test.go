@@ -0,0 +1,131 @@
+package springcloud
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"gin-demo/pkg/util/springcloud/eurekatest"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writePem saves the DER blocks of the given type to a new file in dir
+func writePem(t *testing.T, dir, name, blockType string, der []byte) string {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// newClientCertificate creates a self-signed client certificate, it is its own CA
+func newClientCertificate(t *testing.T) (certificate *x509.Certificate, certDer, keyDer []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gin-demo"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certDer, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ = x509.ParseCertificate(certDer)
+	keyDer, err = x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, certDer, keyDer
+}
+
+func TestEureka_BasicAuth(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.RequireAuthorization("Basic " + base64.StdEncoding.EncodeToString([]byte("eureka:s3cret")))
+
+	serviceUrl := strings.Replace(server.ServiceUrl(), "http://", "http://eureka:s3cret@", 1)
+	eureka := NewEureka(serviceUrl, "gin-demo", 30, true, true)
+	eureka.HostName = "demo-host"
+	if err := eureka.Start(); err != nil {
+		t.Fatal("eureka start failed: ", err)
+	}
+	if err := eureka.renew(); err != nil {
+		t.Fatal("renew failed: ", err)
+	}
+	eureka.Stop()
+	if _, exist := server.Instance("gin-demo", "demo-host:gin-demo:8080"); exist {
+		t.Fatal("instance not cancelled")
+	}
+
+	wrongPassword := NewEureka(strings.Replace(serviceUrl, "s3cret", "wrong", 1), "gin-demo", 30, false, true)
+	if _, err := wrongPassword.GetApplications(); err == nil {
+		t.Fatal("expect an error with the wrong password")
+	} else if strings.Contains(err.Error(), "wrong") {
+		t.Fatal("the password leaked in the error: ", err)
+	}
+}
+
+func TestEureka_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clientCertificate, certDer, keyDer := newClientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCertificate)
+	server := eurekatest.NewTLSServer(clientCAs)
+	defer server.Close()
+	server.RequireAuthorization("Bearer t0ken")
+
+	security := SecurityConfig{
+		BearerToken: "t0ken",
+		CAFile:      writePem(t, dir, "ca.pem", "CERTIFICATE", server.Certificate().Raw),
+		CertFile:    writePem(t, dir, "client.pem", "CERTIFICATE", certDer),
+		KeyFile:     writePem(t, dir, "client-key.pem", "EC PRIVATE KEY", keyDer),
+	}
+
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, true, true)
+	eureka.HostName = "demo-host"
+	if err := eureka.SetSecurity(security); err != nil {
+		t.Fatal("invalid security config: ", err)
+	}
+	if err := eureka.Start(); err != nil {
+		t.Fatal("eureka start failed: ", err)
+	}
+	defer eureka.Stop()
+	if _, exist := server.Instance("gin-demo", "demo-host:gin-demo:8080"); !exist {
+		t.Fatal("instance not registered over TLS")
+	}
+
+	// no client certificate
+	withoutCertificate := NewEureka(server.ServiceUrl(), "gin-demo", 30, false, true)
+	if err := withoutCertificate.SetSecurity(SecurityConfig{BearerToken: "t0ken", CAFile: security.CAFile}); err != nil {
+		t.Fatal("invalid security config: ", err)
+	}
+	if _, err := withoutCertificate.GetApplications(); err == nil {
+		t.Fatal("expect an error without a client certificate")
+	}
+
+	if err := eureka.SetSecurity(SecurityConfig{CAFile: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Fatal("expect an error for a missing CA bundle")
+	}
+}
@@ -0,0 +1,103 @@
+package springcloud
+
+import (
+	"gin-demo/pkg/util/jsonlib"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var registryStale = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "eureka_registry_stale",
+	Help: "Whether the registry is served from the snapshot because no eureka server was reachable yet",
+}, []string{"snapshot"})
+
+// snapshotRefreshInterval bounds the age of the snapshot while the apps hashcode stays the same,
+// the hashcode only counts the instances per status and misses an instance replaced by another
+const snapshotRefreshInterval = 5 * time.Minute
+
+// registrySnapshot is the content of the snapshot file
+type registrySnapshot struct {
+	// SavedAt tells how old the registry is, see SnapshotMaxAge
+	SavedAt      time.Time       `json:"savedAt"`
+	Applications ApplicationType `json:"applications"`
+}
+
+// saveSnapshotIfChanged saves the registry when its apps hashcode changed since the last snapshot,
+// or when the last snapshot is older than snapshotRefreshInterval. A failed write only costs the
+// next cold start, the fetch itself went fine
+func (e *Eureka) saveSnapshotIfChanged(applications ApplicationType) {
+	hashCode := reconcileHashCode(applications)
+	now := time.Now()
+	e.rwLock.RLock()
+	unchanged := hashCode == e.snapshotHashCode && now.Sub(e.snapshotSavedAt) < snapshotRefreshInterval
+	e.rwLock.RUnlock()
+	if unchanged {
+		return
+	}
+
+	if err := e.saveSnapshot(applications, now); err != nil {
+		return
+	}
+	e.rwLock.Lock()
+	e.snapshotHashCode = hashCode
+	e.snapshotSavedAt = now
+	e.rwLock.Unlock()
+}
+
+// saveSnapshot replaces the snapshot file, through a rename so that a crash never leaves half a file
+func (e *Eureka) saveSnapshot(applications ApplicationType, savedAt time.Time) error {
+	data, err := jsonlib.Marshal(&registrySnapshot{SavedAt: savedAt, Applications: applications})
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(e.SnapshotFile), filepath.Base(e.SnapshotFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), e.SnapshotFile)
+}
+
+// loadSnapshot serves the registry of the snapshot file as stale until the next successful fetch
+func (e *Eureka) loadSnapshot() error {
+	data, err := ioutil.ReadFile(e.SnapshotFile)
+	if err != nil {
+		return err
+	}
+	var snapshot registrySnapshot
+	if err := jsonlib.Unmarshal(data, &snapshot); err != nil {
+		return errors.Errorf("invalid registry snapshot %s:%s", e.SnapshotFile, err)
+	}
+	if age := time.Since(snapshot.SavedAt); e.SnapshotMaxAge > 0 && age > e.SnapshotMaxAge {
+		return errors.Errorf("registry snapshot %s is too old, saved %s ago", e.SnapshotFile, age.Round(time.Second))
+	}
+
+	e.rwLock.Lock()
+	e.Applications = snapshot.Applications
+	e.stale = true
+	e.rwLock.Unlock()
+	registryStale.WithLabelValues(e.SnapshotFile).Set(1)
+
+	e.publish(snapshot.Applications)
+	return nil
+}
+
+// Stale tells whether the registry comes from the snapshot, no eureka server has answered since the start
+func (e *Eureka) Stale() bool {
+	e.rwLock.RLock()
+	defer e.rwLock.RUnlock()
+	return e.stale
+}
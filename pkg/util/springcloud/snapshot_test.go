@@ -0,0 +1,173 @@
+package springcloud
+
+import (
+	"gin-demo/pkg/util/jsonlib"
+	"gin-demo/pkg/util/springcloud/eurekatest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEureka_Snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotFile := filepath.Join(dir, "registry.json")
+
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-1", "10.0.0.1", 8080))
+
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, false, true)
+	eureka.SnapshotFile = snapshotFile
+	if _, err := eureka.GetApplications(); err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+	if _, err := os.Stat(snapshotFile); err != nil {
+		t.Fatal("snapshot not saved: ", err)
+	}
+
+	// eureka is down at the start, the registry comes from the snapshot
+	server.InjectFault(eurekatest.Fault{DropConnection: true})
+	coldStart := NewEureka(server.ServiceUrl(), "gin-demo", 30, true, true)
+	coldStart.HostName = "demo-host"
+	coldStart.SnapshotFile = snapshotFile
+	if err := coldStart.Start(); err != nil {
+		t.Fatal("eureka start failed despite the snapshot: ", err)
+	}
+	defer coldStart.Stop()
+	if !coldStart.Stale() {
+		t.Fatal("a registry from the snapshot should be stale")
+	}
+	if instances, exist := coldStart.GetApplication("demo-v1"); !exist || instances[0].InstanceId != "demo-v1-1" {
+		t.Fatalf("instance not loaded from the snapshot: %+v", instances)
+	}
+
+	// eureka is back, the background tasks catch up
+	server.ClearFaults()
+	if _, err := coldStart.GetApplications(); err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+	if err := coldStart.heartbeat(); err != nil {
+		t.Fatal("heartbeat failed: ", err)
+	}
+	if coldStart.Stale() {
+		t.Fatal("the registry is fresh after a successful fetch")
+	}
+	if _, exist := server.Instance("gin-demo", "demo-host:gin-demo:8080"); !exist {
+		t.Fatal("instance not registered once eureka is back")
+	}
+}
+
+func TestEureka_StartWithoutSnapshot(t *testing.T) {
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.InjectFault(eurekatest.Fault{DropConnection: true})
+
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, false, true)
+	eureka.SnapshotFile = filepath.Join(os.TempDir(), "no-such-snapshot.json")
+	if err := eureka.Start(); err == nil {
+		eureka.Stop()
+		t.Fatal("expect an error without eureka and snapshot")
+	}
+}
+
+func TestEureka_SnapshotOnlyOnChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.Register(eurekatest.NewInstance("demo-v1", "demo-v1-1", "10.0.0.1", 8080))
+
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, false, true)
+	eureka.SnapshotFile = filepath.Join(dir, "registry.json")
+	savedAt := func() time.Time {
+		data, err := ioutil.ReadFile(eureka.SnapshotFile)
+		if err != nil {
+			t.Fatal("snapshot not saved: ", err)
+		}
+		var snapshot registrySnapshot
+		if err := jsonlib.Unmarshal(data, &snapshot); err != nil {
+			t.Fatal("invalid snapshot: ", err)
+		}
+		return snapshot.SavedAt
+	}
+
+	if _, err := eureka.GetApplications(); err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+	first := savedAt()
+
+	// the same registry is not written again
+	if _, err := eureka.GetApplications(); err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+	if second := savedAt(); !second.Equal(first) {
+		t.Fatalf("snapshot saved again without any change, first:%s, second:%s", first, second)
+	}
+
+	// a status change alters the hashcode
+	server.SetStatus("demo-v1", "demo-v1-1", StatusDown)
+	if _, err := eureka.GetApplications(); err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+	if third := savedAt(); third.Equal(first) {
+		t.Fatal("snapshot not saved after a change")
+	}
+
+	// and an unchanged registry is still saved once the snapshot gets old
+	eureka.snapshotSavedAt = eureka.snapshotSavedAt.Add(-snapshotRefreshInterval)
+	before := savedAt()
+	if _, err := eureka.GetApplications(); err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+	if refreshed := savedAt(); refreshed.Equal(before) {
+		t.Fatal("old snapshot not refreshed")
+	}
+}
+
+func TestEureka_SnapshotMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := eurekatest.NewServer()
+	defer server.Close()
+	server.InjectFault(eurekatest.Fault{DropConnection: true})
+
+	eureka := NewEureka(server.ServiceUrl(), "gin-demo", 30, false, true)
+	eureka.SnapshotFile = filepath.Join(dir, "registry.json")
+	eureka.SnapshotMaxAge = time.Hour
+	applications := ApplicationType{"DEMO-V1": {{InstanceId: "demo-v1-1", App: "DEMO-V1", Status: StatusUp}}}
+	if err := eureka.saveSnapshot(applications, time.Now().Add(-2*time.Hour)); err != nil {
+		t.Fatal("failed to save snapshot: ", err)
+	}
+	if err := eureka.Start(); err == nil {
+		eureka.Stop()
+		t.Fatal("expect an error with a snapshot older than SnapshotMaxAge")
+	}
+
+	recent := NewEureka(server.ServiceUrl(), "gin-demo", 30, false, true)
+	recent.SnapshotFile = eureka.SnapshotFile
+	recent.SnapshotMaxAge = time.Hour
+	if err := recent.saveSnapshot(applications, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal("failed to save snapshot: ", err)
+	}
+	if err := recent.Start(); err != nil {
+		t.Fatal("eureka start failed despite a recent snapshot: ", err)
+	}
+	defer recent.Stop()
+	if _, exist := recent.GetApplication("demo-v1"); !exist {
+		t.Fatal("instance not loaded from the snapshot")
+	}
+}
@@ -0,0 +1,100 @@
+package springcloud
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// connectionFailureThreshold successive connection failures trip the circuit of a server
+	connectionFailureThreshold = 3
+	circuitTripTimeoutFactor   = 10 * time.Second
+	maxCircuitTripTimeout      = 30 * time.Second
+)
+
+// ServerStats counts what the load balancer needs to know about an instance, it is safe for concurrent use
+type ServerStats struct {
+	activeRequests               int64
+	successiveConnectionFailures int64
+	lastConnectionFailure        int64 // unix nanoseconds
+}
+
+func (s *ServerStats) IncrementActiveRequests() {
+	atomic.AddInt64(&s.activeRequests, 1)
+}
+
+func (s *ServerStats) DecrementActiveRequests() {
+	atomic.AddInt64(&s.activeRequests, -1)
+}
+
+func (s *ServerStats) ActiveRequests() int64 {
+	return atomic.LoadInt64(&s.activeRequests)
+}
+
+// NoteConnectionFailure records that the instance could not be reached
+func (s *ServerStats) NoteConnectionFailure() {
+	atomic.StoreInt64(&s.lastConnectionFailure, time.Now().UnixNano())
+	atomic.AddInt64(&s.successiveConnectionFailures, 1)
+}
+
+// NoteSuccess records that the instance answered, whatever the answer
+func (s *ServerStats) NoteSuccess() {
+	atomic.StoreInt64(&s.successiveConnectionFailures, 0)
+}
+
+func (s *ServerStats) SuccessiveConnectionFailures() int64 {
+	return atomic.LoadInt64(&s.successiveConnectionFailures)
+}
+
+// CircuitTripped tells whether the instance is kept out after successive connection failures.
+// The blackout starts at 10s and doubles with every further failure, up to 30s, like in ribbon
+func (s *ServerStats) CircuitTripped(now time.Time) bool {
+	failures := s.SuccessiveConnectionFailures()
+	if failures < connectionFailureThreshold {
+		return false
+	}
+
+	timeout := circuitTripTimeoutFactor
+	for i := int64(connectionFailureThreshold); i < failures && timeout < maxCircuitTripTimeout; i++ {
+		timeout *= 2
+	}
+	if timeout > maxCircuitTripTimeout {
+		timeout = maxCircuitTripTimeout
+	}
+	lastFailure := time.Unix(0, atomic.LoadInt64(&s.lastConnectionFailure))
+	return now.Before(lastFailure.Add(timeout))
+}
+
+// LoadBalancerStats holds the ServerStats of the instances, by instance id
+type LoadBalancerStats struct {
+	lock    *sync.Mutex
+	servers map[string]*ServerStats
+}
+
+func NewLoadBalancerStats() *LoadBalancerStats {
+	return &LoadBalancerStats{
+		lock:    new(sync.Mutex),
+		servers: map[string]*ServerStats{},
+	}
+}
+
+// ServerStats returns the stats of the instance, created on first use
+func (s *LoadBalancerStats) ServerStats(instanceId string) *ServerStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats, exist := s.servers[instanceId]
+	if !exist {
+		stats = &ServerStats{}
+		s.servers[instanceId] = stats
+	}
+	return stats
+}
+
+// remove forgets an instance which left the registry
+func (s *LoadBalancerStats) remove(instanceId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.servers, instanceId)
+}
@@ -0,0 +1,66 @@
+package springcloud
+
+import "time"
+
+// windowBuckets divide a sliding window, the oldest bucket is dropped as a whole
+const windowBuckets = 10
+
+// callCounts are the outcomes of the calls in a bucket or a whole window
+type callCounts struct {
+	requests int
+	failures int
+	slow     int
+}
+
+func (counts *callCounts) add(failed, slow bool) {
+	counts.requests++
+	if failed {
+		counts.failures++
+	}
+	if slow {
+		counts.slow++
+	}
+}
+
+type windowBucket struct {
+	index int64 // which bucket of time it counts, older ones are reset on use
+	callCounts
+}
+
+// slidingWindow counts the calls of the last window, in windowBuckets buckets. The callers
+// hold their own lock
+type slidingWindow struct {
+	width   int64 // nanoseconds per bucket
+	buckets [windowBuckets]windowBucket
+}
+
+// newSlidingWindow needs a window of at least windowBuckets nanoseconds, the callers default
+// shorter ones
+func newSlidingWindow(window time.Duration) slidingWindow {
+	return slidingWindow{width: int64(window / windowBuckets)}
+}
+
+// add counts a call ending at now, it returns the counts of the whole window
+func (w *slidingWindow) add(now time.Time, failed, slow bool) callCounts {
+	index := now.UnixNano() / w.width
+	bucket := &w.buckets[index%windowBuckets]
+	if bucket.index != index {
+		*bucket = windowBucket{index: index}
+	}
+	bucket.add(failed, slow)
+
+	var counts callCounts
+	for _, bucket := range w.buckets {
+		if bucket.index > index-windowBuckets {
+			counts.requests += bucket.requests
+			counts.failures += bucket.failures
+			counts.slow += bucket.slow
+		}
+	}
+	return counts
+}
+
+// reset forgets every call
+func (w *slidingWindow) reset() {
+	w.buckets = [windowBuckets]windowBucket{}
+}
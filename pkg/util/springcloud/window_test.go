@@ -0,0 +1,29 @@
+package springcloud
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlidingWindow(t *testing.T) {
+	now := newFakeNow()
+	window := newSlidingWindow(10 * time.Second)
+
+	window.add(now.Now(), true, false)
+	now.Advance(5 * time.Second)
+	window.add(now.Now(), false, true)
+	if calls := window.add(now.Now(), false, false); calls != (callCounts{requests: 3, failures: 1, slow: 1}) {
+		t.Fatalf("wrong counts, actual:%+v", calls)
+	}
+
+	// the first bucket slides out of the window, the others stay
+	now.Advance(5 * time.Second)
+	if calls := window.add(now.Now(), false, false); calls != (callCounts{requests: 3, failures: 0, slow: 1}) {
+		t.Fatalf("wrong counts once the first bucket is out, actual:%+v", calls)
+	}
+
+	window.reset()
+	if calls := window.add(now.Now(), true, false); calls != (callCounts{requests: 1, failures: 1}) {
+		t.Fatalf("wrong counts after reset, actual:%+v", calls)
+	}
+}
@@ -0,0 +1,102 @@
+package springcloud
+
+import (
+	"sort"
+	"strings"
+)
+
+// ZoneConfig lists the eureka servers of a region per availability zone, like the
+// eureka.client.region, availability-zones and service-url properties of spring cloud
+type ZoneConfig struct {
+	Region string
+	// Zone is the availability zone of this instance, its servers are tried first
+	Zone string
+	// AvailabilityZones orders the zones of the region, the failover goes through
+	// the zones following Zone, wrapping around
+	AvailabilityZones []string
+	// ServiceUrls maps a zone to its comma separated server urls
+	ServiceUrls map[string]string
+}
+
+// NewEurekaWithZones creates a client which prefers the eureka servers of its own zone and only
+// talks to the other zones while they are unreachable. The zone is registered in the metadata
+func NewEurekaWithZones(zones ZoneConfig, applicationName string, registryFetchIntervalSeconds int, registerWithEureka bool, preferIpAddress bool) *Eureka {
+	serverUrls, localServers := zones.serverUrls()
+	e := NewEureka(strings.Join(serverUrls, ","), applicationName, registryFetchIntervalSeconds, registerWithEureka, preferIpAddress)
+	e.Region = zones.Region
+	e.Zone = zones.Zone
+	e.localServers = localServers
+	return e
+}
+
+// orderedZones starts with the local zone, then follows the availability zones after it,
+// the zones only found in ServiceUrls come last
+func (zones ZoneConfig) orderedZones() []string {
+	offset := 0
+	for i, zone := range zones.AvailabilityZones {
+		if zone == zones.Zone {
+			offset = i
+			break
+		}
+	}
+
+	ordered := []string{zones.Zone}
+	for i := range zones.AvailabilityZones {
+		ordered = append(ordered, zones.AvailabilityZones[(offset+i)%len(zones.AvailabilityZones)])
+	}
+
+	var unlisted []string
+	for zone := range zones.ServiceUrls {
+		unlisted = append(unlisted, zone)
+	}
+	sort.Strings(unlisted)
+	ordered = append(ordered, unlisted...)
+
+	seen := make(map[string]bool, len(ordered))
+	result := ordered[:0]
+	for _, zone := range ordered {
+		if !seen[zone] {
+			seen[zone] = true
+			result = append(result, zone)
+		}
+	}
+	return result
+}
+
+// serverUrls returns the server urls in the order they are tried, and how many of them are in the local zone
+func (zones ZoneConfig) serverUrls() ([]string, int) {
+	var serverUrls []string
+	localServers := 0
+	for _, zone := range zones.orderedZones() {
+		for _, url := range strings.Split(zones.ServiceUrls[zone], ",") {
+			if url = strings.TrimSpace(url); url == "" {
+				continue
+			}
+			serverUrls = append(serverUrls, url)
+			if zone == zones.Zone {
+				localServers++
+			}
+		}
+	}
+	return serverUrls, localServers
+}
+
+// preferLocalZone goes back to the local zone after a failover, so that the servers
+// of the other zones are only used for as long as the local ones are down
+func (e *Eureka) preferLocalZone() {
+	e.rwLock.Lock()
+	defer e.rwLock.Unlock()
+	if e.localServers > 0 && e.currentServerUrlIndex >= e.localServers {
+		e.currentServerUrlIndex = 0
+	}
+}
+
+// maxRetries lets a failover reach every server, including those of the other zones
+func (e *Eureka) maxRetries() int {
+	e.rwLock.RLock()
+	defer e.rwLock.RUnlock()
+	if len(e.serverUrls)-1 > maxRetryTimesIfFailure {
+		return len(e.serverUrls) - 1
+	}
+	return maxRetryTimesIfFailure
+}
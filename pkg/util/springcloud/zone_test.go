@@ -0,0 +1,69 @@
+package springcloud
+
+import (
+	"gin-demo/pkg/util/springcloud/eurekatest"
+	"reflect"
+	"testing"
+)
+
+func TestZoneConfig_ServerUrls(t *testing.T) {
+	zones := ZoneConfig{
+		Region:            "cn-east",
+		Zone:              "zone-b",
+		AvailabilityZones: []string{"zone-a", "zone-b", "zone-c"},
+		ServiceUrls: map[string]string{
+			"zone-a": "http://a1/eureka/",
+			"zone-b": "http://b1/eureka/, http://b2/eureka/",
+			"zone-c": "http://c1/eureka/",
+			"zone-x": "http://x1/eureka/",
+		},
+	}
+
+	serverUrls, localServers := zones.serverUrls()
+	expected := []string{"http://b1/eureka/", "http://b2/eureka/", "http://c1/eureka/", "http://a1/eureka/", "http://x1/eureka/"}
+	if !reflect.DeepEqual(serverUrls, expected) {
+		t.Fatalf("wrong server order, expected:%v, actual:%v", expected, serverUrls)
+	}
+	if localServers != 2 {
+		t.Fatalf("wrong local server count, expected:%d, actual:%d", 2, localServers)
+	}
+}
+
+func TestEureka_ZoneFailover(t *testing.T) {
+	local := eurekatest.NewServer()
+	defer local.Close()
+	remote := eurekatest.NewServer()
+	defer remote.Close()
+
+	eureka := NewEurekaWithZones(ZoneConfig{
+		Zone:              "zone-a",
+		AvailabilityZones: []string{"zone-a", "zone-b"},
+		ServiceUrls:       map[string]string{"zone-a": local.ServiceUrl(), "zone-b": remote.ServiceUrl()},
+	}, "gin-demo", 30, true, true)
+	eureka.HostName = "demo-host"
+	if err := eureka.Start(); err != nil {
+		t.Fatal("eureka start failed: ", err)
+	}
+	defer eureka.Stop()
+
+	instance, exist := local.Instance("gin-demo", "demo-host:gin-demo:8080")
+	if !exist || instance.Metadata["zone"] != "zone-a" {
+		t.Fatalf("instance not registered with its zone in the local zone: %+v", instance)
+	}
+
+	local.InjectFault(eurekatest.Fault{Method: "GET", StatusCode: 500, Count: 1})
+	if _, err := eureka.GetApplications(); err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+	if eureka.currentServer() != remote.ServiceUrl() {
+		t.Fatalf("no failover to the other zone, current server:%s", eureka.currentServer())
+	}
+
+	// back to the local zone once it answers again
+	if _, err := eureka.GetApplications(); err != nil {
+		t.Fatal("failed to get applications: ", err)
+	}
+	if eureka.currentServer() != local.ServiceUrl() {
+		t.Fatalf("not back to the local zone, current server:%s", eureka.currentServer())
+	}
+}
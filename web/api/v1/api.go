@@ -2,22 +2,153 @@ package v1
 
 import (
 	"gin-demo/pkg/controller"
+	"gin-demo/pkg/database"
+	"gin-demo/pkg/discovery"
+	"gin-demo/pkg/gateway"
+	"gin-demo/pkg/util/health"
+	"gin-demo/pkg/util/springcloud"
 	"github.com/gin-gonic/gin"
+	"path/filepath"
+	"time"
 )
 
 type Api struct {
+	// LogFilename is the log file of the application, the disk space check watches its directory
+	LogFilename string
+	Discovery   discovery.Config
+	// GatewayRules maps an application to the name of its load balancing rule, see springcloud.NewRule
+	GatewayRules map[string]string
+	// GatewayHashKey is where the key of the sticky rules comes from, e.g. header:X-User-Id
+	GatewayHashKey string
+	// GatewayPing probes the instances, "url" gets their health check url, "tcp" connects to their port
+	GatewayPing         string
+	GatewayPingInterval time.Duration
+	// GatewayOutlierDetection ejects the upstream instances failing too many requests, when not nil
+	GatewayOutlierDetection *springcloud.OutlierConfig
+	// GatewayRetry sends the failed requests again, to the same or other instances, when not nil
+	GatewayRetry *controller.RetryConfig
+	// GatewayCircuitBreaker rejects the requests to the failing applications for a while, when not nil,
+	// per instance with GatewayCircuitBreakerPerInstance
+	GatewayCircuitBreaker            *springcloud.CircuitBreakerConfig
+	GatewayCircuitBreakerPerInstance bool
+	// GatewayPathRewrites change the path forwarded to an application, see GatewayController.SetPathRewrite
+	GatewayPathRewrites map[string][]string
+	// GatewayRoutesFile declares the routes of the requests no other handler takes, and may replace
+	// the retry, circuit breaker and path rewrites above, see gateway.Config
+	GatewayRoutesFile string
+	// GatewayRoutesReloadInterval is how often the routes file is checked for changes, 0 to only
+	// reload it through admin/gateway/reload
+	GatewayRoutesReloadInterval time.Duration
+	// GatewayMetadataFilters only keep the instances with the given metadata, e.g. version=2
+	GatewayMetadataFilters []string
+	// GatewayZoneAffinity prefers the instances in the zone of this instance
+	GatewayZoneAffinity bool
+
+	registry          *discovery.Registry
+	gatewayController *controller.GatewayController
+	routesReloader    *gateway.Reloader
 }
 
 func (api *Api) Register(r *gin.Engine) {
-	userController := &controller.UserController{}
+	registry, err := discovery.NewRegistry(api.Discovery)
+	if err != nil {
+		panic("invalid discovery config: " + err.Error())
+	}
+	if err := registry.Start(); err != nil {
+		panic("eureka start failed: " + err.Error())
+	}
+	api.registry = registry
+	eureka := registry.Eureka()
+
+	userController := &controller.UserController{Database: database.Database}
 	userController.Handle(r)
 
-	eurekaController := &controller.EurekaController{}
-	eurekaController.Handle(r)
+	controller.NewEurekaController(eureka).Handle(r)
 
-	gatewayController, err := controller.NewGatewayController("http://localhost:1111/eureka/", "gin-demo")
-	if err != nil {
-		panic(err)
+	api.gatewayController = controller.NewGatewayController(eureka)
+	// on eureka, so that /eureka/apps/:appId lists the instances the gateway routes to
+	eureka.SetInstanceFilter(api.instanceFilter(eureka.Zone))
+	api.gatewayController.RefreshFilters()
+	for appId, ruleName := range api.GatewayRules {
+		rule, err := springcloud.NewRule(ruleName)
+		if err != nil {
+			panic(err)
+		}
+		api.gatewayController.SetRule(appId, rule)
+	}
+	switch api.GatewayPing {
+	case "":
+	case "url":
+		api.gatewayController.SetPing(springcloud.NewUrlPing(2*time.Second), api.GatewayPingInterval)
+	case "tcp":
+		api.gatewayController.SetPing(springcloud.TcpPing{Timeout: 2 * time.Second}, api.GatewayPingInterval)
+	default:
+		panic("unknown gateway ping: " + api.GatewayPing)
+	}
+	if api.GatewayOutlierDetection != nil {
+		api.gatewayController.SetOutlierDetection(*api.GatewayOutlierDetection)
+	}
+	if api.GatewayRetry != nil {
+		api.gatewayController.SetRetry(*api.GatewayRetry)
+	}
+	if api.GatewayCircuitBreaker != nil {
+		api.gatewayController.SetCircuitBreaker(*api.GatewayCircuitBreaker, api.GatewayCircuitBreakerPerInstance)
+	}
+	for appId, filters := range api.GatewayPathRewrites {
+		if err := api.gatewayController.SetPathRewrite(appId, filters); err != nil {
+			panic(err)
+		}
+	}
+	if api.GatewayRoutesFile != "" {
+		api.routesReloader = gateway.NewReloader(api.GatewayRoutesFile, api.gatewayController.ApplyConfig)
+		if _, err := api.routesReloader.Reload("startup"); err != nil {
+			panic(err)
+		}
+		if api.GatewayRoutesReloadInterval > 0 {
+			api.routesReloader.Watch(api.GatewayRoutesReloadInterval)
+		}
+		api.gatewayController.SetReloader(api.routesReloader)
+	}
+	if api.GatewayHashKey != "" {
+		if err := api.gatewayController.SetHashKey(api.GatewayHashKey); err != nil {
+			panic(err)
+		}
+	}
+	api.gatewayController.Handle(r)
+
+	// eureka is left out of the status handler, an unreachable registry is not a reason to leave it
+	indicators := health.NewComposite()
+	indicators.Add("db", health.DatabaseIndicator(database.Database, 3*time.Second))
+	indicators.Add("diskSpace", health.DiskSpaceIndicator(filepath.Dir(api.LogFilename), 10*1024*1024))
+	indicators.Add("eureka", health.EurekaIndicator(eureka, 3*30*time.Second))
+	eureka.SetHealthCheckHandler(health.NewEurekaStatusHandler(indicators.Without("eureka")))
+
+	controller.NewHealthController(indicators).Handle(r)
+}
+
+// instanceFilter keeps the UP instances matching the metadata filters and not denied, in zone when possible
+func (api *Api) instanceFilter(zone string) springcloud.InstanceFilter {
+	filters := springcloud.FilterChain{springcloud.DefaultInstanceFilter()}
+	for _, predicate := range api.GatewayMetadataFilters {
+		filter, err := springcloud.ParseMetadataFilter(predicate)
+		if err != nil {
+			panic(err)
+		}
+		filters = append(filters, filter)
+	}
+	filters = append(filters, api.gatewayController.DenyList())
+	// last, so that the zone is only preferred among the instances which may take traffic
+	if api.GatewayZoneAffinity {
+		filters = append(filters, springcloud.ZoneAffinityFilter{Zone: zone})
+	}
+	return filters
+}
+
+// Shutdown drains and deregisters through Registry.Shutdown, then stops the gateway
+func (api *Api) Shutdown(drainPeriod time.Duration) {
+	api.registry.Shutdown(drainPeriod)
+	api.gatewayController.Stop()
+	if api.routesReloader != nil {
+		api.routesReloader.Stop()
 	}
-	gatewayController.Handle(r)
 }